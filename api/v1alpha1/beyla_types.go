@@ -0,0 +1,111 @@
+/*
+Copyright 2023 Grafana Labs <hello@grafana.com>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+// BeylaConfig is the typed configuration of the autoinstrumenter. It is rendered into a
+// configuration file, stored in a ConfigMap that is managed by the operator.
+type BeylaConfig struct {
+	// LogLevel of the autoinstrumenter
+	// +kubebuilder:validation:Enum:="DEBUG";"INFO";"WARN";"ERROR"
+	// +optional
+	LogLevel string `json:"logLevel,omitempty"`
+
+	// Routes configures how the HTTP routes of the instrumented services are reported
+	// +optional
+	Routes *BeylaRoutes `json:"routes,omitempty"`
+
+	// Attributes configures the attributes of the reported metrics
+	// +optional
+	Attributes *BeylaAttributes `json:"attributes,omitempty"`
+
+	// Filters discard the telemetry whose attributes don't match the provided patterns
+	// +optional
+	Filters *BeylaFilters `json:"filters,omitempty"`
+
+	// Discovery configures how the processes of the instrumented Pods are discovered
+	// +optional
+	Discovery *BeylaDiscovery `json:"discovery,omitempty"`
+}
+
+type BeylaRoutes struct {
+	// Patterns of the reported routes, e.g. /users/{id}. Path parameters can be specified
+	// with the {name} or :name syntax.
+	// +optional
+	Patterns []string `json:"patterns,omitempty"`
+
+	// IgnoredPatterns are the route patterns that are not reported, e.g. health checks
+	// +optional
+	IgnoredPatterns []string `json:"ignoredPatterns,omitempty"`
+
+	// IgnoreMode specifies which signals ignore the IgnoredPatterns
+	// +kubebuilder:validation:Enum:="all";"traces";"metrics"
+	// +optional
+	IgnoreMode string `json:"ignoreMode,omitempty"`
+
+	// Unmatched specifies how the routes that don't match any pattern are reported
+	// +kubebuilder:validation:Enum:="unset";"path";"wildcard";"heuristic"
+	// +optional
+	Unmatched string `json:"unmatched,omitempty"`
+}
+
+type BeylaAttributes struct {
+	// Select the attributes reported by each metric family, e.g. http_server_request_duration,
+	// or by all the metric families matching a glob pattern, e.g. http_*
+	// +optional
+	Select map[string]AttributeSelection `json:"select,omitempty"`
+}
+
+type AttributeSelection struct {
+	// Include the attributes matching any of the glob patterns
+	// +optional
+	Include []string `json:"include,omitempty"`
+
+	// Exclude the attributes matching any of the glob patterns
+	// +optional
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+type BeylaFilters struct {
+	// Application filters the application metrics and traces, by attribute name
+	// +optional
+	Application map[string]MatchFilter `json:"application,omitempty"`
+
+	// Network filters the network metrics, by attribute name
+	// +optional
+	Network map[string]MatchFilter `json:"network,omitempty"`
+}
+
+type MatchFilter struct {
+	// Match keeps the telemetry whose attribute value matches the glob pattern
+	// +optional
+	Match string `json:"match,omitempty"`
+
+	// NotMatch keeps the telemetry whose attribute value doesn't match the glob pattern
+	// +optional
+	NotMatch string `json:"notMatch,omitempty"`
+}
+
+type BeylaDiscovery struct {
+	// ExcludeOTelInstrumentedServices avoids instrumenting the services that already export
+	// OpenTelemetry signals. The autoinstrumenter enables it by default.
+	// +optional
+	ExcludeOTelInstrumentedServices *bool `json:"excludeOTelInstrumentedServices,omitempty"`
+
+	// SkipGoSpecificTracers instruments the Go services with the generic tracers, as any other language
+	// +optional
+	SkipGoSpecificTracers bool `json:"skipGoSpecificTracers,omitempty"`
+}
@@ -0,0 +1,139 @@
+/*
+Copyright 2023 Grafana Labs <hello@grafana.com>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/yaml"
+
+	"github.com/grafana/ebpf-autoinstrument-operator/pkg/beyla"
+)
+
+const (
+	// location of the configuration file of the autoinstrumenter, in both Sidecar and DaemonSet modes
+	BeylaConfigDir  = "/config"
+	BeylaConfigFile = "beyla-config.yml"
+
+	// ConfigHashAnnotation stores the hash of the autoinstrumenter configuration file of an
+	// instrumented Pod, so the Pod is replaced when the configuration changes
+	ConfigHashAnnotation = "grafana.com/instrumenter-config-hash"
+
+	sidecarConfigVolume = "beyla-config"
+)
+
+// BeylaConfigFor returns the autoinstrumenter configuration file for the typed configuration
+// of the instrumenter
+func BeylaConfigFor(spec *InstrumenterSpec) *beyla.Config {
+	cfg := &beyla.Config{}
+	bc := spec.Beyla
+	if bc == nil {
+		return cfg
+	}
+	cfg.LogLevel = bc.LogLevel
+	if r := bc.Routes; r != nil {
+		cfg.Routes = &beyla.Routes{
+			Patterns:        r.Patterns,
+			IgnoredPatterns: r.IgnoredPatterns,
+			IgnoreMode:      r.IgnoreMode,
+			Unmatched:       r.Unmatched,
+		}
+	}
+	if a := bc.Attributes; a != nil && len(a.Select) > 0 {
+		cfg.Attributes = &beyla.Attributes{Select: map[string]beyla.Selection{}}
+		for metric, sel := range a.Select {
+			cfg.Attributes.Select[metric] = beyla.Selection{Include: sel.Include, Exclude: sel.Exclude}
+		}
+	}
+	if f := bc.Filters; f != nil {
+		cfg.Filter = &beyla.Filters{Application: matchFilters(f.Application), Network: matchFilters(f.Network)}
+	}
+	if d := bc.Discovery; d != nil {
+		cfg.Discovery = &beyla.Discovery{
+			ExcludeOTelInstrumentedServices: d.ExcludeOTelInstrumentedServices,
+			SkipGoSpecificTracers:           d.SkipGoSpecificTracers,
+		}
+	}
+	return cfg
+}
+
+func matchFilters(filters map[string]MatchFilter) map[string]beyla.MatchFilter {
+	if len(filters) == 0 {
+		return nil
+	}
+	out := make(map[string]beyla.MatchFilter, len(filters))
+	for attr, f := range filters {
+		out[attr] = beyla.MatchFilter{Match: f.Match, NotMatch: f.NotMatch}
+	}
+	return out
+}
+
+// SidecarConfig returns the ConfigMap name and the configuration file of the instrumenter sidecars,
+// or false if they don't need it. The name is suffixed with a hash of the instrumenter kind and name.
+func SidecarConfig(iq InstrumenterObject) (configMap string, file []byte, ok bool) {
+	spec := iq.GetSpec()
+	if spec.Beyla == nil || iq.GetMode() == ModeDaemonSet {
+		return "", nil, false
+	}
+	// marshalling can't fail, as the configuration only contains serializable fields
+	file, _ = yaml.Marshal(BeylaConfigFor(spec))
+	suffix := "-" + contentHash([]byte(iq.InstrumenterKind()+"/"+iq.GetName()))
+	return truncateName("beyla-config-"+iq.GetName(), validation.DNS1123SubdomainMaxLength-len(suffix)) + suffix,
+		file, true
+}
+
+// truncateName shortens the provided resource name to the given length, removing the trailing
+// separators that would make it invalid once suffixed
+func truncateName(name string, length int) string {
+	if len(name) <= length {
+		return name
+	}
+	return strings.TrimRight(name[:length], ".-")
+}
+
+// configSidecarFile mounts the configuration file volume in the autoinstrumenter sidecar
+func configSidecarFile(sidecar *v1.Container) {
+	sidecar.Env = append(sidecar.Env, v1.EnvVar{Name: "BEYLA_CONFIG_PATH", Value: BeylaConfigDir + "/" + BeylaConfigFile})
+	sidecar.VolumeMounts = append(sidecar.VolumeMounts,
+		v1.VolumeMount{Name: sidecarConfigVolume, MountPath: BeylaConfigDir, ReadOnly: true})
+}
+
+// sidecarVolumes returns the volumes that the instrumenter sidecar requires in the instrumented Pod
+func sidecarVolumes(iq InstrumenterObject) []v1.Volume {
+	volumes := ExporterVolumes(iq.GetSpec())
+	if configMap, _, ok := SidecarConfig(iq); ok {
+		volumes = append(volumes, v1.Volume{Name: sidecarConfigVolume, VolumeSource: v1.VolumeSource{
+			ConfigMap: &v1.ConfigMapVolumeSource{LocalObjectReference: v1.LocalObjectReference{Name: configMap}},
+		}})
+	}
+	return volumes
+}
+
+// instrumentationAnnotations returns the annotations that the instrumenter adds to the Pod:
+// the ones required by the exporters, and the hash of the sidecar configuration file
+func instrumentationAnnotations(iq InstrumenterObject, dst *v1.Pod) map[string]string {
+	annotations := exporterAnnotations(iq.GetSpec(), dst)
+	if _, file, ok := SidecarConfig(iq); ok {
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		annotations[ConfigHashAnnotation] = contentHash(file)
+	}
+	return annotations
+}
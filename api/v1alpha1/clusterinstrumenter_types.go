@@ -0,0 +1,84 @@
+/*
+Copyright 2023 Grafana Labs <hello@grafana.com>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ClusterInstrumenterSpec defines the desired state of ClusterInstrumenter
+type ClusterInstrumenterSpec struct {
+	InstrumenterSpec `json:",inline"`
+
+	// Mode of deployment of the autoinstrumenter. Sidecar mode injects an autoinstrumenter container
+	// into each selected Pod. DaemonSet mode deploys an autoinstrumenter Pod on each node, which
+	// discovers the selected Pods by their Kubernetes metadata, leaving the selected Pods untouched.
+	// +kubebuilder:default:="Sidecar"
+	Mode DeploymentMode `json:"mode,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:resource:path=clusterinstrumenters
+//+kubebuilder:resource:scope=Cluster
+//+kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].status`
+//+kubebuilder:printcolumn:name="Matched",type=integer,JSONPath=`.status.matchedPods`
+//+kubebuilder:printcolumn:name="Instrumented",type=integer,JSONPath=`.status.instrumentedPods`
+//+kubebuilder:printcolumn:name="Pending",type=integer,JSONPath=`.status.pendingPods`
+//+kubebuilder:printcolumn:name="Failed",type=integer,JSONPath=`.status.failedPods`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// ClusterInstrumenter is the Schema for the clusterinstrumenters API. It instruments the selected Pods
+// from the Namespaces matching Spec.Selector.NamespaceSelector, or from all of them if it is unset.
+type ClusterInstrumenter struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ClusterInstrumenterSpec `json:"spec,omitempty"`
+	Status InstrumenterStatus      `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// ClusterInstrumenterList contains a list of ClusterInstrumenter
+type ClusterInstrumenterList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ClusterInstrumenter `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&ClusterInstrumenter{}, &ClusterInstrumenterList{})
+}
+
+var _ InstrumenterObject = (*ClusterInstrumenter)(nil)
+
+func (in *ClusterInstrumenter) InstrumenterKind() string {
+	return KindClusterInstrumenter
+}
+
+func (in *ClusterInstrumenter) GetSpec() *InstrumenterSpec {
+	return &in.Spec.InstrumenterSpec
+}
+
+func (in *ClusterInstrumenter) GetMode() DeploymentMode {
+	return in.Spec.Mode
+}
+
+func (in *ClusterInstrumenter) GetStatus() *InstrumenterStatus {
+	return &in.Status
+}
@@ -0,0 +1,88 @@
+/*
+Copyright 2023 Grafana Labs <hello@grafana.com>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	v1 "k8s.io/api/core/v1"
+
+	"github.com/grafana/ebpf-autoinstrument-operator/pkg/helper"
+)
+
+// nodeAgentCapabilities are the Linux capabilities that allow the node agent to inspect the
+// processes of the whole node and attach the eBPF programs to them
+var nodeAgentCapabilities = []v1.Capability{
+	"BPF", "PERFMON", "NET_RAW", "CHECKPOINT_RESTORE",
+	// required to read the executables and memory maps of the processes of other users
+	"SYS_PTRACE", "DAC_READ_SEARCH",
+	// required to lock memory for the eBPF maps in kernels older than 5.11
+	"SYS_RESOURCE",
+}
+
+// BuildNodeAgent returns the autoinstrumenter container for the instrumenters in DaemonSet mode,
+// as well as the annotations of its Pod template
+func BuildNodeAgent(iq InstrumenterObject) (*v1.Container, map[string]string) {
+	spec := iq.GetSpec()
+	agent := &v1.Container{
+		Name:            instrumenterName,
+		Image:           spec.Image,
+		ImagePullPolicy: spec.ImagePullPolicy,
+		SecurityContext: nodeAgentSecurityContext(&spec.SecurityContext),
+		Env: []v1.EnvVar{
+			{Name: "BEYLA_CONFIG_PATH", Value: BeylaConfigDir + "/" + BeylaConfigFile},
+		},
+	}
+	configureExporters(spec, "", agent)
+	// the Kubernetes attributes of the instrumented Pods are added by the autoinstrumenter
+	if exportsOTLP(spec) {
+		configResourceAttributes(nil, spec.OpenTelemetry.ResourceAttributes, agent)
+	}
+
+	agent.Env = overrideEnv(agent.Env, spec.OverrideEnv)
+	return agent, exporterAnnotations(spec, &v1.Pod{})
+}
+
+// nodeAgentSecurityContext runs the node agent as root with the node-level capabilities. As it
+// only reads its configuration file, its root filesystem is read-only.
+func nodeAgentSecurityContext(sc *SecurityContext) *v1.SecurityContext {
+	if sc.Mode == SecurityPrivileged {
+		return &v1.SecurityContext{
+			Privileged:             helper.Ptr(true),
+			RunAsUser:              helper.Ptr(int64(0)),
+			ReadOnlyRootFilesystem: helper.Ptr(true),
+		}
+	}
+	return &v1.SecurityContext{
+		Privileged:               helper.Ptr(false),
+		AllowPrivilegeEscalation: helper.Ptr(false),
+		RunAsUser:                helper.Ptr(int64(0)),
+		ReadOnlyRootFilesystem:   helper.Ptr(true),
+		Capabilities: &v1.Capabilities{
+			Drop: []v1.Capability{"ALL"},
+			Add:  append(append([]v1.Capability{}, nodeAgentCapabilities...), sc.AddCapabilities...),
+		},
+	}
+}
+
+// SelectedByDaemonSet returns whether the Pod is selected by a ClusterInstrumenter in DaemonSet mode,
+// so no other instrumenter should add a sidecar to it
+func SelectedByDaemonSet(iq InstrumenterObject, dst *v1.Pod) bool {
+	if iq.GetMode() != ModeDaemonSet {
+		return false
+	}
+	selected, err := iq.GetSpec().Selector.SelectsPod(dst)
+	return err == nil && selected
+}
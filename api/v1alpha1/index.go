@@ -0,0 +1,170 @@
+/*
+Copyright 2023 Grafana Labs <hello@grafana.com>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	v1 "k8s.io/api/core/v1"
+	toolscache "k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+)
+
+// instrumenterIndex keeps the cached instrumenters indexed by namespace and port label, for the Pod webhook.
+// The returned instrumenters are shared with the informer cache, so they must not be modified.
+type instrumenterIndex struct {
+	mt sync.RWMutex
+	// namespace (empty for ClusterInstrumenters) -> port label -> instrumenter name -> instrumenter
+	entries map[string]map[string]map[string]InstrumenterObject
+	// port label of each indexed instrumenter, to find its entry when it is updated or removed
+	portLabels map[instrumenterKey]string
+	synced     []func() bool
+}
+
+type instrumenterKey struct {
+	namespace string
+	name      string
+}
+
+func newInstrumenterIndex() *instrumenterIndex {
+	return &instrumenterIndex{
+		entries:    map[string]map[string]map[string]InstrumenterObject{},
+		portLabels: map[instrumenterKey]string{},
+	}
+}
+
+// watchInstrumenters feeds the index from the informers of the Instrumenters and
+// ClusterInstrumenters in the provided cache
+func watchInstrumenters(ctx context.Context, c cache.Cache) (*instrumenterIndex, error) {
+	idx := newInstrumenterIndex()
+	handler := toolscache.ResourceEventHandlerFuncs{
+		AddFunc:    idx.add,
+		UpdateFunc: func(_, newObj interface{}) { idx.add(newObj) },
+		DeleteFunc: idx.remove,
+	}
+	for _, obj := range []InstrumenterObject{&Instrumenter{}, &ClusterInstrumenter{}} {
+		informer, err := c.GetInformer(ctx, obj)
+		if err != nil {
+			return nil, fmt.Errorf("getting %s informer: %w", obj.InstrumenterKind(), err)
+		}
+		if _, err := informer.AddEventHandler(handler); err != nil {
+			return nil, fmt.Errorf("watching %s: %w", obj.InstrumenterKind(), err)
+		}
+		idx.synced = append(idx.synced, informer.HasSynced)
+	}
+	return idx, nil
+}
+
+// hasSynced returns whether the index contains all the instrumenters from the cluster
+func (idx *instrumenterIndex) hasSynced() bool {
+	for _, synced := range idx.synced {
+		if !synced() {
+			return false
+		}
+	}
+	return true
+}
+
+func (idx *instrumenterIndex) add(obj interface{}) {
+	iq, ok := obj.(InstrumenterObject)
+	if !ok {
+		return
+	}
+	key := instrumenterKey{namespace: iq.GetNamespace(), name: iq.GetName()}
+	idx.mt.Lock()
+	defer idx.mt.Unlock()
+	idx.unindex(key)
+	portLabel := iq.GetSpec().Selector.PortLabel
+	byPortLabel, ok := idx.entries[key.namespace]
+	if !ok {
+		byPortLabel = map[string]map[string]InstrumenterObject{}
+		idx.entries[key.namespace] = byPortLabel
+	}
+	byName, ok := byPortLabel[portLabel]
+	if !ok {
+		byName = map[string]InstrumenterObject{}
+		byPortLabel[portLabel] = byName
+	}
+	byName[key.name] = iq
+	idx.portLabels[key] = portLabel
+}
+
+func (idx *instrumenterIndex) remove(obj interface{}) {
+	if tombstone, ok := obj.(toolscache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	iq, ok := obj.(InstrumenterObject)
+	if !ok {
+		return
+	}
+	idx.mt.Lock()
+	defer idx.mt.Unlock()
+	idx.unindex(instrumenterKey{namespace: iq.GetNamespace(), name: iq.GetName()})
+}
+
+// unindex removes the entry of the instrumenter, as well as the maps that become empty.
+// The caller must hold the write lock.
+func (idx *instrumenterIndex) unindex(key instrumenterKey) {
+	portLabel, ok := idx.portLabels[key]
+	if !ok {
+		return
+	}
+	delete(idx.portLabels, key)
+	byPortLabel := idx.entries[key.namespace]
+	delete(byPortLabel[portLabel], key.name)
+	if len(byPortLabel[portLabel]) == 0 {
+		delete(byPortLabel, portLabel)
+	}
+	if len(byPortLabel) == 0 {
+		delete(idx.entries, key.namespace)
+	}
+}
+
+// candidates returns the instrumenters whose port label is set in the Pod, sorted by precedence:
+// first the Instrumenters in the Pod namespace, then the ClusterInstrumenters (see Precedes).
+func (idx *instrumenterIndex) candidates(pod *v1.Pod) []InstrumenterObject {
+	idx.mt.RLock()
+	defer idx.mt.RUnlock()
+	cluster := idx.withPortLabels("", pod.Labels)
+	if pod.Namespace == "" {
+		return cluster
+	}
+	return append(idx.withPortLabels(pod.Namespace, pod.Labels), cluster...)
+}
+
+func (idx *instrumenterIndex) withPortLabels(namespace string, podLabels map[string]string) []InstrumenterObject {
+	byPortLabel := idx.entries[namespace]
+	if len(byPortLabel) == 0 {
+		return nil
+	}
+	var found []InstrumenterObject
+	for label, value := range podLabels {
+		if value == "" {
+			continue
+		}
+		for _, iq := range byPortLabel[label] {
+			found = append(found, iq)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return Precedes(found[i], found[j])
+	})
+	return found
+}
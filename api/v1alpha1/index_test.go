@@ -0,0 +1,130 @@
+/*
+Copyright 2023 Grafana Labs <hello@grafana.com>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	toolscache "k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestInstrumenterIndex(t *testing.T) {
+	idx := newInstrumenterIndex()
+	instrumenter := func(ns, name, portLabel string) *Instrumenter {
+		return &Instrumenter{ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: name},
+			Spec: InstrumenterSpec{Selector: Selector{PortLabel: portLabel}}}
+	}
+	clusterInstrumenter := func(name, portLabel string) *ClusterInstrumenter {
+		return &ClusterInstrumenter{ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec: ClusterInstrumenterSpec{InstrumenterSpec: InstrumenterSpec{Selector: Selector{PortLabel: portLabel}}}}
+	}
+	idx.add(instrumenter("default", "b", "instrument"))
+	idx.add(instrumenter("default", "a", "instrument"))
+	idx.add(instrumenter("default", "other-label", "other"))
+	idx.add(instrumenter("other-ns", "c", "instrument"))
+	idx.add(clusterInstrumenter("a", "instrument"))
+	idx.add(clusterInstrumenter("z", "instrument"))
+
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Namespace: "default", Labels: map[string]string{"instrument": "8080", "app": "foo"},
+	}}
+	names := func() []string {
+		var names []string
+		for _, iq := range idx.candidates(pod) {
+			names = append(names, iq.InstrumenterKind()+"/"+iq.GetName())
+		}
+		return names
+	}
+	expected := []string{"Instrumenter/a", "Instrumenter/b", "ClusterInstrumenter/a", "ClusterInstrumenter/z"}
+	if got := names(); fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("expected %v. Got %v", expected, got)
+	}
+
+	// updating the port label moves the instrumenter to another entry
+	idx.add(instrumenter("default", "b", "other"))
+	// removals can be notified as tombstones
+	idx.remove(toolscache.DeletedFinalStateUnknown{Obj: clusterInstrumenter("z", "instrument")})
+	expected = []string{"Instrumenter/a", "ClusterInstrumenter/a"}
+	if got := names(); fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("expected %v. Got %v", expected, got)
+	}
+
+	// higher priorities take precedence within the same kind
+	prioritized := clusterInstrumenter("y", "instrument")
+	prioritized.Spec.Priority = 5
+	idx.add(prioritized)
+	expected = []string{"Instrumenter/a", "ClusterInstrumenter/y", "ClusterInstrumenter/a"}
+	if got := names(); fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("expected %v. Got %v", expected, got)
+	}
+
+	// empty label values don't select the Pod
+	pod.Labels["instrument"] = ""
+	if got := names(); len(got) != 0 {
+		t.Errorf("expected no instrumenters. Got %v", got)
+	}
+}
+
+// BenchmarkPodWebhook measures the latency of the Pod admission with thousands of instrumenters,
+// either listing them from the client on each request, or taking them from the index.
+func BenchmarkPodWebhook(b *testing.B) {
+	scheme := runtime.NewScheme()
+	_ = v1.AddToScheme(scheme)
+	_ = AddToScheme(scheme)
+	for _, instrumenters := range []int{100, 1000, 5000} {
+		objs := make([]client.Object, 0, instrumenters)
+		idx := newInstrumenterIndex()
+		for i := 0; i < instrumenters; i++ {
+			// a few instrumenters per namespace, plus some ClusterInstrumenters
+			var iq InstrumenterObject = &Instrumenter{ObjectMeta: metav1.ObjectMeta{
+				Namespace: fmt.Sprintf("ns-%d", i/4), Name: fmt.Sprintf("instr-%d", i),
+			}}
+			if i%10 == 0 {
+				iq = &ClusterInstrumenter{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("cluster-%d", i)}}
+			}
+			iq.GetSpec().Selector.PortLabel = fmt.Sprintf("instrument-port-%d", i)
+			objs = append(objs, iq)
+			idx.add(iq)
+		}
+		cl := fake.NewClientBuilder().WithScheme(scheme).WithObjects(objs...).Build()
+		pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Name: "pod", Namespace: "ns-1", Labels: map[string]string{"instrument-port-5": "8080"},
+		}}
+		for _, tc := range []struct {
+			name    string
+			webhook *podSidecarWebHook
+		}{
+			{name: "list", webhook: &podSidecarWebHook{Client: cl}},
+			{name: "index", webhook: &podSidecarWebHook{Client: cl, index: idx}},
+		} {
+			b.Run(fmt.Sprintf("%s/%d", tc.name, instrumenters), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					if err := tc.webhook.Default(context.Background(), pod.DeepCopy()); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
@@ -19,6 +19,7 @@ package v1alpha1
 import (
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 // Exporter type for metrics
@@ -31,10 +32,18 @@ const (
 	ExporterOTELTraces  = "OpenTelemetryTraces"
 )
 
+const (
+	KindInstrumenter        = "Instrumenter"
+	KindClusterInstrumenter = "ClusterInstrumenter"
+)
+
+// DefaultImage of the autoinstrumenter. It must match the default value of the Image field.
+const DefaultImage = "grafana/ebpf-autoinstrument:latest"
+
 // InstrumenterSpec defines the desired state of Instrumenter
 type InstrumenterSpec struct {
 	// Image allows overriding the autoinstrumenter container image for development purposes
-	// +kubebuilder:validate:MinLength:=1
+	// +kubebuilder:validation:MinLength:=1
 	// +kubebuilder:default:="grafana/ebpf-autoinstrument:latest"
 	// TODO: make Image values optional and use relatedImages sections in bundle
 	Image string `json:"image,omitempty"`
@@ -52,6 +61,26 @@ type InstrumenterSpec struct {
 	// +kubebuilder:default:={portLabel:"grafana.com/instrument-port"}
 	Selector Selector `json:"selector,omitempty"`
 
+	// Priority resolves the conflicts between instrumenters of the same kind that select the same
+	// Pods: the instrumenter with the highest priority instruments them, and ties are broken by the
+	// alphabetical order of the instrumenter names. Namespaced Instrumenters always take precedence
+	// over ClusterInstrumenters, whatever their priority. The instrumenters that lose a conflict
+	// report the contested Pods in their Conflicting status condition. Overlapping selectors are
+	// therefore allowed, and only reported as a warning on admission.
+	// +optional
+	Priority int32 `json:"priority,omitempty"`
+
+	// SecurityContext defines the privileges granted to the autoinstrumenter sidecar, or to the
+	// node agent of the ClusterInstrumenters in DaemonSet mode
+	// +kubebuilder:default:={mode:"Capabilities"}
+	SecurityContext SecurityContext `json:"securityContext,omitempty"`
+
+	// ServiceName defines how the name of the instrumented services is resolved from the Pods
+	// metadata. If the resolution fails, the name of the top-level workload owning the Pod is used,
+	// or the Pod name if the Pod has no owners.
+	// +kubebuilder:default:={sources:{{type:"Annotation",key:"resource.opentelemetry.io/service.name"},{type:"Label",key:"app.kubernetes.io/name"},{type:"OwnerName"},{type:"PodName"}}}
+	ServiceName ServiceNamePolicy `json:"serviceName,omitempty"`
+
 	// Prometheus allows configuring the autoinstrumenter as a Prometheus pull exporter.
 	// +kubebuilder:default:={path:"/metrics"}
 	Prometheus Prometheus `json:"prometheus,omitempty"`
@@ -61,8 +90,14 @@ type InstrumenterSpec struct {
 	// +kubebuilder:default:={interval:"5s"}
 	OpenTelemetry OpenTelemetry `json:"openTelemetry,omitempty"`
 
+	// Beyla is the typed configuration of the autoinstrumenter. In Sidecar mode, it is stored in a
+	// ConfigMap in the namespace of each instrumented Pod. Changing it replaces the instrumented Pods.
+	// +optional
+	Beyla *BeylaConfig `json:"beyla,omitempty"`
+
 	// OverrideEnv allows overriding the autoinstrumenter env vars for fine-grained
-	// configuration
+	// configuration. The variables replace any variable with the same name that is generated
+	// by the operator.
 	// +optional
 	OverrideEnv []v1.EnvVar `json:"overrideEnv,omitempty"`
 }
@@ -75,6 +110,107 @@ type Selector struct {
 	// +optional
 	// +kubebuilder:default:="grafana.com/instrument-port"
 	PortLabel string `json:"portLabel"`
+
+	// MatchLabels restricts the selection to the Pods whose labels contain all the
+	// key-value pairs of this map
+	// +optional
+	MatchLabels map[string]string `json:"matchLabels,omitempty"`
+
+	// MatchExpressions restricts the selection to the Pods whose labels satisfy all
+	// the label selector requirements of this list
+	// +optional
+	MatchExpressions []metav1.LabelSelectorRequirement `json:"matchExpressions,omitempty"`
+
+	// NamespaceSelector restricts the selection to the Pods whose Namespace labels match
+	// the given selector. If unset, the Pod Namespace labels are not taken into account.
+	// The Pods of the kube-system, kube-public and kube-node-lease namespaces, as well as the
+	// namespace of the operator, are never instrumented.
+	// +optional
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+}
+
+// DeploymentMode specifies how the autoinstrumenter is deployed
+// +kubebuilder:validation:Enum:="Sidecar";"DaemonSet"
+type DeploymentMode string
+
+const (
+	// ModeSidecar injects the autoinstrumenter as a sidecar container of the selected Pods
+	ModeSidecar DeploymentMode = "Sidecar"
+	// ModeDaemonSet deploys the autoinstrumenter as a DaemonSet that instruments the selected
+	// Pods from each node
+	ModeDaemonSet DeploymentMode = "DaemonSet"
+)
+
+// SecurityMode specifies how the autoinstrumenter sidecar is granted the privileges required
+// to load the eBPF programs
+// +kubebuilder:validation:Enum:="Privileged";"Capabilities"
+type SecurityMode string
+
+const (
+	// SecurityPrivileged runs the sidecar as a privileged container
+	SecurityPrivileged SecurityMode = "Privileged"
+	// SecurityCapabilities runs the sidecar as a non-privileged container that is only granted the
+	// Linux capabilities required by eBPF. It requires a Linux kernel 5.8 or newer.
+	SecurityCapabilities SecurityMode = "Capabilities"
+)
+
+// SecurityContext of the autoinstrumenter sidecar
+type SecurityContext struct {
+	// Mode of the sidecar security context. The Capabilities mode grants the BPF, PERFMON,
+	// SYS_PTRACE, NET_RAW, CHECKPOINT_RESTORE, DAC_READ_SEARCH and SYS_RESOURCE capabilities.
+	// Use the Privileged mode for older kernels that don't provide the BPF and PERFMON capabilities.
+	// +kubebuilder:default:="Capabilities"
+	Mode SecurityMode `json:"mode,omitempty"`
+
+	// AddCapabilities grants extra Linux capabilities to the sidecar in Capabilities mode
+	// (e.g. SYS_ADMIN or NET_ADMIN)
+	// +optional
+	AddCapabilities []v1.Capability `json:"addCapabilities,omitempty"`
+}
+
+// ServiceNameSourceType specifies where a service name is taken from
+// +kubebuilder:validation:Enum:="Annotation";"Label";"OwnerName";"PodName";"Template"
+type ServiceNameSourceType string
+
+const (
+	// ServiceNameAnnotation takes the service name from the value of a Pod annotation
+	ServiceNameAnnotation ServiceNameSourceType = "Annotation"
+	// ServiceNameLabel takes the service name from the value of a Pod label
+	ServiceNameLabel ServiceNameSourceType = "Label"
+	// ServiceNameOwnerName takes the service name from the top-level workload owning the Pod
+	// (e.g. Deployment, StatefulSet, DaemonSet, CronJob...)
+	ServiceNameOwnerName ServiceNameSourceType = "OwnerName"
+	// ServiceNamePodName takes the service name from the Pod name, which the sidecar reads from the
+	// Downward API, as the Pods created by workloads get their name after being instrumented
+	ServiceNamePodName ServiceNameSourceType = "PodName"
+	// ServiceNameTemplate composes the service name from a template with placeholders
+	ServiceNameTemplate ServiceNameSourceType = "Template"
+)
+
+// ServiceNamePolicy defines how the service name is resolved for each instrumented Pod
+type ServiceNamePolicy struct {
+	// Sources of the service name, in order of preference. The first source providing a non-empty
+	// value is used.
+	// +optional
+	Sources []ServiceNameSource `json:"sources,omitempty"`
+}
+
+// ServiceNameSource defines a source of the service name
+type ServiceNameSource struct {
+	// Type of the source
+	Type ServiceNameSourceType `json:"type"`
+
+	// Key of the Pod annotation or label. Only for the Annotation and Label source types.
+	// +optional
+	Key string `json:"key,omitempty"`
+
+	// Template of the service name. Only for the Template source type.
+	// It accepts the following placeholders: {namespace}, {pod}, {owner}, {ownerKind},
+	// {label:<key>} and {annotation:<key>}. If any placeholder resolves to an empty value,
+	// the source is skipped.
+	// For example: "{label:app.kubernetes.io/part-of}-{owner}".
+	// +optional
+	Template string `json:"template,omitempty"`
 }
 
 type Prometheus struct {
@@ -82,14 +218,57 @@ type Prometheus struct {
 	Path string `json:"path,omitempty"`
 
 	// +kubebuilder:default:=9102
-	// +kubebuilder:validate:Minimum:=1
-	// +kubebuilder:validate:Maximum:=65535
+	// +kubebuilder:validation:Minimum:=1
+	// +kubebuilder:validation:Maximum:=65535
 	Port int `json:"port,omitempty"`
 
 	// +kubebuilder:default:={scrape:"prometheus.io/scrape"}
 	Annotations PrometheusAnnotations `json:"annotations,omitempty"`
+
+	// OnAnnotationConflict specifies what to do when an instrumented Pod already defines its own
+	// Prometheus scrape annotation. Keep leaves the Pod annotations untouched, so the autoinstrumenter
+	// metrics are not scraped through annotations, and reports it in the PrometheusAnnotationConflict
+	// status condition. Overwrite replaces the Pod annotations. UseAlternative annotates the
+	// autoinstrumenter metrics with the AlternativeAnnotations keys.
+	// +kubebuilder:default:="Keep"
+	OnAnnotationConflict AnnotationConflictPolicy `json:"onAnnotationConflict,omitempty"`
+
+	// AlternativeAnnotations are used instead of the Annotations when the OnAnnotationConflict
+	// policy is UseAlternative and the Pod already defines its own Prometheus scrape annotation
+	// +kubebuilder:default:={scrape:"grafana.com/beyla-scrape",scheme:"grafana.com/beyla-scheme",port:"grafana.com/beyla-port",path:"grafana.com/beyla-path"}
+	AlternativeAnnotations PrometheusAnnotations `json:"alternativeAnnotations,omitempty"`
+
+	// PodMonitor configures the generation of a prometheus-operator PodMonitor that scrapes the
+	// autoinstrumenter metrics of the instrumented Pods. Only supported by namespaced Instrumenters
+	// in Sidecar mode: ClusterInstrumenters enabling it are rejected.
+	// +optional
+	PodMonitor PodMonitor `json:"podMonitor,omitempty"`
 }
 
+type PodMonitor struct {
+	// Enabled makes the operator create a PodMonitor for the Pods instrumented by the Instrumenter.
+	// It requires the prometheus-operator CustomResourceDefinitions to be installed in the cluster.
+	// +optional
+	Enabled bool `json:"enabled,omitempty"`
+
+	// Labels of the PodMonitor, e.g. to match the podMonitorSelector of the Prometheus instances
+	// +optional
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// AnnotationConflictPolicy specifies how to proceed when a Pod defines its own Prometheus annotations
+// +kubebuilder:validation:Enum:="Keep";"Overwrite";"UseAlternative"
+type AnnotationConflictPolicy string
+
+const (
+	// AnnotationConflictKeep keeps the Pod Prometheus annotations
+	AnnotationConflictKeep AnnotationConflictPolicy = "Keep"
+	// AnnotationConflictOverwrite overwrites the Pod Prometheus annotations
+	AnnotationConflictOverwrite AnnotationConflictPolicy = "Overwrite"
+	// AnnotationConflictUseAlternative uses alternative annotations for the autoinstrumenter metrics
+	AnnotationConflictUseAlternative AnnotationConflictPolicy = "UseAlternative"
+)
+
 type PrometheusAnnotations struct {
 	// +kubebuilder:default:="prometheus.io/scrape"
 	Scrape string `json:"scrape,omitempty"`
@@ -105,11 +284,24 @@ type PrometheusAnnotations struct {
 }
 
 type OpenTelemetry struct {
-	// Endpoint of the OpenTelemetry collector
+	// Endpoint of the OpenTelemetry collector, for the signals that don't specify their own endpoint.
+	// It must be an absolute http or https URL, and it is required by the OpenTelemetry exporters
+	// unless all their signals specify their own endpoint.
 	// +optional
-	// TODO: properly validate URL (or empty value)
 	Endpoint string `json:"endpoint,omitempty"`
 
+	// Protocol of the OTLP exporters, for the signals that don't specify their own protocol
+	// +kubebuilder:default:="http/protobuf"
+	Protocol OTLPProtocol `json:"protocol,omitempty"`
+
+	// Metrics configures the OTLP export of metrics, when the OpenTelemetryMetrics exporter is enabled
+	// +optional
+	Metrics OTLPSignal `json:"metrics,omitempty"`
+
+	// Traces configures the OTLP export of traces, when the OpenTelemetryTraces exporter is enabled
+	// +optional
+	Traces OTLPSignal `json:"traces,omitempty"`
+
 	// InsecureSkipVerify controls whether the instrumenter OTEL client verifies the server's
 	// certificate chain and host name.
 	// If set to `true`, the OTEL client accepts any certificate presented by the server
@@ -118,21 +310,291 @@ type OpenTelemetry struct {
 	// +kubebuilder:default:=false
 	InsecureSkipVerify bool `json:"insecureSkipVerify,omitempty"`
 
+	// TLS configures the certificates of the TLS connections to the OTLP endpoints. The referred
+	// ConfigMaps and Secrets must exist in the namespace of the instrumented Pods or, in DaemonSet
+	// mode, in the namespace of the autoinstrumenter DaemonSet.
+	// +optional
+	TLS *OTLPTLS `json:"tls,omitempty"`
+
+	// Headers added to the OTLP export requests of all the signals, e.g. for authentication.
+	// The Secrets referred by the headers must exist in the namespace of the instrumented Pods
+	// or, in DaemonSet mode, in the namespace of the autoinstrumenter DaemonSet.
+	// +optional
+	Headers []OTLPHeader `json:"headers,omitempty"`
+
+	// ResourceAttributes are added to the OpenTelemetry resource of the exported metrics and traces,
+	// besides the Kubernetes attributes of the instrumented Pod (e.g. k8s.pod.name, k8s.node.name
+	// or k8s.deployment.name), which can be overridden here. Values are passed verbatim to the
+	// autoinstrumenter, so they should be percent-encoded if they contain commas.
+	// +optional
+	ResourceAttributes map[string]string `json:"resourceAttributes,omitempty"`
+
 	// Interval is the intervening time between metrics exports
 	// +kubebuilder:default:="5s"
 	Interval metav1.Duration `json:"interval,omitempty"`
+
+	// ExportTimeout is the maximum time that each trace spans export request waits for the OTLP
+	// endpoint. The autoinstrumenter doesn't support it for metrics. If empty, the autoinstrumenter
+	// default is used.
+	// +optional
+	ExportTimeout metav1.Duration `json:"exportTimeout,omitempty"`
+
+	// Sampler of the exported traces. If empty, the autoinstrumenter default sampler is used.
+	// +optional
+	Sampler *Sampler `json:"sampler,omitempty"`
+
+	// Batch configures the batching of the exported trace spans
+	// +optional
+	Batch OTLPBatch `json:"batch,omitempty"`
+
+	// Retry configures the exponential backoff of the export requests that failed
+	// +optional
+	Retry OTLPRetry `json:"retry,omitempty"`
+}
+
+// Sampler decides which traces are exported
+type Sampler struct {
+	// Name of the sampler, as defined by the OpenTelemetry specification
+	Name SamplerName `json:"name"`
+
+	// Ratio of the sampled traces, from 0 to 1, for the traceidratio and parentbased_traceidratio
+	// samplers. If empty, all the traces are sampled.
+	// +kubebuilder:validation:Pattern:=`^(0(\.[0-9]+)?|1(\.0+)?)$`
+	// +optional
+	Ratio string `json:"ratio,omitempty"`
 }
 
+// SamplerName is the name of a trace sampler
+// +kubebuilder:validation:Enum:="always_on";"always_off";"traceidratio";"parentbased_always_on";"parentbased_always_off";"parentbased_traceidratio"
+type SamplerName string
+
+const (
+	SamplerAlwaysOn                SamplerName = "always_on"
+	SamplerAlwaysOff               SamplerName = "always_off"
+	SamplerTraceIDRatio            SamplerName = "traceidratio"
+	SamplerParentBasedAlwaysOn     SamplerName = "parentbased_always_on"
+	SamplerParentBasedAlwaysOff    SamplerName = "parentbased_always_off"
+	SamplerParentBasedTraceIDRatio SamplerName = "parentbased_traceidratio"
+)
+
+// OTLPBatch configures the batching of the exported trace spans. Empty fields take the
+// autoinstrumenter default values.
+type OTLPBatch struct {
+	// MaxExportBatchSize is the maximum number of spans of each export request
+	// +kubebuilder:validation:Minimum:=1
+	// +optional
+	MaxExportBatchSize int32 `json:"maxExportBatchSize,omitempty"`
+
+	// MaxQueueSize is the maximum number of spans that are buffered before being exported.
+	// Further spans are dropped.
+	// +kubebuilder:validation:Minimum:=1
+	// +optional
+	MaxQueueSize int32 `json:"maxQueueSize,omitempty"`
+
+	// ScheduleDelay is the maximum time between two consecutive exports
+	// +optional
+	ScheduleDelay metav1.Duration `json:"scheduleDelay,omitempty"`
+}
+
+// OTLPRetry configures the exponential backoff of the failed export requests. Empty fields
+// take the autoinstrumenter default values.
+type OTLPRetry struct {
+	// InitialInterval is the time to wait after the first failure before retrying
+	// +optional
+	InitialInterval metav1.Duration `json:"initialInterval,omitempty"`
+
+	// MaxInterval is the upper bound of the time between two consecutive retries
+	// +optional
+	MaxInterval metav1.Duration `json:"maxInterval,omitempty"`
+
+	// MaxElapsedTime is the maximum time spent retrying an export request, after which the
+	// exported data is dropped
+	// +optional
+	MaxElapsedTime metav1.Duration `json:"maxElapsedTime,omitempty"`
+}
+
+// OTLPSignal configures where a given signal is exported to
+type OTLPSignal struct {
+	// Endpoint of the OpenTelemetry collector for the signal. If empty, the OpenTelemetry
+	// Endpoint is used.
+	// +optional
+	Endpoint string `json:"endpoint,omitempty"`
+
+	// Path of the signal in the endpoint. If empty, the OTLP default path for the signal is used
+	// (/v1/metrics or /v1/traces). Only valid for the http/protobuf protocol, as gRPC endpoints
+	// don't have a path.
+	// +optional
+	Path string `json:"path,omitempty"`
+
+	// Protocol of the OTLP exporter for the signal. If empty, the OpenTelemetry Protocol is used.
+	// +optional
+	Protocol OTLPProtocol `json:"protocol,omitempty"`
+}
+
+// OTLPTLS specifies the certificates of the TLS connections to the OTLP endpoints
+type OTLPTLS struct {
+	// CA bundle to verify the certificates of the OTLP endpoints, instead of the system CAs
+	// +optional
+	CA *CABundle `json:"ca,omitempty"`
+
+	// ClientCertificate to authenticate the autoinstrumenter against the OTLP endpoints (mTLS)
+	// +optional
+	ClientCertificate *ClientCertificate `json:"clientCertificate,omitempty"`
+}
+
+// CABundle selects a PEM-encoded CA bundle from either a ConfigMap or a Secret key
+type CABundle struct {
+	// ConfigMapKeyRef selects the CA bundle from a ConfigMap key
+	// +optional
+	ConfigMapKeyRef *v1.ConfigMapKeySelector `json:"configMapKeyRef,omitempty"`
+
+	// SecretKeyRef selects the CA bundle from a Secret key
+	// +optional
+	SecretKeyRef *v1.SecretKeySelector `json:"secretKeyRef,omitempty"`
+}
+
+// ClientCertificate selects a PEM-encoded client certificate and its private key from a Secret,
+// e.g. of type kubernetes.io/tls
+type ClientCertificate struct {
+	// SecretName is the name of the Secret with the client certificate and key
+	// +kubebuilder:validation:MinLength:=1
+	SecretName string `json:"secretName"`
+
+	// CertificateKey is the Secret key of the client certificate
+	// +kubebuilder:default:="tls.crt"
+	CertificateKey string `json:"certificateKey,omitempty"`
+
+	// PrivateKeyKey is the Secret key of the client private key
+	// +kubebuilder:default:="tls.key"
+	PrivateKeyKey string `json:"privateKeyKey,omitempty"`
+}
+
+// OTLPHeader is an HTTP or gRPC header of the OTLP export requests
+type OTLPHeader struct {
+	// Name of the header
+	// +kubebuilder:validation:MinLength:=1
+	Name string `json:"name"`
+
+	// Value of the header. It is passed verbatim to the autoinstrumenter, so it should be
+	// percent-encoded if it contains commas.
+	// +optional
+	Value string `json:"value,omitempty"`
+
+	// ValueFrom specifies the source of the header value. Cannot be used if Value is not empty.
+	// +optional
+	ValueFrom *OTLPHeaderSource `json:"valueFrom,omitempty"`
+}
+
+// OTLPHeaderSource is the source of an OTLP header value, which isn't stored in plain text
+// in the instrumented Pods
+type OTLPHeaderSource struct {
+	// SecretKeyRef selects a key of a Secret in the namespace of the instrumented Pod
+	SecretKeyRef *v1.SecretKeySelector `json:"secretKeyRef"`
+}
+
+// OTLPProtocol is the transport protocol of the OTLP exporters
+// +kubebuilder:validation:Enum:="grpc";"http/protobuf"
+type OTLPProtocol string
+
+const (
+	OTLPProtocolGRPC         OTLPProtocol = "grpc"
+	OTLPProtocolHTTPProtobuf OTLPProtocol = "http/protobuf"
+)
+
+// Condition types of the Instrumenter status
+const (
+	// ConditionReady is True when all the matched Pods are instrumented with an up-to-date sidecar
+	ConditionReady = "Ready"
+	// ConditionProgressing is True while there are matched Pods pending to be (re)instrumented
+	ConditionProgressing = "Progressing"
+	// ConditionDegraded is True when the instrumenter sidecar fails in any Pod, or the operator
+	// can't reconcile the instrumenter
+	ConditionDegraded = "Degraded"
+	// ConditionPrometheusConflict is True when some instrumented Pods keep their own Prometheus scrape
+	// annotations, so the autoinstrumenter metrics aren't annotated for scraping
+	ConditionPrometheusConflict = "PrometheusAnnotationConflict"
+	// ConditionMissedAdmission is True when some matched Pods were admitted without the instrumenter
+	// sidecar (e.g. because the webhook was unavailable), so the operator is replacing them
+	ConditionMissedAdmission = "MissedAdmission"
+	// ConditionConflicting is True when some Pods selected by the instrumenter are instrumented by
+	// other instrumenters that take precedence over it (see the Priority property)
+	ConditionConflicting = "Conflicting"
+)
+
+// PodState describes the instrumentation state of a Pod
+// +kubebuilder:validation:Enum:="Instrumented";"Pending";"Failed"
+type PodState string
+
+const (
+	// PodInstrumented means that the Pod runs an up-to-date instrumenter sidecar
+	PodInstrumented PodState = "Instrumented"
+	// PodPending means that the Pod is waiting to be (re)instrumented
+	PodPending PodState = "Pending"
+	// PodFailed means that the instrumenter sidecar of the Pod can't start or is crashing
+	PodFailed PodState = "Failed"
+)
+
+// MaxStatusPods is the maximum number of Pod references listed in the instrumenter status
+const MaxStatusPods = 50
+
 // InstrumenterStatus defines the observed state of Instrumenter
 type InstrumenterStatus struct {
-	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
-	// Important: Run "make" to regenerate code after modifying this file
+	// ObservedGeneration is the most recent generation of the instrumenter that has been reconciled
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// Conditions of the instrumenter: Ready, Progressing, Degraded, PrometheusAnnotationConflict,
+	// MissedAdmission and Conflicting
+	// +optional
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+
+	// MatchedPods is the number of Pods selected by this instrumenter
+	MatchedPods int32 `json:"matchedPods"`
+
+	// InstrumentedPods is the number of matched Pods running an up-to-date instrumenter sidecar
+	InstrumentedPods int32 `json:"instrumentedPods"`
+
+	// PendingPods is the number of matched Pods waiting to be (re)instrumented
+	PendingPods int32 `json:"pendingPods"`
+
+	// FailedPods is the number of matched Pods whose instrumenter sidecar can't start or is crashing
+	FailedPods int32 `json:"failedPods"`
+
+	// Pods lists the matched Pods and their instrumentation state. Failed and pending Pods are
+	// listed first. The list is truncated to a maximum of 50 elements.
+	// +optional
+	// +kubebuilder:validation:MaxItems:=50
+	Pods []PodReference `json:"pods,omitempty"`
+
+	// PodMonitor is the name of the PodMonitor created for the Pods instrumented by this instrumenter, if any
+	// +optional
+	PodMonitor string `json:"podMonitor,omitempty"`
+}
+
+// PodReference describes the instrumentation state of a Pod
+type PodReference struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+
+	State PodState `json:"state"`
+
+	// Message gives details about the Pod state, e.g. the failure reason
+	// +optional
+	Message string `json:"message,omitempty"`
 }
 
 //+kubebuilder:object:root=true
 //+kubebuilder:subresource:status
 //+kubebuilder:resource:path=instrumenters
 //+kubebuilder:resource:scope=Namespaced
+//+kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].status`
+//+kubebuilder:printcolumn:name="Matched",type=integer,JSONPath=`.status.matchedPods`
+//+kubebuilder:printcolumn:name="Instrumented",type=integer,JSONPath=`.status.instrumentedPods`
+//+kubebuilder:printcolumn:name="Pending",type=integer,JSONPath=`.status.pendingPods`
+//+kubebuilder:printcolumn:name="Failed",type=integer,JSONPath=`.status.failedPods`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
 
 // Instrumenter is the Schema for the instrumenters API
 type Instrumenter struct {
@@ -155,3 +617,35 @@ type InstrumenterList struct {
 func init() {
 	SchemeBuilder.Register(&Instrumenter{}, &InstrumenterList{})
 }
+
+// InstrumenterObject is implemented by the kinds that can instrument a Pod:
+// Instrumenter and ClusterInstrumenter
+// +kubebuilder:object:generate=false
+type InstrumenterObject interface {
+	client.Object
+	// InstrumenterKind returns the kind of the object, even if its TypeMeta is not set
+	InstrumenterKind() string
+	GetSpec() *InstrumenterSpec
+	GetStatus() *InstrumenterStatus
+	// GetMode returns the deployment mode of the autoinstrumenter
+	GetMode() DeploymentMode
+}
+
+var _ InstrumenterObject = (*Instrumenter)(nil)
+
+func (in *Instrumenter) InstrumenterKind() string {
+	return KindInstrumenter
+}
+
+func (in *Instrumenter) GetSpec() *InstrumenterSpec {
+	return &in.Spec
+}
+
+// GetMode returns ModeSidecar, as namespaced Instrumenters can't deploy the autoinstrumenter in the nodes
+func (in *Instrumenter) GetMode() DeploymentMode {
+	return ModeSidecar
+}
+
+func (in *Instrumenter) GetStatus() *InstrumenterStatus {
+	return &in.Status
+}
@@ -19,12 +19,21 @@ package v1alpha1
 import (
 	"context"
 	"fmt"
+	"net/http"
+	"sort"
 
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
 	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
 
 	"github.com/grafana/ebpf-autoinstrument-operator/pkg/helper/lvl"
+	"github.com/grafana/ebpf-autoinstrument-operator/pkg/owner"
+	admissionv1 "k8s.io/api/admission/v1"
 	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -36,21 +45,44 @@ var webhookLog = logf.Log.WithName("pod-sidecar-webhook")
 
 type podSidecarWebHook struct {
 	client.Client
+	// index of the instrumenters from the informer cache. If nil or not synced yet, the
+	// instrumenters are listed from the Client.
+	index *instrumenterIndex
 }
 
 // SetupWebhookWithManager needs to manually register the webhook (not using the kubebuilder/operator-sdk workflow)
 // as it needs to be registered towards a core type that is not registerd as type by the controller.
 func SetupWebhookWithManager(mgr ctrl.Manager) error {
 	webhookLog.Info("registering webhook server")
-	return builder.WebhookManagedBy(mgr).
+	index, err := watchInstrumenters(context.Background(), mgr.GetCache())
+	if err != nil {
+		return fmt.Errorf("indexing instrumenters: %w", err)
+	}
+	if err := builder.WebhookManagedBy(mgr).
 		For(&v1.Pod{}).
-		WithDefaulter(&podSidecarWebHook{Client: mgr.GetClient()}).
-		Complete()
+		WithDefaulter(&podSidecarWebHook{Client: mgr.GetClient(), index: index}).
+		Complete(); err != nil {
+		return err
+	}
+	decoder, err := admission.NewDecoder(mgr.GetScheme())
+	if err != nil {
+		return fmt.Errorf("creating admission decoder: %w", err)
+	}
+	validator := &instrumenterValidator{Client: mgr.GetClient(), decoder: decoder}
+	mgr.GetWebhookServer().Register("/validate-appo11y-grafana-com-v1alpha1-instrumenter",
+		&webhook.Admission{Handler: validator})
+	mgr.GetWebhookServer().Register("/validate-appo11y-grafana-com-v1alpha1-clusterinstrumenter",
+		&webhook.Admission{Handler: validator})
+	return nil
 }
 
 var _ admission.CustomDefaulter = (*podSidecarWebHook)(nil)
 
-//+kubebuilder:webhook:path=/mutate--v1-pod,mutating=true,failurePolicy=fail,sideEffects=NoneOnDryRun,groups="",resources=pods,verbs=create;update,versions=v1,name=minstrumenter.kb.io,admissionReviewVersions=v1
+// PodWebhookName is the name of the Pod webhook in the MutatingWebhookConfiguration. Its namespace and
+// object selectors, as well as its failure policy, are managed at runtime by the operator.
+const PodWebhookName = "minstrumenter.kb.io"
+
+//+kubebuilder:webhook:path=/mutate--v1-pod,mutating=true,failurePolicy=ignore,sideEffects=NoneOnDryRun,groups="",resources=pods,verbs=create,versions=v1,name=minstrumenter.kb.io,admissionReviewVersions=v1
 
 func (wh *podSidecarWebHook) Default(ctx context.Context, obj runtime.Object) error {
 	pod, ok := obj.(*v1.Pod)
@@ -61,22 +93,48 @@ func (wh *podSidecarWebHook) Default(ctx context.Context, obj runtime.Object) er
 	}
 	log := webhookLog.WithValues("podName", pod.Name, "podNamespace", pod.Namespace)
 	dbg := log.V(lvl.Debug)
+	// the containers of an existing Pod can't be modified, so only the new Pods are instrumented
+	if req, err := admission.RequestFromContext(ctx); err == nil && req.Operation != admissionv1.Create {
+		dbg.Info("ignoring operation on existing Pod", "operation", req.Operation)
+		return nil
+	}
 
-	// Check if there is any instrumenter in the given namespace
-	// TODO: find a way to cache it in memory?
-	instrumenters := InstrumenterList{}
-	if err := wh.List(ctx, &instrumenters, client.InNamespace(pod.Namespace)); err != nil {
+	instrumenters, err := wh.instrumenters(ctx, pod)
+	if err != nil {
 		log.Error(err, "requesting instrumenters list. Ignoring request")
 		return nil
 	}
 
-	dbg.Info("queried instrumenters for that namespace", "len", len(instrumenters.Items))
-	// It should never happen that two instrumenters match the same Pod,
-	// at the moment, we leave it as an undefined behavior.
-	for i := range instrumenters.Items {
-		instr := &instrumenters.Items[i]
-		dbg.Info("checking if the Pod needs to be instrumented", "instrumenter", instr.Name)
-		if InstrumentIfRequired(instr, pod) {
+	dbg.Info("queried instrumenters for that namespace", "len", len(instrumenters))
+	if len(instrumenters) == 0 {
+		return nil
+	}
+
+	owners, err := owner.Resolve(ctx, wh, pod)
+	if err != nil {
+		log.Error(err, "resolving pod owners. Ignoring request")
+		return nil
+	}
+	// the instrumenters are sorted by precedence, so the first one selecting the Pod instruments it
+	var ns *v1.Namespace
+	for _, instr := range instrumenters {
+		instrLog := dbg.WithValues("instrumenter", instr.GetName(), "kind", instr.InstrumenterKind())
+		instrLog.Info("checking if the Pod needs to be instrumented")
+		selected, err := wh.selectsNamespace(ctx, instr, pod, &ns)
+		if err != nil {
+			log.Error(err, "checking namespace selector. Ignoring instrumenter",
+				"instrumenter", instr.GetName(), "kind", instr.InstrumenterKind())
+			continue
+		}
+		if !selected {
+			instrLog.Info("pod namespace not selected by instrumenter")
+			continue
+		}
+		if SelectedByDaemonSet(instr, pod) {
+			dbg.Info("pod is instrumented by the instrumenter DaemonSet")
+			return nil
+		}
+		if InstrumentIfRequired(instr, pod, owners) {
 			dbg.Info("pod successfully instrumented")
 			return nil
 		}
@@ -84,3 +142,197 @@ func (wh *podSidecarWebHook) Default(ctx context.Context, obj runtime.Object) er
 
 	return nil
 }
+
+// instrumenterValidator rejects the invalid instrumenters, and warns about the risky settings and the
+// overlapping selectors. It is a raw admission handler, as CustomValidator doesn't support warnings.
+type instrumenterValidator struct {
+	client.Client
+	decoder *admission.Decoder
+}
+
+var _ admission.Handler = (*instrumenterValidator)(nil)
+
+//+kubebuilder:webhook:path=/validate-appo11y-grafana-com-v1alpha1-instrumenter,mutating=false,failurePolicy=fail,sideEffects=None,groups=appo11y.grafana.com,resources=instrumenters,verbs=create;update,versions=v1alpha1,name=vinstrumenter.kb.io,admissionReviewVersions=v1
+//+kubebuilder:webhook:path=/validate-appo11y-grafana-com-v1alpha1-clusterinstrumenter,mutating=false,failurePolicy=fail,sideEffects=None,groups=appo11y.grafana.com,resources=clusterinstrumenters,verbs=create;update,versions=v1alpha1,name=vclusterinstrumenter.kb.io,admissionReviewVersions=v1
+
+func (v *instrumenterValidator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	if req.Operation != admissionv1.Create && req.Operation != admissionv1.Update {
+		return admission.Allowed("")
+	}
+	var iq InstrumenterObject
+	switch req.Kind.Kind {
+	case KindInstrumenter:
+		iq = &Instrumenter{}
+	case KindClusterInstrumenter:
+		iq = &ClusterInstrumenter{}
+	default:
+		return admission.Errored(http.StatusBadRequest, fmt.Errorf("received object is not an instrumenter: %s", req.Kind))
+	}
+	if err := v.decoder.Decode(req, iq); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	if iq.GetNamespace() == "" && iq.InstrumenterKind() == KindInstrumenter {
+		iq.SetNamespace(req.Namespace)
+	}
+	errs, warnings, err := v.validate(ctx, iq)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	if len(errs) > 0 {
+		status := apierrors.NewInvalid(GroupVersion.WithKind(iq.InstrumenterKind()).GroupKind(), iq.GetName(), errs).Status()
+		return admission.Response{AdmissionResponse: admissionv1.AdmissionResponse{
+			Allowed: false, Result: &status, Warnings: warnings,
+		}}
+	}
+	return admission.Allowed("").WithWarnings(warnings...)
+}
+
+// validate returns the errors and the warnings of the instrumenter specification
+func (v *instrumenterValidator) validate(ctx context.Context, iq InstrumenterObject) (field.ErrorList, []string, error) {
+	specPath := field.NewPath("spec")
+	spec := iq.GetSpec()
+	errs := validateSpec(spec, specPath)
+	warnings := specWarnings(spec, specPath)
+	if iq.InstrumenterKind() == KindClusterInstrumenter && spec.Prometheus.PodMonitor.Enabled {
+		errs = append(errs, field.Forbidden(specPath.Child("prometheus", "podMonitor", "enabled"),
+			"PodMonitors are only supported by namespaced Instrumenters"))
+	}
+	// overlapping selectors are allowed, as the priority decides which instrumenter takes each Pod
+	if iq.InstrumenterKind() == KindInstrumenter {
+		instrumenters := InstrumenterList{}
+		if err := v.List(ctx, &instrumenters, client.InNamespace(iq.GetNamespace())); err != nil {
+			return nil, nil, fmt.Errorf("listing instrumenters: %w", err)
+		}
+		for i := range instrumenters.Items {
+			other := &instrumenters.Items[i]
+			if other.Name != iq.GetName() && selectorsOverlap(&spec.Selector, &other.Spec.Selector) {
+				winner := other.Name
+				if Precedes(iq, other) {
+					winner = iq.GetName()
+				}
+				warnings = append(warnings, fmt.Sprintf(
+					"%s might select the same Pods as Instrumenter %s. Instrumenter %s takes precedence on them",
+					specPath.Child("selector"), other.Name, winner))
+			}
+		}
+	}
+	clash, err := v.portClash(ctx, iq, specPath.Child("prometheus", "port"))
+	if err != nil {
+		return nil, nil, err
+	}
+	if clash != nil {
+		errs = append(errs, clash)
+	}
+	return errs, warnings, nil
+}
+
+// portClash returns an error if the Prometheus port of the sidecar is already used by any of the
+// selected Pods. Only the Pods matching the selector labels in the selected namespaces are listed.
+func (v *instrumenterValidator) portClash(ctx context.Context, iq InstrumenterObject, portPath *field.Path) (*field.Error, error) {
+	spec := iq.GetSpec()
+	if iq.GetMode() == ModeDaemonSet || !ExportsPrometheus(spec) {
+		return nil, nil
+	}
+	reqs, ok := podRequirements(&spec.Selector)
+	if !ok {
+		// already reported by validateSpec
+		return nil, nil
+	}
+	podSelector := labels.NewSelector().Add(reqs...)
+	namespaces := []string{iq.GetNamespace()}
+	if iq.InstrumenterKind() == KindClusterInstrumenter {
+		var err error
+		if namespaces, err = v.selectedNamespaces(ctx, &spec.Selector); err != nil {
+			return nil, err
+		}
+	}
+	for _, ns := range namespaces {
+		pods := v1.PodList{}
+		if err := v.List(ctx, &pods, client.InNamespace(ns),
+			client.MatchingLabelsSelector{Selector: podSelector}); err != nil {
+			return nil, fmt.Errorf("listing pods: %w", err)
+		}
+		if pod, clash, ok := prometheusPortClash(iq, pods.Items); ok {
+			return field.Invalid(portPath, spec.Prometheus.Port, fmt.Sprintf(
+				"already in use in Pod %s/%s, as %s", pod.Namespace, pod.Name, clash)), nil
+		}
+	}
+	return nil, nil
+}
+
+// selectedNamespaces returns the names of the namespaces matching the NamespaceSelector,
+// excluding the system namespaces
+func (v *instrumenterValidator) selectedNamespaces(ctx context.Context, selector *Selector) ([]string, error) {
+	nsSelector := labels.Everything()
+	if selector.NamespaceSelector != nil {
+		var err error
+		if nsSelector, err = metav1.LabelSelectorAsSelector(selector.NamespaceSelector); err != nil {
+			// already reported by validateSpec
+			return nil, nil
+		}
+	}
+	namespaces := v1.NamespaceList{}
+	if err := v.List(ctx, &namespaces, client.MatchingLabelsSelector{Selector: nsSelector}); err != nil {
+		return nil, fmt.Errorf("listing namespaces: %w", err)
+	}
+	names := make([]string, 0, len(namespaces.Items))
+	for i := range namespaces.Items {
+		if !IsSystemNamespace(namespaces.Items[i].Name) {
+			names = append(names, namespaces.Items[i].Name)
+		}
+	}
+	return names, nil
+}
+
+// instrumenters returns the instrumenters that could instrument the Pod, sorted by precedence (see Precedes).
+// They are taken from the in-memory index, unless it hasn't synced yet.
+func (wh *podSidecarWebHook) instrumenters(ctx context.Context, pod *v1.Pod) ([]InstrumenterObject, error) {
+	if wh.index != nil && wh.index.hasSynced() {
+		return wh.index.candidates(pod), nil
+	}
+	return wh.listInstrumenters(ctx, pod.Namespace)
+}
+
+// listInstrumenters returns all the instrumenters that could instrument a Pod in the given namespace,
+// sorted by precedence: first the Instrumenters in that namespace, then all the
+// ClusterInstrumenters (see Precedes).
+func (wh *podSidecarWebHook) listInstrumenters(ctx context.Context, namespace string) ([]InstrumenterObject, error) {
+	instrumenters := InstrumenterList{}
+	if err := wh.List(ctx, &instrumenters, client.InNamespace(namespace)); err != nil {
+		return nil, fmt.Errorf("listing instrumenters: %w", err)
+	}
+	clusterInstrumenters := ClusterInstrumenterList{}
+	if err := wh.List(ctx, &clusterInstrumenters); err != nil {
+		return nil, fmt.Errorf("listing cluster instrumenters: %w", err)
+	}
+	all := make([]InstrumenterObject, 0, len(instrumenters.Items)+len(clusterInstrumenters.Items))
+	for i := range instrumenters.Items {
+		all = append(all, &instrumenters.Items[i])
+	}
+	for i := range clusterInstrumenters.Items {
+		all = append(all, &clusterInstrumenters.Items[i])
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return Precedes(all[i], all[j])
+	})
+	return all, nil
+}
+
+// selectsNamespace checks whether the Instrumenter NamespaceSelector matches the Pod namespace.
+// The Namespace is only fetched the first time that an Instrumenter needs to inspect its labels,
+// and stored in the ns argument for later invocations.
+func (wh *podSidecarWebHook) selectsNamespace(
+	ctx context.Context, instr InstrumenterObject, pod *v1.Pod, ns **v1.Namespace,
+) (bool, error) {
+	if instr.GetSpec().Selector.NamespaceSelector == nil {
+		return true, nil
+	}
+	if *ns == nil {
+		*ns = &v1.Namespace{}
+		if err := wh.Get(ctx, client.ObjectKey{Name: pod.Namespace}, *ns); err != nil {
+			*ns = nil
+			return false, fmt.Errorf("requesting namespace %s: %w", pod.Namespace, err)
+		}
+	}
+	return instr.GetSpec().Selector.SelectsNamespace(*ns)
+}
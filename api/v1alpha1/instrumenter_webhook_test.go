@@ -0,0 +1,227 @@
+/*
+Copyright 2023 Grafana Labs <hello@grafana.com>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"context"
+	"sync"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	admissionv1 "k8s.io/api/admission/v1"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+var _ = Describe("Instrumenter validation", Ordered, func() {
+	const ns = "validator"
+	var warnings *warningRecorder
+	var cl client.Client
+	BeforeAll(func() {
+		Expect(k8sClient.Create(ctx, &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: ns}})).To(Succeed())
+		warnings = &warningRecorder{}
+		wcfg := rest.CopyConfig(cfg)
+		wcfg.WarningHandler = warnings
+		var err error
+		cl, err = client.New(wcfg, client.Options{Scheme: k8sClient.Scheme(),
+			Opts: client.WarningHandlerOptions{SuppressWarnings: true}})
+		Expect(err).ToNot(HaveOccurred())
+	})
+	// dryRun validates the instrumenter without storing it, returning the warnings
+	dryRun := func(iq InstrumenterObject) ([]string, error) {
+		warnings.reset()
+		err := cl.Create(ctx, iq.DeepCopyObject().(client.Object), client.DryRunAll)
+		return warnings.get(), err
+	}
+	causes := func(err error) []metav1.StatusCause {
+		status, ok := err.(apierrors.APIStatus)
+		Expect(ok).To(BeTrue(), "expecting an API error. Got %v", err)
+		Expect(status.Status().Details).ToNot(BeNil())
+		return status.Status().Details.Causes
+	}
+
+	It("should warn about the risky settings and the overlapping selectors", func() {
+		existing := &Instrumenter{
+			ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: "existing"},
+			Spec: InstrumenterSpec{
+				Image:    DefaultImage,
+				Export:   []Exporter{ExporterPrometheus},
+				Selector: Selector{PortLabel: "port", MatchLabels: map[string]string{"app": "frontend"}},
+			},
+		}
+		Expect(k8sClient.Create(ctx, existing)).To(Succeed())
+		instr := &Instrumenter{
+			ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: "new"},
+			Spec: InstrumenterSpec{
+				Image:    "grafana/beyla:latest",
+				Export:   []Exporter{ExporterOTELTraces},
+				Selector: Selector{PortLabel: "port", MatchLabels: map[string]string{"app": "backend"}},
+				OpenTelemetry: OpenTelemetry{
+					Endpoint:           "https://tempo:4318",
+					InsecureSkipVerify: true,
+				},
+			},
+		}
+		By("warning about the image tag and insecureSkipVerify")
+		Expect(dryRun(instr)).To(HaveLen(2))
+
+		By("warning about the overlap with the existing Instrumenter, which takes precedence by name")
+		instr.Spec.Selector.MatchLabels = nil
+		Eventually(dryRun).WithArguments(instr).Should(ContainElement(
+			ContainSubstring("Instrumenter existing takes precedence")))
+		instr.Spec.Priority = 10
+		Expect(dryRun(instr)).To(ContainElement(ContainSubstring("Instrumenter new takes precedence")))
+
+		By("not overlapping ClusterInstrumenters with namespaced Instrumenters, as the latter take precedence")
+		cluster := &ClusterInstrumenter{ObjectMeta: metav1.ObjectMeta{Name: "cluster"},
+			Spec: ClusterInstrumenterSpec{InstrumenterSpec: InstrumenterSpec{
+				Image: "grafana/beyla:1.0.0", Export: []Exporter{ExporterPrometheus}, Selector: Selector{PortLabel: "port"},
+			}}}
+		Expect(dryRun(cluster)).To(BeEmpty())
+	})
+
+	It("should reject the invalid specifications", func() {
+		instr := &Instrumenter{
+			ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: "no-endpoint"},
+			Spec: InstrumenterSpec{
+				Image:    DefaultImage,
+				Export:   []Exporter{ExporterOTELTraces},
+				Selector: Selector{PortLabel: "port"},
+			},
+		}
+		_, err := dryRun(instr)
+		Expect(apierrors.IsInvalid(err)).To(BeTrue(), "expecting the missing endpoint to be invalid. Got %v", err)
+		Expect(causes(err)).To(HaveLen(1))
+
+		By("supporting PodMonitors only in namespaced Instrumenters")
+		cluster := &ClusterInstrumenter{ObjectMeta: metav1.ObjectMeta{Name: "pod-monitor"},
+			Spec: ClusterInstrumenterSpec{InstrumenterSpec: InstrumenterSpec{
+				Image: DefaultImage, Export: []Exporter{ExporterPrometheus}, Selector: Selector{PortLabel: "port"},
+				Prometheus: Prometheus{PodMonitor: PodMonitor{Enabled: true}},
+			}}}
+		_, err = dryRun(cluster)
+		Expect(apierrors.IsInvalid(err)).To(BeTrue(), "expecting the PodMonitor to be invalid. Got %v", err)
+		Expect(causes(err)).To(ConsistOf(HaveField("Field", "spec.prometheus.podMonitor.enabled")))
+	})
+
+	It("should reject the Prometheus ports that clash with the selected Pods, unless in a system namespace", func() {
+		for _, namespace := range []string{ns, "kube-system"} {
+			Expect(k8sClient.Create(ctx, &v1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "pod", Labels: map[string]string{"clash-port": "8080"}},
+				Spec: v1.PodSpec{Containers: []v1.Container{{
+					Name: "app", Image: "foo-image", Ports: []v1.ContainerPort{{ContainerPort: 9102}},
+				}}},
+			})).To(Succeed())
+		}
+		cluster := &ClusterInstrumenter{ObjectMeta: metav1.ObjectMeta{Name: "clash"},
+			Spec: ClusterInstrumenterSpec{InstrumenterSpec: InstrumenterSpec{
+				Image:      DefaultImage,
+				Export:     []Exporter{ExporterPrometheus},
+				Prometheus: Prometheus{Port: 9102},
+				Selector: Selector{PortLabel: "clash-port", NamespaceSelector: &metav1.LabelSelector{
+					MatchLabels: map[string]string{v1.LabelMetadataName: "kube-system"},
+				}},
+			}}}
+		Eventually(func() error {
+			// waiting for the webhook to list the Pods
+			cluster.Spec.Selector.NamespaceSelector = nil
+			_, err := dryRun(cluster)
+			return err
+		}, timeout, interval).Should(HaveOccurred())
+		cluster.Spec.Selector.NamespaceSelector = &metav1.LabelSelector{
+			MatchLabels: map[string]string{v1.LabelMetadataName: "kube-system"},
+		}
+		_, err := dryRun(cluster)
+		Expect(err).ToNot(HaveOccurred())
+
+		cluster.Spec.Selector.NamespaceSelector = nil
+		_, err = dryRun(cluster)
+		Expect(apierrors.IsInvalid(err)).To(BeTrue(), "expecting the clashing port to be invalid. Got %v", err)
+		Expect(causes(err)).To(ConsistOf(And(
+			HaveField("Field", "spec.prometheus.port"),
+			HaveField("Message", ContainSubstring(ns+"/pod")),
+		)))
+	})
+})
+
+var _ = Describe("Pod webhook", Ordered, func() {
+	const ns = "pod-webhook"
+	instr := &Instrumenter{
+		ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: "instr"},
+		Spec: InstrumenterSpec{
+			Image:    DefaultImage,
+			Export:   []Exporter{ExporterPrometheus},
+			Selector: Selector{PortLabel: "webhook-port"},
+		},
+	}
+	newPod := func() *v1.Pod {
+		return &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: "pod", Labels: map[string]string{"webhook-port": "8080"}},
+			Spec:       v1.PodSpec{Containers: []v1.Container{{Name: "app", Image: "foo-image"}}},
+		}
+	}
+	BeforeAll(func() {
+		Expect(k8sClient.Create(ctx, &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: ns}})).To(Succeed())
+		Expect(k8sClient.Create(ctx, instr)).To(Succeed())
+	})
+
+	It("should instrument the created Pods", func() {
+		Eventually(func() bool {
+			pod := newPod()
+			Expect(k8sClient.Create(ctx, pod, client.DryRunAll)).To(Succeed())
+			return IsInstrumentedBy(instr, pod)
+		}, timeout, interval).Should(BeTrue())
+	})
+
+	It("should not modify the existing Pods", func() {
+		wh := &podSidecarWebHook{Client: k8sClient}
+		pod := newPod()
+		Expect(wh.Default(admission.NewContextWithRequest(context.Background(),
+			admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{Operation: admissionv1.Update}}), pod),
+		).To(Succeed())
+		Expect(pod.Spec.Containers).To(HaveLen(1))
+		Expect(IsInstrumentedBy(instr, pod)).To(BeFalse())
+	})
+})
+
+// warningRecorder records the warnings returned by the API server, such as the admission warnings
+type warningRecorder struct {
+	mu       sync.Mutex
+	warnings []string
+}
+
+func (w *warningRecorder) HandleWarningHeader(_ int, _ string, text string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.warnings = append(w.warnings, text)
+}
+
+func (w *warningRecorder) reset() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.warnings = nil
+}
+
+func (w *warningRecorder) get() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]string{}, w.warnings...)
+}
@@ -0,0 +1,102 @@
+/*
+Copyright 2023 Grafana Labs <hello@grafana.com>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"encoding/json"
+
+	v1 "k8s.io/api/core/v1"
+
+	"github.com/grafana/ebpf-autoinstrument-operator/pkg/helper"
+)
+
+// originalState of the Pod fields that are modified when the instrumenter sidecar is added
+type originalState struct {
+	ShareProcessNamespace *bool `json:"shareProcessNamespace,omitempty"`
+	// Annotations that were overridden by the instrumenter. A nil value means that
+	// the annotation didn't exist.
+	Annotations map[string]*string `json:"annotations,omitempty"`
+}
+
+// recordOriginalState returns the current state of the Pod fields that are modified by AddInstrumenter
+func recordOriginalState(dst *v1.Pod) *originalState {
+	orig := &originalState{Annotations: map[string]*string{}}
+	if dst.Spec.ShareProcessNamespace != nil {
+		orig.ShareProcessNamespace = helper.Ptr(*dst.Spec.ShareProcessNamespace)
+	}
+	return orig
+}
+
+// recordAnnotation stores the current value of the annotation, if it wasn't already recorded
+func (o *originalState) recordAnnotation(dst *v1.Pod, key string) {
+	if _, ok := o.Annotations[key]; ok {
+		return
+	}
+	if value, ok := dst.Annotations[key]; ok {
+		o.Annotations[key] = &value
+	} else {
+		o.Annotations[key] = nil
+	}
+}
+
+func (o *originalState) storeIn(dst *v1.Pod) {
+	// marshalling can't fail, as it only contains serializable fields
+	state, _ := json.Marshal(o)
+	dst.Annotations[OriginalStateAnnotation] = string(state)
+}
+
+// restoreOriginalState restores the Pod fields that were recorded in the original state annotation,
+// if any. Pods instrumented by previous versions of the operator don't have this annotation, so
+// their fields are left as they are.
+func restoreOriginalState(dst *v1.Pod) {
+	state, ok := dst.Annotations[OriginalStateAnnotation]
+	if !ok {
+		return
+	}
+	delete(dst.Annotations, OriginalStateAnnotation)
+	orig := originalState{}
+	if err := json.Unmarshal([]byte(state), &orig); err != nil {
+		webhookLog.Error(err, "can't restore the original state of the Pod. Ignoring",
+			"podName", dst.Name, "podNamespace", dst.Namespace)
+		return
+	}
+	dst.Spec.ShareProcessNamespace = orig.ShareProcessNamespace
+	for key, value := range orig.Annotations {
+		if value == nil {
+			delete(dst.Annotations, key)
+		} else {
+			dst.Annotations[key] = *value
+		}
+	}
+}
+
+// originalAnnotation returns the value of the Pod annotation before being instrumented
+func originalAnnotation(dst *v1.Pod, key string) (string, bool) {
+	if state, ok := dst.Annotations[OriginalStateAnnotation]; ok {
+		orig := originalState{}
+		if err := json.Unmarshal([]byte(state), &orig); err == nil {
+			if value, recorded := orig.Annotations[key]; recorded {
+				if value == nil {
+					return "", false
+				}
+				return *value, true
+			}
+		}
+	}
+	value, ok := dst.Annotations[key]
+	return value, ok
+}
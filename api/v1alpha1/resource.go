@@ -0,0 +1,108 @@
+/*
+Copyright 2023 Grafana Labs <hello@grafana.com>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"sort"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+
+	"github.com/grafana/ebpf-autoinstrument-operator/pkg/owner"
+)
+
+// podNameEnv is the Downward API environment variable of the sidecar with the Pod name
+const podNameEnv = "K8S_POD_NAME"
+
+// podNameReference references the Pod name from an environment variable value of the sidecar
+var podNameReference = "$(" + podNameEnv + ")"
+
+// podMetadataAttributes are the resource attributes of the instrumented Pod that are only known
+// after its creation, so they are loaded from the Downward API into environment variables
+var podMetadataAttributes = []struct {
+	attribute string
+	env       string
+	fieldPath string
+}{
+	{attribute: "k8s.namespace.name", env: "K8S_NAMESPACE_NAME", fieldPath: "metadata.namespace"},
+	{attribute: "k8s.pod.name", env: podNameEnv, fieldPath: "metadata.name"},
+	{attribute: "k8s.pod.uid", env: "K8S_POD_UID", fieldPath: "metadata.uid"},
+	{attribute: "k8s.node.name", env: "K8S_NODE_NAME", fieldPath: "spec.nodeName"},
+}
+
+// ownerAttributes are the resource attributes of each kind of workload owning a Pod
+var ownerAttributes = map[string]string{
+	owner.KindReplicaSet:  "k8s.replicaset.name",
+	owner.KindDeployment:  "k8s.deployment.name",
+	owner.KindStatefulSet: "k8s.statefulset.name",
+	owner.KindDaemonSet:   "k8s.daemonset.name",
+	owner.KindJob:         "k8s.job.name",
+	owner.KindCronJob:     "k8s.cronjob.name",
+}
+
+// podResourceAttributes returns the Kubernetes resource attributes of the instrumented Pod, as
+// well as the Downward API environment variables that their values refer to
+func podResourceAttributes(owners owner.Chain) (map[string]string, []v1.EnvVar) {
+	attrs := map[string]string{}
+	env := make([]v1.EnvVar, 0, len(podMetadataAttributes))
+	for _, md := range podMetadataAttributes {
+		env = append(env, downwardEnv(md.env, md.fieldPath))
+		attrs[md.attribute] = "$(" + md.env + ")"
+	}
+	for _, o := range owners {
+		if attr, ok := ownerAttributes[o.Kind]; ok {
+			attrs[attr] = escapeEnvReferences(o.Name)
+		}
+	}
+	return attrs, env
+}
+
+// configResourceAttributes adds the OTEL_RESOURCE_ATTRIBUTES variable to the autoinstrumenter
+// container, merging the provided attributes with the static attributes of the instrumenter,
+// which take precedence
+func configResourceAttributes(attrs, static map[string]string, container *v1.Container) {
+	if attrs == nil {
+		attrs = map[string]string{}
+	}
+	for k, v := range static {
+		attrs[k] = escapeEnvReferences(v)
+	}
+	if len(attrs) == 0 {
+		return
+	}
+	pairs := make([]string, 0, len(attrs))
+	for k, v := range attrs {
+		pairs = append(pairs, k+"="+v)
+	}
+	// sorting the attributes, so the sidecar specification is deterministic
+	sort.Strings(pairs)
+	container.Env = append(container.Env,
+		v1.EnvVar{Name: "OTEL_RESOURCE_ATTRIBUTES", Value: strings.Join(pairs, ",")})
+}
+
+// escapeEnvReferences escapes the literal values of the environment variables, so they
+// aren't expanded as variable references
+func escapeEnvReferences(value string) string {
+	return strings.ReplaceAll(value, "$", "$$")
+}
+
+// downwardEnv returns an environment variable that loads a Pod field from the Downward API
+func downwardEnv(name, fieldPath string) v1.EnvVar {
+	return v1.EnvVar{Name: name, ValueFrom: &v1.EnvVarSource{
+		FieldRef: &v1.ObjectFieldSelector{FieldPath: fieldPath},
+	}}
+}
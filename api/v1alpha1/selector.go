@@ -0,0 +1,71 @@
+/*
+Copyright 2023 Grafana Labs <hello@grafana.com>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// SystemNamespaces are never instrumented, nor intercepted by the Pod webhook
+var SystemNamespaces = []string{"kube-system", "kube-public", "kube-node-lease"}
+
+// IsSystemNamespace returns whether the namespace is one of the SystemNamespaces
+func IsSystemNamespace(namespace string) bool {
+	for _, ns := range SystemNamespaces {
+		if ns == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// SelectsPod returns whether the labels of the provided Pod match the Selector.
+// The Pod needs to have the PortLabel as well as matching all the MatchLabels and
+// MatchExpressions.
+func (s *Selector) SelectsPod(pod *v1.Pod) (bool, error) {
+	if pod.Labels[s.PortLabel] == "" {
+		return false, nil
+	}
+	if len(s.MatchLabels) == 0 && len(s.MatchExpressions) == 0 {
+		return true, nil
+	}
+	sel, err := metav1.LabelSelectorAsSelector(&metav1.LabelSelector{
+		MatchLabels:      s.MatchLabels,
+		MatchExpressions: s.MatchExpressions,
+	})
+	if err != nil {
+		return false, fmt.Errorf("invalid pod selector: %w", err)
+	}
+	return sel.Matches(labels.Set(pod.Labels)), nil
+}
+
+// SelectsNamespace returns whether the labels of the provided Namespace match the
+// NamespaceSelector. An unset NamespaceSelector selects any Namespace.
+func (s *Selector) SelectsNamespace(ns *v1.Namespace) (bool, error) {
+	if s.NamespaceSelector == nil {
+		return true, nil
+	}
+	sel, err := metav1.LabelSelectorAsSelector(s.NamespaceSelector)
+	if err != nil {
+		return false, fmt.Errorf("invalid namespace selector: %w", err)
+	}
+	return sel.Matches(labels.Set(ns.Labels)), nil
+}
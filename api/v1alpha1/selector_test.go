@@ -0,0 +1,99 @@
+/*
+Copyright 2023 Grafana Labs <hello@grafana.com>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestSelector_SelectsPod(t *testing.T) {
+	sel := Selector{
+		PortLabel:   "grafana.com/instrument-port",
+		MatchLabels: map[string]string{"tier": "backend"},
+		MatchExpressions: []metav1.LabelSelectorRequirement{{
+			Key: "env", Operator: metav1.LabelSelectorOpNotIn, Values: []string{"dev"},
+		}},
+	}
+	for _, tc := range []struct {
+		name     string
+		labels   map[string]string
+		expected bool
+	}{
+		{name: "no labels", expected: false},
+		{name: "missing port label",
+			labels:   map[string]string{"tier": "backend"},
+			expected: false},
+		{name: "matching labels",
+			labels:   map[string]string{"grafana.com/instrument-port": "8080", "tier": "backend"},
+			expected: true},
+		{name: "not matching labels",
+			labels:   map[string]string{"grafana.com/instrument-port": "8080", "tier": "frontend"},
+			expected: false},
+		{name: "not matching expressions",
+			labels:   map[string]string{"grafana.com/instrument-port": "8080", "tier": "backend", "env": "dev"},
+			expected: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			selected, err := sel.SelectsPod(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Labels: tc.labels}})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if selected != tc.expected {
+				t.Errorf("expected %v. Got %v", tc.expected, selected)
+			}
+		})
+	}
+}
+
+func TestSelector_SelectsPod_PortLabelOnly(t *testing.T) {
+	sel := Selector{PortLabel: "grafana.com/instrument-port"}
+	selected, err := sel.SelectsPod(&v1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Labels: map[string]string{"grafana.com/instrument-port": "8080"},
+	}})
+	if err != nil || !selected {
+		t.Errorf("expected pod to be selected. Got %v (err: %v)", selected, err)
+	}
+}
+
+func TestSelector_SelectsNamespace(t *testing.T) {
+	ns := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"team": "payments"}}}
+
+	sel := Selector{}
+	if selected, err := sel.SelectsNamespace(ns); err != nil || !selected {
+		t.Errorf("unset namespace selector should select any namespace. Got %v (err: %v)", selected, err)
+	}
+
+	sel.NamespaceSelector = &metav1.LabelSelector{MatchLabels: map[string]string{"team": "payments"}}
+	if selected, err := sel.SelectsNamespace(ns); err != nil || !selected {
+		t.Errorf("expected namespace to be selected. Got %v (err: %v)", selected, err)
+	}
+
+	sel.NamespaceSelector = &metav1.LabelSelector{MatchLabels: map[string]string{"team": "billing"}}
+	if selected, err := sel.SelectsNamespace(ns); err != nil || selected {
+		t.Errorf("expected namespace not to be selected. Got %v (err: %v)", selected, err)
+	}
+
+	sel.NamespaceSelector = &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{{
+		Key: "team", Operator: "Foo",
+	}}}
+	if _, err := sel.SelectsNamespace(ns); err == nil {
+		t.Error("expected error for invalid selector")
+	}
+}
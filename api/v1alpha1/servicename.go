@@ -0,0 +1,155 @@
+/*
+Copyright 2023 Grafana Labs <hello@grafana.com>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"regexp"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+
+	"github.com/grafana/ebpf-autoinstrument-operator/pkg/owner"
+)
+
+// matches the {name} and {name:argument} placeholders of the service name templates
+var placeholder = regexp.MustCompile(`\{([a-zA-Z]+)(?::([^}]+))?}`)
+
+// ServiceName resolves the service name of the Pod according to the policy sources, defaulting
+// to the name of its top-level owner, or to the Pod name if it has no owners
+func (p *ServiceNamePolicy) ServiceName(dst *v1.Pod, owners owner.Chain) string {
+	r := serviceNameResolver{pod: dst, owners: owners, podName: podName(dst), literal: identity}
+	return r.resolve(p)
+}
+
+// sidecarServiceName resolves the service name as a sidecar environment variable value, referencing
+// the Pod name from the Downward API. It also returns whether it references the Pod name.
+func (p *ServiceNamePolicy) sidecarServiceName(dst *v1.Pod, owners owner.Chain) (string, bool) {
+	r := serviceNameResolver{pod: dst, owners: owners, podName: podNameReference, literal: escapeEnvReferences}
+	name := r.resolve(p)
+	return name, r.podNameUsed
+}
+
+// reportedServiceName returns the service name that the sidecar reports for a SERVICE_NAME variable
+// value, expanding the Pod name reference. Before the Pod creation, the Pod name is approximated
+// from its generated name prefix.
+func reportedServiceName(envValue string, dst *v1.Pod) string {
+	return strings.NewReplacer("$$", "$", podNameReference, podName(dst)).Replace(envValue)
+}
+
+// serviceNameResolver provides the values of the service name sources of a Pod
+type serviceNameResolver struct {
+	pod    *v1.Pod
+	owners owner.Chain
+	// podName is the value that replaces the Pod name
+	podName string
+	// literal transforms the rest of the values
+	literal     func(string) string
+	podNameUsed bool
+}
+
+func (r *serviceNameResolver) resolve(p *ServiceNamePolicy) string {
+	for i := range p.Sources {
+		if name := r.resolveSource(&p.Sources[i]); name != "" {
+			return name
+		}
+	}
+	if name := ownerName(r.owners); name != "" {
+		return r.literal(name)
+	}
+	return r.name()
+}
+
+func (r *serviceNameResolver) resolveSource(s *ServiceNameSource) string {
+	switch s.Type {
+	case ServiceNameAnnotation:
+		return r.literal(r.pod.Annotations[s.Key])
+	case ServiceNameLabel:
+		return r.literal(r.pod.Labels[s.Key])
+	case ServiceNameOwnerName:
+		return r.literal(ownerName(r.owners))
+	case ServiceNamePodName:
+		return r.name()
+	case ServiceNameTemplate:
+		return r.expandTemplate(s.Template)
+	}
+	return ""
+}
+
+// name returns the Pod name, if known
+func (r *serviceNameResolver) name() string {
+	if podName(r.pod) == "" {
+		return ""
+	}
+	r.podNameUsed = true
+	return r.podName
+}
+
+// expandTemplate replaces the template placeholders by their values. It returns an empty string
+// if any placeholder is unknown or resolves to an empty value.
+func (r *serviceNameResolver) expandTemplate(template string) string {
+	missing := false
+	podNameUsed := r.podNameUsed
+	// the placeholders can't contain the '$' character, so escaping the template keeps them
+	expanded := placeholder.ReplaceAllStringFunc(r.literal(template), func(match string) string {
+		groups := placeholder.FindStringSubmatch(match)
+		var value string
+		switch groups[1] {
+		case "namespace":
+			value = r.literal(r.pod.Namespace)
+		case "pod":
+			value = r.name()
+		case "owner":
+			value = r.literal(ownerName(r.owners))
+		case "ownerKind":
+			if top, ok := r.owners.Top(); ok {
+				value = top.Kind
+			}
+		case "label":
+			value = r.literal(r.pod.Labels[groups[2]])
+		case "annotation":
+			value = r.literal(r.pod.Annotations[groups[2]])
+		}
+		if value == "" {
+			missing = true
+		}
+		return value
+	})
+	if missing {
+		r.podNameUsed = podNameUsed
+		return ""
+	}
+	return expanded
+}
+
+func ownerName(owners owner.Chain) string {
+	if top, ok := owners.Top(); ok {
+		return top.Name
+	}
+	return ""
+}
+
+func podName(dst *v1.Pod) string {
+	if dst.Name != "" {
+		return dst.Name
+	}
+	// Pods created by a workload might not have a name yet at admission time
+	return strings.TrimSuffix(dst.GenerateName, "-")
+}
+
+func identity(s string) string {
+	return s
+}
@@ -1,14 +1,18 @@
 package v1alpha1
 
 import (
-	"reflect"
+	"encoding/json"
+	"hash/fnv"
 	"strconv"
+	"strings"
 
 	"github.com/mariomac/gostream/stream"
 
 	"github.com/grafana/ebpf-autoinstrument-operator/pkg/helper"
+	"github.com/grafana/ebpf-autoinstrument-operator/pkg/owner"
 
 	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 // TODO: user-overridable
@@ -16,142 +20,499 @@ const (
 	instrumenterName = "grafana-ebpf-autoinstrumenter"
 
 	InstrumentedLabel = "grafana.com/instrumented-by"
+	// InstrumentedKindLabel specifies the kind of the instrumenter referred by the InstrumentedLabel.
+	// If missing, the Pod is considered to be instrumented by an Instrumenter.
+	InstrumentedKindLabel = "grafana.com/instrumented-by-kind"
+	// SidecarHashAnnotation stores a hash of the instrumenter sidecar container at the moment of
+	// the injection, which allows detecting outdated sidecars without comparing the Pod containers,
+	// whose fields might have been defaulted by the API server.
+	SidecarHashAnnotation = "grafana.com/instrumenter-sidecar-hash"
+	// OriginalStateAnnotation stores the original state of the Pod fields that are modified by
+	// the instrumenter, so they can be restored when the sidecar is removed
+	OriginalStateAnnotation = "grafana.com/instrumenter-original-state"
+	// ReportedServiceNameAnnotation stores the service name that the instrumenter sidecar reports for
+	// the Pod, e.g. to be used as a label in the Prometheus scrape configuration
+	ReportedServiceNameAnnotation = "grafana.com/instrumenter-service-name"
+	// PrometheusPortName is the name of the instrumenter sidecar port that exposes the Prometheus metrics
+	PrometheusPortName = "beyla-metrics"
 
-	// TODO: user-configurable
-	metricsPath = "/v1/metrics"
-	tracesPath  = "/v1/traces"
+	// otlpHeaderEnvPrefix is the prefix of the environment variables that load the OTLP header
+	// values from Secrets
+	otlpHeaderEnvPrefix = "OTLP_HEADER_"
+
+	// default paths of the OTLP/HTTP signals
+	defaultMetricsPath = "/v1/metrics"
+	defaultTracesPath  = "/v1/traces"
 )
 
 // NeedsInstrumentation returns whether the given pod requires instrumentation,
 // and a container with the instrumenter, in case of requiring it.
-func NeedsInstrumentation(iq *Instrumenter, dst *v1.Pod) (*v1.Container, bool) {
-	if dst.Labels == nil {
+// The owners chain of the Pod is used to derive the service name.
+func NeedsInstrumentation(iq InstrumenterObject, dst *v1.Pod, owners owner.Chain) (*v1.Container, bool) {
+	// in DaemonSet mode, the Pods are instrumented from the autoinstrumenter running in their node
+	if dst.Labels == nil || iq.GetMode() == ModeDaemonSet {
 		return nil, false
 	}
-	// if the Pod does not have the port selection label,
-	// or it's being already instrumented by another Instrumenter
-	if dst.Labels[iq.Spec.Selector.PortLabel] == "" ||
-		(dst.Labels[InstrumentedLabel] != "" && dst.Labels[InstrumentedLabel] != iq.Name) {
+	// if the Pod is being already instrumented by another Instrumenter
+	if instrumentedByOther(iq, dst) {
 		return nil, false
 	}
-	expected := buildSidecar(iq, dst)
-	actual, ok := findByName(dst.Spec.Containers)
-	if !ok {
+	// if the Pod does not match the selector. Invalid selectors are considered as not matching
+	if selected, err := iq.GetSpec().Selector.SelectsPod(dst); err != nil || !selected {
+		return nil, false
+	}
+	expected := buildSidecar(iq, dst, owners)
+	if _, ok := findByName(dst.Spec.Containers); !ok {
+		return expected, true
+	}
+	// taking over a Pod from an instrumenter with lower precedence
+	if name, kind := InstrumentedBy(dst); name != iq.GetName() || kind != iq.InstrumenterKind() {
 		return expected, true
 	}
-	if reflect.DeepEqual(expected, actual) {
+	if dst.Annotations[SidecarHashAnnotation] ==
+		instrumentationHash(expected, sidecarVolumes(iq), instrumentationAnnotations(iq, dst)) {
 		return nil, false
 	}
 	return expected, true
 }
 
+// IsInstrumentedBy returns whether the Pod has an instrumenter sidecar from the provided instrumenter
+func IsInstrumentedBy(iq InstrumenterObject, dst *v1.Pod) bool {
+	name, kind := InstrumentedBy(dst)
+	return name == iq.GetName() && kind == iq.InstrumenterKind()
+}
+
+// SidecarStatus returns the status of the instrumenter sidecar container of the Pod, if any
+func SidecarStatus(dst *v1.Pod) (*v1.ContainerStatus, bool) {
+	for i := range dst.Status.ContainerStatuses {
+		if dst.Status.ContainerStatuses[i].Name == instrumenterName {
+			return &dst.Status.ContainerStatuses[i], true
+		}
+	}
+	return nil, false
+}
+
 // InstrumentIfRequired instruments, if needed, the destination pod, and returns whether it has been instrumented
-func InstrumentIfRequired(iq *Instrumenter, dst *v1.Pod) bool {
-	sidecar, ok := NeedsInstrumentation(iq, dst)
+func InstrumentIfRequired(iq InstrumenterObject, dst *v1.Pod, owners owner.Chain) bool {
+	sidecar, ok := NeedsInstrumentation(iq, dst, owners)
 	if !ok {
 		return false
 	}
-	AddInstrumenter(iq.Name, sidecar, dst)
+	AddInstrumenter(iq, sidecar, dst)
 	return true
 }
 
-func AddInstrumenter(instrumenterName string, sidecar *v1.Container, dst *v1.Pod) {
-	// it might happen that the sidecar container needs to be replaced or added
-	current, ok := findByName(dst.Spec.Containers)
-	if ok {
-		*current = *sidecar
-	} else {
-		dst.Spec.Containers = append(dst.Spec.Containers, *sidecar)
+// InstrumentedBy returns the name and the kind of the instrumenter of a Pod,
+// or empty strings if the Pod is not instrumented
+func InstrumentedBy(dst *v1.Pod) (name, kind string) {
+	if name = dst.Labels[InstrumentedLabel]; name == "" {
+		return "", ""
+	}
+	if kind = dst.Labels[InstrumentedKindLabel]; kind == "" {
+		kind = KindInstrumenter
+	}
+	return name, kind
+}
+
+// instrumentedByOther returns whether the Pod is instrumented by another instrumenter that
+// takes precedence over the provided one. Since namespaced Instrumenters take precedence
+// over ClusterInstrumenters, they can take over the Pods instrumented by the latter.
+func instrumentedByOther(iq InstrumenterObject, dst *v1.Pod) bool {
+	name, kind := InstrumentedBy(dst)
+	if name == "" || (name == iq.GetName() && kind == iq.InstrumenterKind()) {
+		return false
+	}
+	return iq.InstrumenterKind() != KindInstrumenter || kind != KindClusterInstrumenter
+}
+
+// Precedes returns whether the instrumenter a takes precedence over the instrumenter b when both
+// select the same Pod: namespaced Instrumenters precede ClusterInstrumenters, then the instrumenters
+// with higher priority precede those with lower priority, and ties are broken by name.
+func Precedes(a, b InstrumenterObject) bool {
+	if ak, bk := a.InstrumenterKind(), b.InstrumenterKind(); ak != bk {
+		return ak == KindInstrumenter
+	}
+	if ap, bp := a.GetSpec().Priority, b.GetSpec().Priority; ap != bp {
+		return ap > bp
 	}
-	labelInstrumented(instrumenterName, dst)
-	// TODO: on Pod recreation, restore the previous value of this property (e.g. store it in an annotation)
+	return a.GetName() < b.GetName()
+}
+
+// AddInstrumenter adds the instrumenter sidecar to the Pod, as well as the annotations required by the
+// exporters. The original state of the Pod fields that are modified is stored in an annotation, so
+// RemoveInstrumenter can restore it.
+func AddInstrumenter(iq InstrumenterObject, sidecar *v1.Container, dst *v1.Pod) {
+	// when replacing an outdated sidecar, or taking over the Pod from another instrumenter,
+	// the Pod is instrumented from its original state
+	RemoveInstrumenter(dst)
+	orig := recordOriginalState(dst)
+	dst.Spec.Containers = append(dst.Spec.Containers, *sidecar)
+	labelInstrumented(iq, dst)
+	if dst.Annotations == nil {
+		dst.Annotations = map[string]string{}
+	}
+	annotations := instrumentationAnnotations(iq, dst)
+	for k, v := range annotations {
+		orig.recordAnnotation(dst, k)
+		dst.Annotations[k] = v
+	}
+	volumes := sidecarVolumes(iq)
+	dst.Spec.Volumes = append(dst.Spec.Volumes, volumes...)
+	dst.Annotations[SidecarHashAnnotation] = instrumentationHash(sidecar, volumes, annotations)
+	dst.Annotations[ReportedServiceNameAnnotation] = reportedServiceName(envValue(sidecar, "SERVICE_NAME"), dst)
 	dst.Spec.ShareProcessNamespace = helper.Ptr(true)
+	orig.storeIn(dst)
 }
 
+// RemoveInstrumenter removes the instrumenter sidecar from the Pod, restoring the original state
+// of the fields that were modified by AddInstrumenter
 func RemoveInstrumenter(dst *v1.Pod) {
 	unlabelInstrumented(dst)
+	delete(dst.Annotations, SidecarHashAnnotation)
+	delete(dst.Annotations, ReportedServiceNameAnnotation)
 	dst.Spec.Containers = stream.OfSlice(dst.Spec.Containers).
 		Filter(func(c v1.Container) bool {
 			return c.Name != instrumenterName
 		}).ToSlice()
+	dst.Spec.Volumes = stream.OfSlice(dst.Spec.Volumes).
+		Filter(func(v v1.Volume) bool {
+			return !isInstrumenterVolume(&v)
+		}).ToSlice()
+	restoreOriginalState(dst)
 }
 
-func buildSidecar(iq *Instrumenter, dst *v1.Pod) *v1.Container {
+func buildSidecar(iq InstrumenterObject, dst *v1.Pod, owners owner.Chain) *v1.Container {
+	spec := iq.GetSpec()
 	lbls := dst.ObjectMeta.Labels
 
-	// TODO: extract this information from owner (daemonset, deployment, replicaset...)
-	svcName, svcNamespace := dst.Name, dst.Namespace
+	svcName, refsPodName := spec.ServiceName.sidecarServiceName(dst, owners)
+	svcNamespace := dst.Namespace
 
+	// the Downward API variables must be defined before the variables that reference them
+	var env []v1.EnvVar
+	var attrs map[string]string
+	if exportsOTLP(spec) {
+		attrs, env = podResourceAttributes(owners)
+	} else if refsPodName {
+		env = []v1.EnvVar{downwardEnv(podNameEnv, "metadata.name")}
+	}
 	// TODO: do not make pod failing if sidecar fails, just report it in the Instrumenter status
 	sidecar := &v1.Container{
 		Name:            instrumenterName,
-		Image:           iq.Spec.Image,
-		ImagePullPolicy: iq.Spec.ImagePullPolicy,
-		// TODO: capabilities by default, or privileged only if user requests for it
-		SecurityContext: &v1.SecurityContext{
-			Privileged: helper.Ptr(true),
-			RunAsUser:  helper.Ptr(int64(0)),
-		},
-		Env: []v1.EnvVar{
-			{Name: "SERVICE_NAME", Value: svcName},
-			{Name: "SERVICE_NAMESPACE", Value: svcNamespace},
-			{Name: "OPEN_PORT", Value: lbls[iq.Spec.Selector.PortLabel]},
-		},
+		Image:           spec.Image,
+		ImagePullPolicy: spec.ImagePullPolicy,
+		SecurityContext: securityContext(&spec.SecurityContext),
+		Env: append(env,
+			v1.EnvVar{Name: "SERVICE_NAME", Value: svcName},
+			v1.EnvVar{Name: "SERVICE_NAMESPACE", Value: svcNamespace},
+			v1.EnvVar{Name: "OPEN_PORT", Value: lbls[spec.Selector.PortLabel]},
+		),
+	}
+	configureExporters(spec, svcName, sidecar)
+	if exportsOTLP(spec) {
+		configResourceAttributes(attrs, spec.OpenTelemetry.ResourceAttributes, sidecar)
 	}
+	if _, _, ok := SidecarConfig(iq); ok {
+		configSidecarFile(sidecar)
+	}
+
+	sidecar.Env = overrideEnv(sidecar.Env, spec.OverrideEnv)
+	return sidecar
+}
+
+// configureExporters adds the configuration of the exporters to the autoinstrumenter container
+func configureExporters(spec *InstrumenterSpec, svcName string, container *v1.Container) {
 	exporters := map[Exporter]struct{}{}
-	for _, e := range iq.Spec.Export {
+	for _, e := range spec.Export {
 		exporters[e] = struct{}{}
 	}
 	if _, ok := exporters[ExporterPrometheus]; ok {
-		configurePrometheusExporter(svcName, iq, dst, sidecar)
+		configurePrometheusExporter(svcName, spec, container)
 	}
 	_, otelM := exporters[ExporterOTELMetrics]
-	_, otelT := exporters[ExporterOTELMetrics]
+	_, otelT := exporters[ExporterOTELTraces]
 	if otelM || otelT {
-		configOpenTelemetry(otelM, otelT, iq, sidecar)
+		configOpenTelemetry(otelM, otelT, spec, container)
 	}
+}
 
-	sidecar.Env = append(sidecar.Env, iq.Spec.OverrideEnv...)
-	return sidecar
+// exporterAnnotations returns the annotations that the exporters require in the instrumented Pod,
+// according to the policy for the Pods that define their own Prometheus annotations
+func exporterAnnotations(spec *InstrumenterSpec, dst *v1.Pod) map[string]string {
+	if !ExportsPrometheus(spec) {
+		return nil
+	}
+	keys := &spec.Prometheus.Annotations
+	if _, ok := originalAnnotation(dst, keys.Scrape); ok {
+		switch spec.Prometheus.OnAnnotationConflict {
+		case AnnotationConflictOverwrite:
+		case AnnotationConflictUseAlternative:
+			keys = &spec.Prometheus.AlternativeAnnotations
+		default:
+			return nil
+		}
+	}
+	return map[string]string{
+		keys.Scrape: "true",
+		keys.Port:   strconv.Itoa(spec.Prometheus.Port),
+		keys.Scheme: "http", // TODO: make configurable
+		keys.Path:   spec.Prometheus.Path,
+	}
 }
 
-func configurePrometheusExporter(svcName string, iq *Instrumenter, dst *v1.Pod, sidecar *v1.Container) {
-	portStr := strconv.Itoa(iq.Spec.Prometheus.Port)
-	if dst.Annotations == nil {
-		dst.Annotations = map[string]string{}
+// PrometheusConflict returns whether the Pod keeps its own Prometheus scrape annotations, according
+// to the instrumenter policy, so the autoinstrumenter metrics aren't annotated for scraping
+func PrometheusConflict(iq InstrumenterObject, dst *v1.Pod) bool {
+	spec := iq.GetSpec()
+	if !ExportsPrometheus(spec) || iq.GetMode() == ModeDaemonSet {
+		return false
+	}
+	switch spec.Prometheus.OnAnnotationConflict {
+	case AnnotationConflictOverwrite, AnnotationConflictUseAlternative:
+		return false
+	}
+	_, ok := originalAnnotation(dst, spec.Prometheus.Annotations.Scrape)
+	return ok
+}
+
+func exportsOTLP(spec *InstrumenterSpec) bool {
+	for _, e := range spec.Export {
+		if e == ExporterOTELMetrics || e == ExporterOTELTraces {
+			return true
+		}
+	}
+	return false
+}
+
+// ExportsPrometheus returns whether the autoinstrumenter is configured as a Prometheus exporter
+func ExportsPrometheus(spec *InstrumenterSpec) bool {
+	for _, e := range spec.Export {
+		if e == ExporterPrometheus {
+			return true
+		}
 	}
-	dst.Annotations[iq.Spec.Prometheus.Annotations.Scrape] = "true"
-	dst.Annotations[iq.Spec.Prometheus.Annotations.Port] = portStr
-	dst.Annotations[iq.Spec.Prometheus.Annotations.Scheme] = "http" // TODO: make configurable
-	dst.Annotations[iq.Spec.Prometheus.Annotations.Path] = iq.Spec.Prometheus.Path
+	return false
+}
+
+// ebpfCapabilities are the Linux capabilities that allow loading and attaching the eBPF
+// programs without running a privileged container
+var ebpfCapabilities = []v1.Capability{
+	"BPF", "PERFMON", "SYS_PTRACE", "NET_RAW", "CHECKPOINT_RESTORE", "DAC_READ_SEARCH",
+	// required to lock memory for the eBPF maps in kernels older than 5.11
+	"SYS_RESOURCE",
+}
+
+func securityContext(sc *SecurityContext) *v1.SecurityContext {
+	if sc.Mode == SecurityPrivileged {
+		return &v1.SecurityContext{
+			Privileged: helper.Ptr(true),
+			RunAsUser:  helper.Ptr(int64(0)),
+		}
+	}
+	return &v1.SecurityContext{
+		Privileged: helper.Ptr(false),
+		// the capabilities are only effective for the root user
+		RunAsUser: helper.Ptr(int64(0)),
+		Capabilities: &v1.Capabilities{
+			Drop: []v1.Capability{"ALL"},
+			Add:  append(append([]v1.Capability{}, ebpfCapabilities...), sc.AddCapabilities...),
+		},
+	}
+}
+
+func configurePrometheusExporter(svcName string, spec *InstrumenterSpec, sidecar *v1.Container) {
+	portStr := strconv.Itoa(spec.Prometheus.Port)
+	if svcName != "" {
+		sidecar.Env = append(sidecar.Env, v1.EnvVar{Name: "PROMETHEUS_SERVICE_NAME", Value: svcName})
+	}
+	sidecar.Ports = append(sidecar.Ports, v1.ContainerPort{
+		Name:          PrometheusPortName,
+		ContainerPort: int32(spec.Prometheus.Port),
+		Protocol:      v1.ProtocolTCP,
+	})
 	sidecar.Env = append(sidecar.Env,
-		v1.EnvVar{Name: "PROMETHEUS_SERVICE_NAME", Value: svcName},
 		v1.EnvVar{Name: "PROMETHEUS_PORT", Value: portStr},
-		v1.EnvVar{Name: "PROMETHEUS_PATH", Value: iq.Spec.Prometheus.Path},
+		v1.EnvVar{Name: "PROMETHEUS_PATH", Value: spec.Prometheus.Path},
 		// TODO: extra properties such as METRICS_REPORT_TARGET and METRICS_REPORT_PEER
 	)
 }
 
-func configOpenTelemetry(metrics, traces bool, iq *Instrumenter, sidecar *v1.Container) {
-	otel := &iq.Spec.OpenTelemetry
-	if !metrics {
-		sidecar.Env = append(sidecar.Env,
-			v1.EnvVar{Name: "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", Value: otel.Endpoint + tracesPath})
-	} else if !traces {
-		sidecar.Env = append(sidecar.Env,
-			v1.EnvVar{Name: "OTEL_EXPORTER_OTLP_METRICS_ENDPOINT", Value: otel.Endpoint + metricsPath})
-	} else {
-		sidecar.Env = append(sidecar.Env,
-			v1.EnvVar{Name: "OTEL_EXPORTER_OTLP_ENDPOINT", Value: otel.Endpoint})
+func configOpenTelemetry(metrics, traces bool, spec *InstrumenterSpec, sidecar *v1.Container) {
+	otel := &spec.OpenTelemetry
+	if metrics {
+		configOTLPSignal("METRICS", otel, &otel.Metrics, defaultMetricsPath, sidecar)
+	}
+	if traces {
+		configOTLPSignal("TRACES", otel, &otel.Traces, defaultTracesPath, sidecar)
 	}
+	configOTLPHeaders(otel.Headers, sidecar)
+	configOTLPTLS(otel.TLS, sidecar)
+	configOTLPTuning(metrics, traces, otel, sidecar)
 	if otel.InsecureSkipVerify {
 		sidecar.Env = append(sidecar.Env,
 			v1.EnvVar{Name: "OTEL_INSECURE_SKIP_VERIFY", Value: "true"})
 	}
 	// TODO: this should be added automatically from the autoinstrumenter. Kept here for backwards-compatibility
 	sidecar.Env = append(sidecar.Env,
-		v1.EnvVar{Name: "OTEL_EXPORTER_OTLP_PROTOCOL", Value: "http/protobuf"})
+		v1.EnvVar{Name: "OTEL_EXPORTER_OTLP_PROTOCOL", Value: string(otel.protocol(&OTLPSignal{}))})
+}
+
+// configOTLPSignal configures the endpoint and the protocol of the given signal, which the
+// OTLP exporters use as-is
+func configOTLPSignal(
+	signalName string, otel *OpenTelemetry, signal *OTLPSignal, defaultPath string, sidecar *v1.Container,
+) {
+	protocol := otel.protocol(signal)
+	if endpoint := otel.signalEndpoint(signal, protocol, defaultPath); endpoint != "" {
+		sidecar.Env = append(sidecar.Env,
+			v1.EnvVar{Name: "OTEL_EXPORTER_OTLP_" + signalName + "_ENDPOINT", Value: endpoint})
+	}
+	sidecar.Env = append(sidecar.Env,
+		v1.EnvVar{Name: "OTEL_EXPORTER_OTLP_" + signalName + "_PROTOCOL", Value: string(protocol)})
+}
+
+// configOTLPHeaders adds the OTLP headers to the autoinstrumenter container. The header values
+// from Secrets are loaded in their own environment variables, which are referenced from the
+// headers variable, so they don't appear in plain text in the Pod specification.
+func configOTLPHeaders(headers []OTLPHeader, sidecar *v1.Container) {
+	if len(headers) == 0 {
+		return
+	}
+	pairs := make([]string, 0, len(headers))
+	for i := range headers {
+		h := &headers[i]
+		if h.ValueFrom == nil || h.ValueFrom.SecretKeyRef == nil {
+			// escaping the literal values, so they aren't expanded as variable references
+			pairs = append(pairs, h.Name+"="+escapeEnvReferences(h.Value))
+			continue
+		}
+		name := otlpHeaderEnvPrefix + strconv.Itoa(i)
+		sidecar.Env = append(sidecar.Env, v1.EnvVar{
+			Name:      name,
+			ValueFrom: &v1.EnvVarSource{SecretKeyRef: h.ValueFrom.SecretKeyRef.DeepCopy()},
+		})
+		pairs = append(pairs, h.Name+"=$("+name+")")
+	}
+	sidecar.Env = append(sidecar.Env,
+		v1.EnvVar{Name: "OTEL_EXPORTER_OTLP_HEADERS", Value: strings.Join(pairs, ",")})
+}
 
+// configOTLPTuning configures the export intervals, sampling, batching, timeouts and retries of the
+// OTLP exporters, as Go duration strings. Unset values are left to the autoinstrumenter defaults.
+func configOTLPTuning(metrics, traces bool, otel *OpenTelemetry, sidecar *v1.Container) {
+	add := func(name string, value string, set bool) {
+		if set {
+			sidecar.Env = append(sidecar.Env, v1.EnvVar{Name: name, Value: value})
+		}
+	}
+	duration := func(name string, d metav1.Duration, set bool) {
+		add(name, d.Duration.String(), set && d.Duration > 0)
+	}
+	duration("METRICS_INTERVAL", otel.Interval, metrics)
+	if traces && otel.Sampler != nil {
+		add("OTEL_TRACES_SAMPLER", string(otel.Sampler.Name), true)
+		add("OTEL_TRACES_SAMPLER_ARG", otel.Sampler.Ratio, otel.Sampler.Ratio != "")
+	}
+	if traces {
+		batch := &otel.Batch
+		add("OTLP_TRACES_MAX_EXPORT_BATCH_SIZE", strconv.Itoa(int(batch.MaxExportBatchSize)), batch.MaxExportBatchSize > 0)
+		add("OTLP_TRACES_MAX_QUEUE_SIZE", strconv.Itoa(int(batch.MaxQueueSize)), batch.MaxQueueSize > 0)
+		duration("OTLP_TRACES_BATCH_TIMEOUT", batch.ScheduleDelay, true)
+		duration("OTLP_TRACES_EXPORT_TIMEOUT", otel.ExportTimeout, true)
+	}
+	retry := &otel.Retry
+	duration("BACKOFF_INITIAL_INTERVAL", retry.InitialInterval, true)
+	duration("BACKOFF_MAX_INTERVAL", retry.MaxInterval, true)
+	duration("BACKOFF_MAX_ELAPSED_TIME", retry.MaxElapsedTime, true)
+}
+
+// protocol returns the OTLP protocol of the given signal
+func (o *OpenTelemetry) protocol(signal *OTLPSignal) OTLPProtocol {
+	switch {
+	case signal.Protocol != "":
+		return signal.Protocol
+	case o.Protocol != "":
+		return o.Protocol
+	default:
+		return OTLPProtocolHTTPProtobuf
+	}
+}
+
+// signalEndpoint returns the full URL where the given signal is exported, or an empty string
+// if there isn't any endpoint for it. gRPC endpoints don't have a path, while HTTP endpoints
+// append the signal path.
+func (o *OpenTelemetry) signalEndpoint(signal *OTLPSignal, protocol OTLPProtocol, defaultPath string) string {
+	endpoint := signal.Endpoint
+	if endpoint == "" {
+		endpoint = o.Endpoint
+	}
+	if endpoint == "" {
+		return ""
+	}
+	endpoint = strings.TrimSuffix(endpoint, "/")
+	if protocol == OTLPProtocolGRPC {
+		return endpoint
+	}
+	path := signal.Path
+	if path == "" {
+		path = defaultPath
+	}
+	return endpoint + "/" + strings.TrimPrefix(path, "/")
+}
+
+// instrumentationHash returns a short, deterministic hash of the sidecar container specification,
+// as well as the volumes and annotations added to the instrumented Pod
+func instrumentationHash(sidecar *v1.Container, volumes []v1.Volume, annotations map[string]string) string {
+	h := fnv.New64a()
+	// marshalling a Container can't fail, as it only contains serializable fields
+	spec, _ := json.Marshal(sidecar)
+	_, _ = h.Write(spec)
+	// volumes and annotations are only hashed if present, so the hash of the Pods that don't
+	// have them is kept between versions
+	if len(volumes) > 0 {
+		vols, _ := json.Marshal(volumes)
+		_, _ = h.Write(vols)
+	}
+	// map keys are marshalled in order, so the hash is deterministic
+	if len(annotations) > 0 {
+		annots, _ := json.Marshal(annotations)
+		_, _ = h.Write(annots)
+	}
+	return strconv.FormatUint(h.Sum64(), 36)
+}
+
+// overrideEnv replaces the variables of the env list by the variables with the same name from the
+// overrides list, and appends the rest of overrides
+func overrideEnv(env, overrides []v1.EnvVar) []v1.EnvVar {
+	positions := make(map[string]int, len(env))
+	for i := range env {
+		positions[env[i].Name] = i
+	}
+	for i := range overrides {
+		if pos, ok := positions[overrides[i].Name]; ok {
+			env[pos] = overrides[i]
+		} else {
+			positions[overrides[i].Name] = len(env)
+			env = append(env, overrides[i])
+		}
+	}
+	return env
+}
+
+// contentHash returns a short, deterministic hash of the provided contents
+func contentHash(content []byte) string {
+	h := fnv.New64a()
+	_, _ = h.Write(content)
+	return strconv.FormatUint(h.Sum64(), 36)
+}
+
+func envValue(container *v1.Container, name string) string {
+	for i := range container.Env {
+		if container.Env[i].Name == name {
+			return container.Env[i].Value
+		}
+	}
+	return ""
 }
 
 func findByName(containers []v1.Container) (*v1.Container, bool) {
@@ -164,11 +525,12 @@ func findByName(containers []v1.Container) (*v1.Container, bool) {
 }
 
 // labelInstrumented annotates a pod as already being instrumented
-func labelInstrumented(instrumenterName string, dst *v1.Pod) {
+func labelInstrumented(iq InstrumenterObject, dst *v1.Pod) {
 	if dst.Labels == nil {
 		dst.Labels = map[string]string{}
 	}
-	dst.Labels[InstrumentedLabel] = instrumenterName
+	dst.Labels[InstrumentedLabel] = iq.GetName()
+	dst.Labels[InstrumentedKindLabel] = iq.InstrumenterKind()
 }
 
 func unlabelInstrumented(dst *v1.Pod) {
@@ -176,4 +538,5 @@ func unlabelInstrumented(dst *v1.Pod) {
 		return
 	}
 	delete(dst.Labels, InstrumentedLabel)
+	delete(dst.Labels, InstrumentedKindLabel)
 }
@@ -0,0 +1,804 @@
+/*
+Copyright 2023 Grafana Labs <hello@grafana.com>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/grafana/ebpf-autoinstrument-operator/pkg/owner"
+)
+
+func TestNeedsInstrumentation_Precedence(t *testing.T) {
+	spec := InstrumenterSpec{Selector: Selector{PortLabel: "grafana.com/instrument-port"}}
+	instr := &Instrumenter{ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"}, Spec: spec}
+	clusterInstr := &ClusterInstrumenter{ObjectMeta: metav1.ObjectMeta{Name: "foo"},
+		Spec: ClusterInstrumenterSpec{InstrumenterSpec: spec}}
+	otherClusterInstr := &ClusterInstrumenter{ObjectMeta: metav1.ObjectMeta{Name: "bar"},
+		Spec: ClusterInstrumenterSpec{InstrumenterSpec: spec}}
+
+	podInstrumentedBy := func(iq InstrumenterObject) *v1.Pod {
+		pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Name: "pod", Namespace: "default",
+			Labels: map[string]string{"grafana.com/instrument-port": "8080"},
+		}}
+		if iq != nil {
+			AddInstrumenter(iq, buildSidecar(iq, pod, nil), pod)
+		}
+		return pod
+	}
+
+	for _, tc := range []struct {
+		name         string
+		instrumenter InstrumenterObject
+		instrumented InstrumenterObject
+		expected     bool
+	}{
+		{name: "uninstrumented pod", instrumenter: clusterInstr, expected: true},
+		{name: "instrumented by itself", instrumenter: clusterInstr, instrumented: clusterInstr},
+		{name: "namespaced takes over cluster", instrumenter: instr, instrumented: clusterInstr, expected: true},
+		{name: "cluster doesn't take over namespaced", instrumenter: clusterInstr, instrumented: instr},
+		{name: "cluster doesn't take over cluster", instrumenter: clusterInstr, instrumented: otherClusterInstr},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, needs := NeedsInstrumentation(tc.instrumenter, podInstrumentedBy(tc.instrumented), nil)
+			if needs != tc.expected {
+				t.Errorf("expected NeedsInstrumentation to be %v. Got %v", tc.expected, needs)
+			}
+		})
+	}
+}
+
+func TestInstrumentedBy(t *testing.T) {
+	pod := &v1.Pod{}
+	if name, kind := InstrumentedBy(pod); name != "" || kind != "" {
+		t.Errorf("expected uninstrumented pod. Got %q/%q", name, kind)
+	}
+	// Pods labeled by previous versions of the operator don't have the kind label
+	pod.Labels = map[string]string{InstrumentedLabel: "foo"}
+	if name, kind := InstrumentedBy(pod); name != "foo" || kind != KindInstrumenter {
+		t.Errorf("expected foo/Instrumenter. Got %q/%q", name, kind)
+	}
+	pod.Labels[InstrumentedKindLabel] = KindClusterInstrumenter
+	if name, kind := InstrumentedBy(pod); name != "foo" || kind != KindClusterInstrumenter {
+		t.Errorf("expected foo/ClusterInstrumenter. Got %q/%q", name, kind)
+	}
+}
+
+func TestServiceName(t *testing.T) {
+	iq := &Instrumenter{Spec: InstrumenterSpec{Selector: Selector{PortLabel: "grafana.com/instrument-port"}}}
+	for _, tc := range []struct {
+		name     string
+		pod      v1.Pod
+		owners   owner.Chain
+		expected string
+	}{
+		// the Pod name is resolved from the Downward API, as it is unknown at admission time
+		{name: "ownerless pod",
+			pod:      v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "my-pod"}},
+			expected: "$(K8S_POD_NAME)"},
+		{name: "deployment",
+			pod:      v1.Pod{ObjectMeta: metav1.ObjectMeta{GenerateName: "backend-5d4f8c-"}},
+			owners:   owner.Chain{{Kind: "ReplicaSet", Name: "backend-5d4f8c"}, {Kind: "Deployment", Name: "backend"}},
+			expected: "backend"},
+		{name: "statefulset",
+			pod:      v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "db-0"}},
+			owners:   owner.Chain{{Kind: "StatefulSet", Name: "db"}},
+			expected: "db"},
+		{name: "generated name without owner",
+			pod:      v1.Pod{ObjectMeta: metav1.ObjectMeta{GenerateName: "worker-"}},
+			expected: "$(K8S_POD_NAME)"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.pod.Namespace = "ns"
+			sidecar := buildSidecar(iq, &tc.pod, tc.owners)
+			env := map[string]string{}
+			for _, e := range sidecar.Env {
+				env[e.Name] = e.Value
+			}
+			if env["SERVICE_NAME"] != tc.expected || env["SERVICE_NAMESPACE"] != "ns" {
+				t.Errorf("expected service %s/%s. Got %s/%s", "ns", tc.expected,
+					env["SERVICE_NAMESPACE"], env["SERVICE_NAME"])
+			}
+		})
+	}
+}
+
+func TestServiceName_Policy(t *testing.T) {
+	policy := ServiceNamePolicy{Sources: []ServiceNameSource{
+		{Type: ServiceNameAnnotation, Key: "resource.opentelemetry.io/service.name"},
+		{Type: ServiceNameTemplate, Template: "{label:app.kubernetes.io/part-of}-{label:app.kubernetes.io/name}"},
+		{Type: ServiceNameLabel, Key: "app.kubernetes.io/name"},
+		{Type: ServiceNameTemplate, Template: "{ownerKind}/{unknown}"},
+	}}
+	owners := owner.Chain{{Kind: "ReplicaSet", Name: "backend-5d4f8c"}, {Kind: "Deployment", Name: "backend"}}
+	for _, tc := range []struct {
+		name        string
+		labels      map[string]string
+		annotations map[string]string
+		expected    string
+	}{
+		{name: "annotation",
+			annotations: map[string]string{"resource.opentelemetry.io/service.name": "checkout"},
+			labels:      map[string]string{"app.kubernetes.io/name": "api"},
+			expected:    "checkout"},
+		{name: "template",
+			labels:   map[string]string{"app.kubernetes.io/name": "api", "app.kubernetes.io/part-of": "shop"},
+			expected: "shop-api"},
+		{name: "label after incomplete template",
+			labels:   map[string]string{"app.kubernetes.io/name": "api"},
+			expected: "api"},
+		{name: "fallback to owner",
+			expected: "backend"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pod := v1.Pod{ObjectMeta: metav1.ObjectMeta{
+				Name: "backend-5d4f8c-x7z2q", Labels: tc.labels, Annotations: tc.annotations,
+			}}
+			if name := policy.ServiceName(&pod, owners); name != tc.expected {
+				t.Errorf("expected %q. Got %q", tc.expected, name)
+			}
+		})
+	}
+}
+
+func TestServiceName_TemplatePlaceholders(t *testing.T) {
+	pod := v1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Name: "db-0", Namespace: "storage",
+		Annotations: map[string]string{"team": "data"},
+	}}
+	owners := owner.Chain{{Kind: "StatefulSet", Name: "db"}}
+	policy := ServiceNamePolicy{Sources: []ServiceNameSource{{
+		Type:     ServiceNameTemplate,
+		Template: "{annotation:team}.{namespace}.{ownerKind}.{owner}.{pod}",
+	}}}
+	if name := policy.ServiceName(&pod, owners); name != "data.storage.StatefulSet.db.db-0" {
+		t.Errorf("unexpected service name: %q", name)
+	}
+}
+
+func TestNeedsInstrumentation_GeneratedPodName(t *testing.T) {
+	iq := &Instrumenter{ObjectMeta: metav1.ObjectMeta{Name: "instr", Namespace: "ns"}, Spec: InstrumenterSpec{
+		Selector: Selector{PortLabel: "grafana.com/instrument-port"},
+		ServiceName: ServiceNamePolicy{Sources: []ServiceNameSource{
+			{Type: ServiceNameTemplate, Template: "{namespace}$.{pod}"},
+		}},
+	}}
+	// at admission time, the Pods created by workloads only have a generated name prefix
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{
+		GenerateName: "worker-", Namespace: "ns",
+		Labels: map[string]string{"grafana.com/instrument-port": "8080"},
+	}}
+	if !InstrumentIfRequired(iq, pod, nil) {
+		t.Fatal("expected the Pod to be instrumented")
+	}
+	sidecar, _ := findByName(pod.Spec.Containers)
+	if name := envValue(sidecar, "SERVICE_NAME"); name != "ns$$.$(K8S_POD_NAME)" {
+		t.Errorf("expected the service name to reference the Pod name variable. Got %q", name)
+	}
+	if sidecar.Env[0].Name != "K8S_POD_NAME" || sidecar.Env[0].ValueFrom == nil {
+		t.Errorf("expected the Pod name variable to be defined first. Got %+v", sidecar.Env[0])
+	}
+	if name := pod.Annotations[ReportedServiceNameAnnotation]; name != "ns$.worker" {
+		t.Errorf("unexpected reported service name %q", name)
+	}
+	// the API server assigns the final name after the admission
+	pod.Name = "worker-x7z2q"
+	if _, ok := NeedsInstrumentation(iq, pod, nil); ok {
+		t.Error("not expecting the Pod to need instrumentation after its name is assigned")
+	}
+}
+
+func TestSecurityContext(t *testing.T) {
+	pod := v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod", Namespace: "ns"}}
+
+	iq := &Instrumenter{Spec: InstrumenterSpec{SecurityContext: SecurityContext{Mode: SecurityPrivileged}}}
+	sc := buildSidecar(iq, &pod, nil).SecurityContext
+	if sc.Privileged == nil || !*sc.Privileged || sc.Capabilities != nil {
+		t.Errorf("expected privileged security context. Got %+v", sc)
+	}
+
+	iq = &Instrumenter{Spec: InstrumenterSpec{SecurityContext: SecurityContext{
+		Mode: SecurityCapabilities, AddCapabilities: []v1.Capability{"NET_ADMIN"},
+	}}}
+	sc = buildSidecar(iq, &pod, nil).SecurityContext
+	if sc.Privileged == nil || *sc.Privileged {
+		t.Errorf("expected non-privileged security context. Got %+v", sc)
+	}
+	added := map[v1.Capability]struct{}{}
+	for _, c := range sc.Capabilities.Add {
+		added[c] = struct{}{}
+	}
+	for _, c := range []v1.Capability{"BPF", "PERFMON", "SYS_PTRACE", "NET_RAW", "NET_ADMIN"} {
+		if _, ok := added[c]; !ok {
+			t.Errorf("expected capability %s in %v", c, sc.Capabilities.Add)
+		}
+	}
+	if _, ok := added["SYS_ADMIN"]; ok {
+		t.Errorf("not expecting SYS_ADMIN capability")
+	}
+	if len(sc.Capabilities.Drop) != 1 || sc.Capabilities.Drop[0] != "ALL" {
+		t.Errorf("expected all the other capabilities to be dropped. Got %v", sc.Capabilities.Drop)
+	}
+}
+
+func TestNodeAgentSecurityContext(t *testing.T) {
+	iq := &ClusterInstrumenter{Spec: ClusterInstrumenterSpec{Mode: ModeDaemonSet}}
+	agent, _ := BuildNodeAgent(iq)
+	sc := agent.SecurityContext
+	if sc.Privileged == nil || *sc.Privileged || sc.AllowPrivilegeEscalation == nil || *sc.AllowPrivilegeEscalation {
+		t.Errorf("expected non-privileged security context. Got %+v", sc)
+	}
+	if sc.ReadOnlyRootFilesystem == nil || !*sc.ReadOnlyRootFilesystem {
+		t.Errorf("expected read-only root filesystem. Got %+v", sc)
+	}
+	added := map[v1.Capability]struct{}{}
+	for _, c := range sc.Capabilities.Add {
+		added[c] = struct{}{}
+	}
+	for _, c := range []v1.Capability{"BPF", "PERFMON", "SYS_PTRACE", "DAC_READ_SEARCH", "CHECKPOINT_RESTORE"} {
+		if _, ok := added[c]; !ok {
+			t.Errorf("expected capability %s in %v", c, sc.Capabilities.Add)
+		}
+	}
+
+	iq.Spec.SecurityContext.Mode = SecurityPrivileged
+	agent, _ = BuildNodeAgent(iq)
+	if sc := agent.SecurityContext; sc.Privileged == nil || !*sc.Privileged || sc.Capabilities != nil {
+		t.Errorf("expected privileged security context. Got %+v", sc)
+	}
+}
+
+func TestNeedsInstrumentation_DaemonSetMode(t *testing.T) {
+	iq := &ClusterInstrumenter{
+		ObjectMeta: metav1.ObjectMeta{Name: "instr"},
+		Spec: ClusterInstrumenterSpec{
+			Mode:             ModeDaemonSet,
+			InstrumenterSpec: InstrumenterSpec{Selector: Selector{PortLabel: "grafana.com/instrument-port"}},
+		},
+	}
+	pod := v1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Name: "pod", Labels: map[string]string{"grafana.com/instrument-port": "8080"},
+	}}
+	if _, ok := NeedsInstrumentation(iq, &pod, nil); ok {
+		t.Error("not expecting a sidecar in DaemonSet mode")
+	}
+	if !SelectedByDaemonSet(iq, &pod) {
+		t.Error("expected Pod to be selected by the DaemonSet")
+	}
+	iq.Spec.Mode = ModeSidecar
+	if SelectedByDaemonSet(iq, &pod) {
+		t.Error("not expecting Pod to be selected by a DaemonSet in Sidecar mode")
+	}
+}
+
+func TestRemoveInstrumenter_RestoresOriginalState(t *testing.T) {
+	iq := &Instrumenter{
+		ObjectMeta: metav1.ObjectMeta{Name: "instr"},
+		Spec: InstrumenterSpec{
+			Selector: Selector{PortLabel: "grafana.com/instrument-port"},
+			Export:   []Exporter{ExporterPrometheus},
+			Prometheus: Prometheus{Port: 9102, Path: "/metrics", Annotations: PrometheusAnnotations{
+				Scrape: "prometheus.io/scrape", Port: "prometheus.io/port",
+				Scheme: "prometheus.io/scheme", Path: "prometheus.io/path",
+			}},
+		},
+	}
+	original := v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "pod",
+			Labels:      map[string]string{"grafana.com/instrument-port": "8080"},
+			Annotations: map[string]string{"prometheus.io/port": "8080", "team": "data"},
+		},
+		Spec: v1.PodSpec{Containers: []v1.Container{{Name: "app"}}},
+	}
+	pod := original.DeepCopy()
+
+	if !InstrumentIfRequired(iq, pod, nil) {
+		t.Fatal("expected Pod to be instrumented")
+	}
+	if pod.Annotations["prometheus.io/port"] != "9102" || !*pod.Spec.ShareProcessNamespace {
+		t.Fatalf("unexpected instrumented Pod: %+v", pod)
+	}
+	// updating an instrumented Pod keeps the original state
+	iq.Spec.Prometheus.Port = 9103
+	if !InstrumentIfRequired(iq, pod, nil) {
+		t.Fatal("expected Pod to be re-instrumented")
+	}
+	if len(pod.Spec.Containers) != 2 || pod.Annotations["prometheus.io/port"] != "9103" {
+		t.Fatalf("unexpected re-instrumented Pod: %+v", pod)
+	}
+
+	RemoveInstrumenter(pod)
+	if pod.Spec.ShareProcessNamespace != nil {
+		t.Errorf("expected ShareProcessNamespace to be unset. Got %v", *pod.Spec.ShareProcessNamespace)
+	}
+	if len(pod.Annotations) != len(original.Annotations) {
+		t.Errorf("expected annotations %v. Got %v", original.Annotations, pod.Annotations)
+	}
+	for k, v := range original.Annotations {
+		if pod.Annotations[k] != v {
+			t.Errorf("expected annotation %s=%s. Got %q", k, v, pod.Annotations[k])
+		}
+	}
+	if len(pod.Spec.Containers) != 1 || pod.Spec.Containers[0].Name != "app" {
+		t.Errorf("unexpected containers: %+v", pod.Spec.Containers)
+	}
+	if _, ok := pod.Labels[InstrumentedLabel]; ok {
+		t.Error("not expecting instrumented label")
+	}
+}
+
+func TestPrometheusAnnotationConflict(t *testing.T) {
+	prometheus := Prometheus{
+		Port: 9102, Path: "/metrics",
+		Annotations: PrometheusAnnotations{
+			Scrape: "prometheus.io/scrape", Port: "prometheus.io/port",
+			Scheme: "prometheus.io/scheme", Path: "prometheus.io/path",
+		},
+		AlternativeAnnotations: PrometheusAnnotations{
+			Scrape: "grafana.com/beyla-scrape", Port: "grafana.com/beyla-port",
+			Scheme: "grafana.com/beyla-scheme", Path: "grafana.com/beyla-path",
+		},
+	}
+	for _, tc := range []struct {
+		policy           AnnotationConflictPolicy
+		expectedPort     string
+		expectedAltPort  string
+		expectedConflict bool
+	}{
+		{policy: AnnotationConflictKeep, expectedPort: "8080", expectedConflict: true},
+		{policy: AnnotationConflictOverwrite, expectedPort: "9102"},
+		{policy: AnnotationConflictUseAlternative, expectedPort: "8080", expectedAltPort: "9102"},
+	} {
+		t.Run(string(tc.policy), func(t *testing.T) {
+			iq := &Instrumenter{ObjectMeta: metav1.ObjectMeta{Name: "instrumenter"}, Spec: InstrumenterSpec{
+				Selector:   Selector{PortLabel: "grafana.com/instrument-port"},
+				Export:     []Exporter{ExporterPrometheus},
+				Prometheus: prometheus,
+			}}
+			iq.Spec.Prometheus.OnAnnotationConflict = tc.policy
+			pod := v1.Pod{ObjectMeta: metav1.ObjectMeta{
+				Name:   "pod",
+				Labels: map[string]string{"grafana.com/instrument-port": "8080"},
+				Annotations: map[string]string{
+					"prometheus.io/scrape": "true", "prometheus.io/port": "8080",
+				},
+			}}
+			if !InstrumentIfRequired(iq, &pod, nil) {
+				t.Fatal("expected Pod to be instrumented")
+			}
+			if pod.Annotations["prometheus.io/port"] != tc.expectedPort {
+				t.Errorf("expected port annotation %s. Got %s", tc.expectedPort, pod.Annotations["prometheus.io/port"])
+			}
+			if pod.Annotations["grafana.com/beyla-port"] != tc.expectedAltPort {
+				t.Errorf("expected alternative port annotation %q. Got %q",
+					tc.expectedAltPort, pod.Annotations["grafana.com/beyla-port"])
+			}
+			if pod.Annotations[ReportedServiceNameAnnotation] != "pod" {
+				t.Errorf("expected reported service name to be pod. Got %q", pod.Annotations[ReportedServiceNameAnnotation])
+			}
+			if PrometheusConflict(iq, &pod) != tc.expectedConflict {
+				t.Errorf("expected conflict to be %v", tc.expectedConflict)
+			}
+			if _, ok := NeedsInstrumentation(iq, &pod, nil); ok {
+				t.Error("not expecting the Pod to need instrumentation again")
+			}
+		})
+	}
+}
+
+func TestConfigureExporters(t *testing.T) {
+	otel := OpenTelemetry{
+		Endpoint: "http://collector:4318/",
+		Traces:   OTLPSignal{Endpoint: "http://tempo:4318", Path: "otlp/v1/traces"},
+	}
+	for _, tc := range []struct {
+		name     string
+		export   []Exporter
+		otel     OpenTelemetry
+		expected map[string]string
+	}{{
+		name:     "none",
+		otel:     otel,
+		expected: map[string]string{},
+	}, {
+		name:   "prometheus",
+		export: []Exporter{ExporterPrometheus},
+		otel:   otel,
+		expected: map[string]string{
+			"PROMETHEUS_SERVICE_NAME": "svc", "PROMETHEUS_PORT": "9102", "PROMETHEUS_PATH": "/metrics",
+		},
+	}, {
+		name:   "metrics",
+		export: []Exporter{ExporterOTELMetrics},
+		otel:   otel,
+		expected: map[string]string{
+			"OTEL_EXPORTER_OTLP_METRICS_ENDPOINT": "http://collector:4318/v1/metrics",
+			"OTEL_EXPORTER_OTLP_METRICS_PROTOCOL": "http/protobuf",
+			"OTEL_EXPORTER_OTLP_PROTOCOL":         "http/protobuf",
+		},
+	}, {
+		name:   "traces",
+		export: []Exporter{ExporterOTELTraces},
+		otel:   otel,
+		expected: map[string]string{
+			"OTEL_EXPORTER_OTLP_TRACES_ENDPOINT": "http://tempo:4318/otlp/v1/traces",
+			"OTEL_EXPORTER_OTLP_TRACES_PROTOCOL": "http/protobuf",
+			"OTEL_EXPORTER_OTLP_PROTOCOL":        "http/protobuf",
+		},
+	}, {
+		name:   "metrics and traces",
+		export: []Exporter{ExporterOTELMetrics, ExporterOTELTraces},
+		otel:   otel,
+		expected: map[string]string{
+			"OTEL_EXPORTER_OTLP_METRICS_ENDPOINT": "http://collector:4318/v1/metrics",
+			"OTEL_EXPORTER_OTLP_METRICS_PROTOCOL": "http/protobuf",
+			"OTEL_EXPORTER_OTLP_TRACES_ENDPOINT":  "http://tempo:4318/otlp/v1/traces",
+			"OTEL_EXPORTER_OTLP_TRACES_PROTOCOL":  "http/protobuf",
+			"OTEL_EXPORTER_OTLP_PROTOCOL":         "http/protobuf",
+		},
+	}, {
+		name:   "all, with metrics path override",
+		export: []Exporter{ExporterPrometheus, ExporterOTELMetrics, ExporterOTELTraces},
+		otel: OpenTelemetry{
+			Endpoint:           "http://collector:4318",
+			Metrics:            OTLPSignal{Path: "/custom/metrics"},
+			InsecureSkipVerify: true,
+		},
+		expected: map[string]string{
+			"PROMETHEUS_SERVICE_NAME":             "svc",
+			"PROMETHEUS_PORT":                     "9102",
+			"PROMETHEUS_PATH":                     "/metrics",
+			"OTEL_EXPORTER_OTLP_METRICS_ENDPOINT": "http://collector:4318/custom/metrics",
+			"OTEL_EXPORTER_OTLP_METRICS_PROTOCOL": "http/protobuf",
+			"OTEL_EXPORTER_OTLP_TRACES_ENDPOINT":  "http://collector:4318/v1/traces",
+			"OTEL_EXPORTER_OTLP_TRACES_PROTOCOL":  "http/protobuf",
+			"OTEL_INSECURE_SKIP_VERIFY":           "true",
+			"OTEL_EXPORTER_OTLP_PROTOCOL":         "http/protobuf",
+		},
+	}, {
+		name:   "traces without endpoint",
+		export: []Exporter{ExporterOTELTraces},
+		expected: map[string]string{
+			"OTEL_EXPORTER_OTLP_TRACES_PROTOCOL": "http/protobuf",
+			"OTEL_EXPORTER_OTLP_PROTOCOL":        "http/protobuf",
+		},
+	}, {
+		name:   "gRPC, with HTTP traces",
+		export: []Exporter{ExporterOTELMetrics, ExporterOTELTraces},
+		otel: OpenTelemetry{
+			Endpoint: "http://collector:4317/",
+			Protocol: OTLPProtocolGRPC,
+			Traces:   OTLPSignal{Endpoint: "http://tempo:4318", Protocol: OTLPProtocolHTTPProtobuf},
+		},
+		expected: map[string]string{
+			"OTEL_EXPORTER_OTLP_METRICS_ENDPOINT": "http://collector:4317",
+			"OTEL_EXPORTER_OTLP_METRICS_PROTOCOL": "grpc",
+			"OTEL_EXPORTER_OTLP_TRACES_ENDPOINT":  "http://tempo:4318/v1/traces",
+			"OTEL_EXPORTER_OTLP_TRACES_PROTOCOL":  "http/protobuf",
+			"OTEL_EXPORTER_OTLP_PROTOCOL":         "grpc",
+		},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			spec := InstrumenterSpec{
+				Export:        tc.export,
+				Prometheus:    Prometheus{Port: 9102, Path: "/metrics"},
+				OpenTelemetry: tc.otel,
+			}
+			container := v1.Container{}
+			configureExporters(&spec, "svc", &container)
+			env := map[string]string{}
+			for _, e := range container.Env {
+				env[e.Name] = e.Value
+			}
+			if !reflect.DeepEqual(tc.expected, env) {
+				t.Errorf("expected env %v. Got %v", tc.expected, env)
+			}
+		})
+	}
+}
+
+func TestConfigOTLPHeaders(t *testing.T) {
+	secretRef := &v1.SecretKeySelector{LocalObjectReference: v1.LocalObjectReference{Name: "grafana-cloud"}, Key: "token"}
+	container := v1.Container{}
+	configOTLPHeaders([]OTLPHeader{
+		{Name: "X-Scope-OrgID", Value: "tenant-$1"},
+		{Name: "Authorization", ValueFrom: &OTLPHeaderSource{SecretKeyRef: secretRef}},
+	}, &container)
+
+	if len(container.Env) != 2 {
+		t.Fatalf("expected 2 env vars. Got %+v", container.Env)
+	}
+	if container.Env[0].Name != "OTLP_HEADER_1" || container.Env[0].Value != "" ||
+		!reflect.DeepEqual(container.Env[0].ValueFrom.SecretKeyRef, secretRef) {
+		t.Errorf("expected the header value to be loaded from the Secret. Got %+v", container.Env[0])
+	}
+	expected := v1.EnvVar{Name: "OTEL_EXPORTER_OTLP_HEADERS", Value: "X-Scope-OrgID=tenant-$$1,Authorization=$(OTLP_HEADER_1)"}
+	if container.Env[1] != expected {
+		t.Errorf("expected %+v. Got %+v", expected, container.Env[1])
+	}
+}
+
+func TestInstrumentIfRequired_OTLPTLS(t *testing.T) {
+	iq := &Instrumenter{ObjectMeta: metav1.ObjectMeta{Name: "instrumenter"}, Spec: InstrumenterSpec{
+		Selector: Selector{PortLabel: "grafana.com/instrument-port"},
+		Export:   []Exporter{ExporterOTELTraces},
+		OpenTelemetry: OpenTelemetry{
+			Endpoint: "https://collector:4318",
+			TLS: &OTLPTLS{
+				CA: &CABundle{ConfigMapKeyRef: &v1.ConfigMapKeySelector{
+					LocalObjectReference: v1.LocalObjectReference{Name: "ca-bundle"}, Key: "bundle.pem",
+				}},
+				ClientCertificate: &ClientCertificate{SecretName: "client-cert"},
+			},
+		},
+	}}
+	appVolume := v1.Volume{Name: "data", VolumeSource: v1.VolumeSource{EmptyDir: &v1.EmptyDirVolumeSource{}}}
+	pod := v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "pod", Labels: map[string]string{"grafana.com/instrument-port": "8080"}},
+		Spec:       v1.PodSpec{Volumes: []v1.Volume{appVolume}},
+	}
+	if !InstrumentIfRequired(iq, &pod, nil) {
+		t.Fatal("expected Pod to be instrumented")
+	}
+	if len(pod.Spec.Volumes) != 3 {
+		t.Fatalf("expected the CA and client certificate volumes to be added. Got %+v", pod.Spec.Volumes)
+	}
+	ca := pod.Spec.Volumes[1].ConfigMap
+	if ca == nil || ca.Name != "ca-bundle" || ca.Items[0] != (v1.KeyToPath{Key: "bundle.pem", Path: "ca.crt"}) {
+		t.Errorf("unexpected CA volume: %+v", pod.Spec.Volumes[1])
+	}
+	cert := pod.Spec.Volumes[2].Secret
+	if cert == nil || cert.SecretName != "client-cert" || len(cert.Items) != 2 || cert.Items[1].Key != "tls.key" {
+		t.Errorf("unexpected client certificate volume: %+v", pod.Spec.Volumes[2])
+	}
+	sidecar, _ := findByName(pod.Spec.Containers)
+	if len(sidecar.VolumeMounts) != 2 {
+		t.Errorf("expected the sidecar to mount the certificate volumes. Got %+v", sidecar.VolumeMounts)
+	}
+	for env, expected := range map[string]string{
+		"OTEL_EXPORTER_OTLP_CERTIFICATE":        "/etc/beyla/otlp-ca/ca.crt",
+		"OTEL_EXPORTER_OTLP_CLIENT_CERTIFICATE": "/etc/beyla/otlp-client-cert/tls.crt",
+		"OTEL_EXPORTER_OTLP_CLIENT_KEY":         "/etc/beyla/otlp-client-cert/tls.key",
+	} {
+		if value := envValue(sidecar, env); value != expected {
+			t.Errorf("expected %s to be %s. Got %q", env, expected, value)
+		}
+	}
+	if _, ok := NeedsInstrumentation(iq, &pod, nil); ok {
+		t.Error("not expecting the Pod to need instrumentation again")
+	}
+
+	// changing the referred ConfigMap requires reinstrumenting the Pod
+	iq.Spec.OpenTelemetry.TLS.CA.ConfigMapKeyRef.Name = "other-bundle"
+	if _, ok := NeedsInstrumentation(iq, &pod, nil); !ok {
+		t.Error("expecting the Pod to need instrumentation after changing the CA bundle")
+	}
+
+	RemoveInstrumenter(&pod)
+	if !reflect.DeepEqual(pod.Spec.Volumes, []v1.Volume{appVolume}) {
+		t.Errorf("expected only the application volumes to remain. Got %+v", pod.Spec.Volumes)
+	}
+}
+
+func TestConfigOTLPTuning(t *testing.T) {
+	otel := OpenTelemetry{
+		Interval:      metav1.Duration{Duration: 30 * time.Second},
+		ExportTimeout: metav1.Duration{Duration: 10 * time.Second},
+		Batch: OTLPBatch{
+			MaxExportBatchSize: 512,
+			MaxQueueSize:       4096,
+			ScheduleDelay:      metav1.Duration{Duration: 500 * time.Millisecond},
+		},
+		Retry:   OTLPRetry{MaxElapsedTime: metav1.Duration{Duration: time.Minute}},
+		Sampler: &Sampler{Name: SamplerParentBasedTraceIDRatio, Ratio: "0.25"},
+	}
+	for _, tc := range []struct {
+		name            string
+		metrics, traces bool
+		expected        map[string]string
+	}{{
+		name:    "metrics",
+		metrics: true,
+		expected: map[string]string{
+			"METRICS_INTERVAL":         "30s",
+			"BACKOFF_MAX_ELAPSED_TIME": "1m0s",
+		},
+	}, {
+		name:   "traces",
+		traces: true,
+		expected: map[string]string{
+			"OTEL_TRACES_SAMPLER":               "parentbased_traceidratio",
+			"OTEL_TRACES_SAMPLER_ARG":           "0.25",
+			"OTLP_TRACES_MAX_EXPORT_BATCH_SIZE": "512",
+			"OTLP_TRACES_MAX_QUEUE_SIZE":        "4096",
+			"OTLP_TRACES_BATCH_TIMEOUT":         "500ms",
+			"OTLP_TRACES_EXPORT_TIMEOUT":        "10s",
+			"BACKOFF_MAX_ELAPSED_TIME":          "1m0s",
+		},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			container := v1.Container{}
+			configOTLPTuning(tc.metrics, tc.traces, &otel, &container)
+			env := map[string]string{}
+			for _, e := range container.Env {
+				env[e.Name] = e.Value
+			}
+			if !reflect.DeepEqual(tc.expected, env) {
+				t.Errorf("expected env %v. Got %v", tc.expected, env)
+			}
+		})
+	}
+}
+
+func TestBuildSidecar_ResourceAttributes(t *testing.T) {
+	iq := &Instrumenter{Spec: InstrumenterSpec{
+		Selector: Selector{PortLabel: "grafana.com/instrument-port"},
+		Export:   []Exporter{ExporterOTELTraces},
+		OpenTelemetry: OpenTelemetry{
+			Endpoint: "http://collector:4318",
+			ResourceAttributes: map[string]string{
+				"deployment.environment": "prod",
+				"k8s.cluster.name":       "eu-west-$1",
+				"k8s.node.name":          "overridden",
+			},
+		},
+	}}
+	pod := v1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Namespace: "ns", Labels: map[string]string{"grafana.com/instrument-port": "8080"},
+	}}
+	owners := owner.Chain{
+		{Kind: owner.KindReplicaSet, Name: "backend-5d4f8c"},
+		{Kind: owner.KindDeployment, Name: "backend"},
+	}
+	sidecar := buildSidecar(iq, &pod, owners)
+
+	expected := "deployment.environment=prod," +
+		"k8s.cluster.name=eu-west-$$1," +
+		"k8s.deployment.name=backend," +
+		"k8s.namespace.name=$(K8S_NAMESPACE_NAME)," +
+		"k8s.node.name=overridden," +
+		"k8s.pod.name=$(K8S_POD_NAME)," +
+		"k8s.pod.uid=$(K8S_POD_UID)," +
+		"k8s.replicaset.name=backend-5d4f8c"
+	if attrs := envValue(sidecar, "OTEL_RESOURCE_ATTRIBUTES"); attrs != expected {
+		t.Errorf("expected resource attributes\n%s\nGot\n%s", expected, attrs)
+	}
+	// the referred variables must be defined before the resource attributes
+	fieldRefs := map[string]string{}
+	for _, e := range sidecar.Env {
+		if e.Name == "OTEL_RESOURCE_ATTRIBUTES" {
+			break
+		}
+		if e.ValueFrom != nil && e.ValueFrom.FieldRef != nil {
+			fieldRefs[e.Name] = e.ValueFrom.FieldRef.FieldPath
+		}
+	}
+	expectedRefs := map[string]string{
+		"K8S_NAMESPACE_NAME": "metadata.namespace",
+		"K8S_POD_NAME":       "metadata.name",
+		"K8S_POD_UID":        "metadata.uid",
+		"K8S_NODE_NAME":      "spec.nodeName",
+	}
+	if !reflect.DeepEqual(expectedRefs, fieldRefs) {
+		t.Errorf("expected Downward API variables %v. Got %v", expectedRefs, fieldRefs)
+	}
+}
+
+func TestInstrumentIfRequired_BeylaConfig(t *testing.T) {
+	iq := &Instrumenter{ObjectMeta: metav1.ObjectMeta{Name: "instrumenter", Namespace: "default"}, Spec: InstrumenterSpec{
+		Selector: Selector{PortLabel: "grafana.com/instrument-port"},
+		Export:   []Exporter{ExporterOTELTraces},
+		Beyla: &BeylaConfig{
+			LogLevel: "DEBUG",
+			Routes:   &BeylaRoutes{Patterns: []string{"/users/:id"}},
+		},
+		OverrideEnv: []v1.EnvVar{{Name: "BEYLA_CONFIG_PATH", Value: "/other/config.yml"}},
+	}}
+	pod := v1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Name: "pod", Namespace: "default", Labels: map[string]string{"grafana.com/instrument-port": "8080"},
+	}}
+	if !InstrumentIfRequired(iq, &pod, nil) {
+		t.Fatal("expected Pod to be instrumented")
+	}
+	if len(pod.Spec.Volumes) != 1 || pod.Spec.Volumes[0].ConfigMap == nil ||
+		!strings.HasPrefix(pod.Spec.Volumes[0].ConfigMap.Name, "beyla-config-instrumenter-") {
+		t.Fatalf("expected the configuration ConfigMap volume to be added. Got %+v", pod.Spec.Volumes)
+	}
+	sidecar, _ := findByName(pod.Spec.Containers)
+	if len(sidecar.VolumeMounts) != 1 || sidecar.VolumeMounts[0].MountPath != BeylaConfigDir {
+		t.Errorf("expected the sidecar to mount the configuration volume. Got %+v", sidecar.VolumeMounts)
+	}
+	// the override replaces the variable instead of duplicating it
+	configPaths := 0
+	for _, env := range sidecar.Env {
+		if env.Name == "BEYLA_CONFIG_PATH" {
+			configPaths++
+		}
+	}
+	if value := envValue(sidecar, "BEYLA_CONFIG_PATH"); configPaths != 1 || value != "/other/config.yml" {
+		t.Errorf("expected a single overridden BEYLA_CONFIG_PATH. Got %d with value %q", configPaths, value)
+	}
+	hash := pod.Annotations[ConfigHashAnnotation]
+	if hash == "" {
+		t.Errorf("expected the configuration hash annotation. Got %v", pod.Annotations)
+	}
+	if _, ok := NeedsInstrumentation(iq, &pod, nil); ok {
+		t.Error("not expecting the Pod to need instrumentation again")
+	}
+
+	// changing the configuration requires reinstrumenting the Pod
+	iq.Spec.Beyla.LogLevel = "INFO"
+	if _, ok := NeedsInstrumentation(iq, &pod, nil); !ok {
+		t.Error("expecting the Pod to need instrumentation after changing the configuration")
+	}
+	if !InstrumentIfRequired(iq, &pod, nil) {
+		t.Fatal("expected Pod to be reinstrumented")
+	}
+	if pod.Annotations[ConfigHashAnnotation] == hash {
+		t.Error("expected the configuration hash to change")
+	}
+
+	RemoveInstrumenter(&pod)
+	if len(pod.Spec.Volumes) != 0 {
+		t.Errorf("expected the configuration volume to be removed. Got %+v", pod.Spec.Volumes)
+	}
+	if _, ok := pod.Annotations[ConfigHashAnnotation]; ok {
+		t.Errorf("expected the configuration hash annotation to be removed. Got %v", pod.Annotations)
+	}
+}
+
+func TestSidecarConfig(t *testing.T) {
+	spec := InstrumenterSpec{Beyla: &BeylaConfig{
+		Filters: &BeylaFilters{Application: map[string]MatchFilter{"url.path": {NotMatch: "/health"}}},
+	}}
+	cluster := &ClusterInstrumenter{ObjectMeta: metav1.ObjectMeta{Name: "foo"}, Spec: ClusterInstrumenterSpec{InstrumenterSpec: spec}}
+	name, file, ok := SidecarConfig(cluster)
+	if !ok || !strings.HasPrefix(name, "beyla-config-foo-") {
+		t.Errorf("expected a beyla-config-foo-<hash> ConfigMap. Got %q (%v)", name, ok)
+	}
+	// the ConfigMaps of Instrumenters and ClusterInstrumenters don't collide
+	for _, iq := range []InstrumenterObject{
+		&Instrumenter{ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "ns"}, Spec: spec},
+		&Instrumenter{ObjectMeta: metav1.ObjectMeta{Name: "cluster-foo", Namespace: "ns"}, Spec: spec},
+	} {
+		if other, _, _ := SidecarConfig(iq); other == name {
+			t.Errorf("expected %s %s to have a different ConfigMap. Got %q", iq.InstrumenterKind(), iq.GetName(), other)
+		}
+	}
+	// the name is truncated to fit the ConfigMap name limit, keeping the hash suffix
+	long := &Instrumenter{ObjectMeta: metav1.ObjectMeta{Name: strings.Repeat("a", 240) + "." + strings.Repeat("b", 12)}, Spec: spec}
+	longName, _, _ := SidecarConfig(long)
+	if len(longName) > 253 || strings.Contains(longName, ".-") || !strings.HasPrefix(longName, "beyla-config-aaa") {
+		t.Errorf("expected a valid ConfigMap name. Got %q", longName)
+	}
+	expected := "filter:\n  application:\n    url.path:\n      not_match: /health\n"
+	if string(file) != expected {
+		t.Errorf("unexpected configuration file:\n%s", file)
+	}
+	// in DaemonSet mode, the configuration goes to the node agent ConfigMap
+	cluster.Spec.Mode = ModeDaemonSet
+	if _, _, ok := SidecarConfig(cluster); ok {
+		t.Error("not expecting a sidecar configuration in DaemonSet mode")
+	}
+}
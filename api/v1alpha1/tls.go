@@ -0,0 +1,108 @@
+/*
+Copyright 2023 Grafana Labs <hello@grafana.com>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	v1 "k8s.io/api/core/v1"
+)
+
+// volumes that provide the OTLP TLS certificates to the autoinstrumenter
+const (
+	otlpCAVolume         = "beyla-otlp-ca"
+	otlpClientCertVolume = "beyla-otlp-client-cert"
+
+	otlpCADir         = "/etc/beyla/otlp-ca"
+	otlpClientCertDir = "/etc/beyla/otlp-client-cert"
+
+	// the mounted files are named as in the kubernetes.io/tls Secrets
+	caFile   = "ca.crt"
+	certFile = "tls.crt"
+	keyFile  = "tls.key"
+)
+
+// ExporterVolumes returns the volumes that the autoinstrumenter container requires in its Pod,
+// according to the exporters configuration
+func ExporterVolumes(spec *InstrumenterSpec) []v1.Volume {
+	tls := spec.OpenTelemetry.TLS
+	if tls == nil || !exportsOTLP(spec) {
+		return nil
+	}
+	var volumes []v1.Volume
+	if ca := tls.CA; ca != nil {
+		switch {
+		case ca.ConfigMapKeyRef != nil:
+			volumes = append(volumes, v1.Volume{Name: otlpCAVolume, VolumeSource: v1.VolumeSource{
+				ConfigMap: &v1.ConfigMapVolumeSource{
+					LocalObjectReference: ca.ConfigMapKeyRef.LocalObjectReference,
+					Items:                []v1.KeyToPath{{Key: ca.ConfigMapKeyRef.Key, Path: caFile}},
+				},
+			}})
+		case ca.SecretKeyRef != nil:
+			volumes = append(volumes, v1.Volume{Name: otlpCAVolume, VolumeSource: v1.VolumeSource{
+				Secret: &v1.SecretVolumeSource{
+					SecretName: ca.SecretKeyRef.Name,
+					Items:      []v1.KeyToPath{{Key: ca.SecretKeyRef.Key, Path: caFile}},
+				},
+			}})
+		}
+	}
+	if cert := tls.ClientCertificate; cert != nil {
+		volumes = append(volumes, v1.Volume{Name: otlpClientCertVolume, VolumeSource: v1.VolumeSource{
+			Secret: &v1.SecretVolumeSource{
+				SecretName: cert.SecretName,
+				Items: []v1.KeyToPath{
+					{Key: orDefault(cert.CertificateKey, certFile), Path: certFile},
+					{Key: orDefault(cert.PrivateKeyKey, keyFile), Path: keyFile},
+				},
+			},
+		}})
+	}
+	return volumes
+}
+
+// configOTLPTLS mounts the volumes returned by ExporterVolumes in the autoinstrumenter container,
+// and points the OTLP exporters to the certificate files
+func configOTLPTLS(tls *OTLPTLS, container *v1.Container) {
+	if tls == nil {
+		return
+	}
+	if tls.CA != nil && (tls.CA.ConfigMapKeyRef != nil || tls.CA.SecretKeyRef != nil) {
+		container.VolumeMounts = append(container.VolumeMounts,
+			v1.VolumeMount{Name: otlpCAVolume, MountPath: otlpCADir, ReadOnly: true})
+		container.Env = append(container.Env,
+			v1.EnvVar{Name: "OTEL_EXPORTER_OTLP_CERTIFICATE", Value: otlpCADir + "/" + caFile})
+	}
+	if tls.ClientCertificate != nil {
+		container.VolumeMounts = append(container.VolumeMounts,
+			v1.VolumeMount{Name: otlpClientCertVolume, MountPath: otlpClientCertDir, ReadOnly: true})
+		container.Env = append(container.Env,
+			v1.EnvVar{Name: "OTEL_EXPORTER_OTLP_CLIENT_CERTIFICATE", Value: otlpClientCertDir + "/" + certFile},
+			v1.EnvVar{Name: "OTEL_EXPORTER_OTLP_CLIENT_KEY", Value: otlpClientCertDir + "/" + keyFile})
+	}
+}
+
+// isInstrumenterVolume returns whether the volume was added to the Pod by AddInstrumenter
+func isInstrumenterVolume(volume *v1.Volume) bool {
+	return volume.Name == otlpCAVolume || volume.Name == otlpClientCertVolume || volume.Name == sidecarConfigVolume
+}
+
+func orDefault(value, defaultValue string) string {
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
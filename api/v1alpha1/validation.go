@@ -0,0 +1,333 @@
+/*
+Copyright 2023 Grafana Labs <hello@grafana.com>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+var otlpProtocols = []string{string(OTLPProtocolGRPC), string(OTLPProtocolHTTPProtobuf)}
+
+var samplers = []string{
+	string(SamplerAlwaysOn), string(SamplerAlwaysOff), string(SamplerTraceIDRatio),
+	string(SamplerParentBasedAlwaysOn), string(SamplerParentBasedAlwaysOff), string(SamplerParentBasedTraceIDRatio),
+}
+
+// validateSpec returns the errors in an instrumenter specification. Besides the checks that
+// can't be expressed in the CRD schema, it repeats some of them in case the CRD is outdated.
+func validateSpec(spec *InstrumenterSpec, specPath *field.Path) field.ErrorList {
+	otel := &spec.OpenTelemetry
+	otelPath := specPath.Child("openTelemetry")
+	errs := validateOTLPProtocol(otel.Protocol, otelPath.Child("protocol"))
+	errs = append(errs, validateOTLPEndpoints(spec, otelPath)...)
+	errs = append(errs, validateOTLPSignal(otel, &otel.Metrics, otelPath.Child("metrics"))...)
+	errs = append(errs, validateOTLPSignal(otel, &otel.Traces, otelPath.Child("traces"))...)
+	if otel.Sampler != nil {
+		errs = append(errs, validateSampler(otel.Sampler, otelPath.Child("sampler"))...)
+	}
+	if otel.TLS != nil && otel.TLS.CA != nil {
+		errs = append(errs, validateCABundle(otel.TLS.CA, otelPath.Child("tls", "ca"))...)
+	}
+	for i := range otel.Headers {
+		errs = append(errs, validateOTLPHeader(&otel.Headers[i], otelPath.Child("headers").Index(i))...)
+	}
+	errs = append(errs, validateSelector(&spec.Selector, specPath.Child("selector"))...)
+	for i := range spec.ServiceName.Sources {
+		errs = append(errs, validateServiceNameSource(&spec.ServiceName.Sources[i],
+			specPath.Child("serviceName", "sources").Index(i))...)
+	}
+	// an unset port takes the default value
+	if port := spec.Prometheus.Port; port < 0 || port > 65535 {
+		errs = append(errs, field.Invalid(specPath.Child("prometheus", "port"), port, "must be from 1 to 65535"))
+	}
+	return errs
+}
+
+// validateSelector checks that the Pod and Namespace label selectors can be parsed
+func validateSelector(selector *Selector, selectorPath *field.Path) field.ErrorList {
+	var errs field.ErrorList
+	if _, err := metav1.LabelSelectorAsSelector(&metav1.LabelSelector{MatchLabels: selector.MatchLabels}); err != nil {
+		errs = append(errs, field.Invalid(selectorPath.Child("matchLabels"), selector.MatchLabels, err.Error()))
+	}
+	for i := range selector.MatchExpressions {
+		expr := &selector.MatchExpressions[i]
+		if _, err := metav1.LabelSelectorAsSelector(&metav1.LabelSelector{
+			MatchExpressions: []metav1.LabelSelectorRequirement{*expr},
+		}); err != nil {
+			errs = append(errs, field.Invalid(selectorPath.Child("matchExpressions").Index(i), expr, err.Error()))
+		}
+	}
+	if selector.NamespaceSelector != nil {
+		if _, err := metav1.LabelSelectorAsSelector(selector.NamespaceSelector); err != nil {
+			errs = append(errs, field.Invalid(selectorPath.Child("namespaceSelector"),
+				selector.NamespaceSelector, err.Error()))
+		}
+	}
+	return errs
+}
+
+func validateServiceNameSource(source *ServiceNameSource, sourcePath *field.Path) field.ErrorList {
+	switch {
+	case (source.Type == ServiceNameAnnotation || source.Type == ServiceNameLabel) && source.Key == "":
+		return field.ErrorList{field.Required(sourcePath.Child("key"),
+			fmt.Sprintf("required by the %s source type", source.Type))}
+	case source.Type == ServiceNameTemplate && source.Template == "":
+		return field.ErrorList{field.Required(sourcePath.Child("template"),
+			"required by the Template source type")}
+	}
+	return nil
+}
+
+// validateOTLPEndpoints checks that the OTLP endpoints are valid URLs, and that each enabled
+// OpenTelemetry exporter has an endpoint, either from the specification or from the OverrideEnv
+func validateOTLPEndpoints(spec *InstrumenterSpec, otelPath *field.Path) field.ErrorList {
+	otel := &spec.OpenTelemetry
+	errs := validateEndpointURL(otel.Endpoint, otelPath.Child("endpoint"))
+	errs = append(errs, validateEndpointURL(otel.Metrics.Endpoint, otelPath.Child("metrics", "endpoint"))...)
+	errs = append(errs, validateEndpointURL(otel.Traces.Endpoint, otelPath.Child("traces", "endpoint"))...)
+	if otel.Endpoint != "" || overridesEnv(spec, "OTEL_EXPORTER_OTLP_ENDPOINT") {
+		return errs
+	}
+	for _, exporter := range spec.Export {
+		switch {
+		case exporter == ExporterOTELMetrics && otel.Metrics.Endpoint == "" &&
+			!overridesEnv(spec, "OTEL_EXPORTER_OTLP_METRICS_ENDPOINT"):
+			errs = append(errs, field.Required(otelPath.Child("endpoint"),
+				"required by the OpenTelemetryMetrics exporter, unless openTelemetry.metrics.endpoint is set"))
+		case exporter == ExporterOTELTraces && otel.Traces.Endpoint == "" &&
+			!overridesEnv(spec, "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"):
+			errs = append(errs, field.Required(otelPath.Child("endpoint"),
+				"required by the OpenTelemetryTraces exporter, unless openTelemetry.traces.endpoint is set"))
+		}
+	}
+	return errs
+}
+
+func validateEndpointURL(endpoint string, endpointPath *field.Path) field.ErrorList {
+	if endpoint == "" {
+		return nil
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return field.ErrorList{field.Invalid(endpointPath, endpoint,
+			"must be an absolute URL with the http or https scheme, e.g. http://otel-collector:4318")}
+	}
+	return nil
+}
+
+// overridesEnv returns whether the OverrideEnv of the specification sets the given variable
+func overridesEnv(spec *InstrumenterSpec, name string) bool {
+	for i := range spec.OverrideEnv {
+		if spec.OverrideEnv[i].Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func validateOTLPHeader(header *OTLPHeader, headerPath *field.Path) field.ErrorList {
+	var errs field.ErrorList
+	if header.Name == "" {
+		errs = append(errs, field.Required(headerPath.Child("name"), ""))
+	} else if strings.ContainsAny(header.Name, "=, ") {
+		errs = append(errs, field.Invalid(headerPath.Child("name"), header.Name,
+			"must not contain equal signs, commas or spaces"))
+	}
+	switch {
+	case header.ValueFrom == nil:
+	case header.ValueFrom.SecretKeyRef == nil:
+		errs = append(errs, field.Required(headerPath.Child("valueFrom", "secretKeyRef"), ""))
+	case header.Value != "":
+		errs = append(errs, field.Forbidden(headerPath.Child("value"),
+			"may not be specified when valueFrom is not empty"))
+	}
+	return errs
+}
+
+func validateOTLPSignal(otel *OpenTelemetry, signal *OTLPSignal, signalPath *field.Path) field.ErrorList {
+	errs := validateOTLPProtocol(signal.Protocol, signalPath.Child("protocol"))
+	if signal.Path != "" && otel.protocol(signal) == OTLPProtocolGRPC {
+		errs = append(errs, field.Invalid(signalPath.Child("path"), signal.Path,
+			"gRPC endpoints don't have a path. Leave it empty or use the http/protobuf protocol"))
+	}
+	return errs
+}
+
+func validateOTLPProtocol(protocol OTLPProtocol, protocolPath *field.Path) field.ErrorList {
+	switch protocol {
+	case "", OTLPProtocolGRPC, OTLPProtocolHTTPProtobuf:
+		return nil
+	}
+	return field.ErrorList{field.NotSupported(protocolPath, protocol, otlpProtocols)}
+}
+
+func validateCABundle(ca *CABundle, caPath *field.Path) field.ErrorList {
+	switch {
+	case ca.ConfigMapKeyRef == nil && ca.SecretKeyRef == nil:
+		return field.ErrorList{field.Required(caPath, "either configMapKeyRef or secretKeyRef must be set")}
+	case ca.ConfigMapKeyRef != nil && ca.SecretKeyRef != nil:
+		return field.ErrorList{field.Forbidden(caPath.Child("secretKeyRef"),
+			"may not be specified when configMapKeyRef is set")}
+	}
+	return nil
+}
+
+func validateSampler(sampler *Sampler, samplerPath *field.Path) field.ErrorList {
+	switch sampler.Name {
+	case SamplerAlwaysOn, SamplerAlwaysOff, SamplerParentBasedAlwaysOn, SamplerParentBasedAlwaysOff:
+		if sampler.Ratio != "" {
+			return field.ErrorList{field.Forbidden(samplerPath.Child("ratio"),
+				"only allowed for the traceidratio and parentbased_traceidratio samplers")}
+		}
+	case SamplerTraceIDRatio, SamplerParentBasedTraceIDRatio:
+		if sampler.Ratio == "" {
+			return nil
+		}
+		if ratio, err := strconv.ParseFloat(sampler.Ratio, 64); err != nil || ratio < 0 || ratio > 1 {
+			return field.ErrorList{field.Invalid(samplerPath.Child("ratio"), sampler.Ratio,
+				"must be a number from 0 to 1")}
+		}
+	default:
+		return field.ErrorList{field.NotSupported(samplerPath.Child("name"), sampler.Name, samplers)}
+	}
+	return nil
+}
+
+// specWarnings returns the warnings about risky, although valid, settings of an instrumenter specification
+func specWarnings(spec *InstrumenterSpec, specPath *field.Path) []string {
+	var warnings []string
+	if spec.OpenTelemetry.InsecureSkipVerify && exportsOTLP(spec) {
+		warnings = append(warnings, fmt.Sprintf("%s: the certificates of the OTLP endpoints aren't verified. "+
+			"Use it only for testing purposes", specPath.Child("openTelemetry", "insecureSkipVerify")))
+	}
+	// the default image isn't pinned until the operator releases are tied to autoinstrumenter versions
+	if spec.Image != "" && spec.Image != DefaultImage && unpinnedImage(spec.Image) {
+		warnings = append(warnings, fmt.Sprintf("%s: image %q isn't pinned to a version, so the "+
+			"instrumented Pods might run different autoinstrumenter versions. Use a version tag or digest",
+			specPath.Child("image"), spec.Image))
+	}
+	return warnings
+}
+
+// unpinnedImage returns whether the container image has no tag nor digest, or the latest tag
+func unpinnedImage(image string) bool {
+	if strings.Contains(image, "@") {
+		return false
+	}
+	// the registry host might contain a port, so only the last path element is checked
+	name := image[strings.LastIndex(image, "/")+1:]
+	tag := ""
+	if i := strings.LastIndex(name, ":"); i >= 0 {
+		tag = name[i+1:]
+	}
+	return tag == "" || tag == "latest"
+}
+
+// prometheusPortClash returns the first selected Pod whose containers already use the Prometheus port
+// of the autoinstrumenter sidecar, as well as a description of the clash
+func prometheusPortClash(iq InstrumenterObject, pods []v1.Pod) (*v1.Pod, string, bool) {
+	spec := iq.GetSpec()
+	if iq.GetMode() == ModeDaemonSet || !ExportsPrometheus(spec) {
+		return nil, "", false
+	}
+	port := strconv.Itoa(spec.Prometheus.Port)
+	for i := range pods {
+		pod := &pods[i]
+		if selected, err := spec.Selector.SelectsPod(pod); err != nil || !selected {
+			continue
+		}
+		if pod.Labels[spec.Selector.PortLabel] == port {
+			return pod, fmt.Sprintf("it is the instrumented port, according to the %s label", spec.Selector.PortLabel), true
+		}
+		for c := range pod.Spec.Containers {
+			container := &pod.Spec.Containers[c]
+			if container.Name == instrumenterName {
+				continue
+			}
+			for _, p := range container.Ports {
+				if p.ContainerPort == int32(spec.Prometheus.Port) {
+					return pod, fmt.Sprintf("it is used by container %s", container.Name), true
+				}
+			}
+		}
+	}
+	return nil, "", false
+}
+
+// selectorsOverlap returns whether two Pod selectors might select the same Pods. The check is
+// conservative: the selectors are only considered disjoint when they have conflicting
+// requirements for the same label. Invalid selectors don't select any Pod.
+func selectorsOverlap(a, b *Selector) bool {
+	reqsA, okA := podRequirements(a)
+	reqsB, okB := podRequirements(b)
+	if !okA || !okB {
+		return false
+	}
+	for i := range reqsA {
+		for j := range reqsB {
+			if reqsA[i].Key() == reqsB[j].Key() &&
+				(conflicting(&reqsA[i], &reqsB[j]) || conflicting(&reqsB[j], &reqsA[i])) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func podRequirements(s *Selector) (labels.Requirements, bool) {
+	sel, err := metav1.LabelSelectorAsSelector(&metav1.LabelSelector{
+		MatchLabels: s.MatchLabels,
+		MatchExpressions: append([]metav1.LabelSelectorRequirement{{
+			Key: s.PortLabel, Operator: metav1.LabelSelectorOpExists,
+		}}, s.MatchExpressions...),
+	})
+	if err != nil {
+		return nil, false
+	}
+	reqs, _ := sel.Requirements()
+	return reqs, true
+}
+
+// conflicting returns whether no label value can satisfy both requirements for the same key
+func conflicting(x, y *labels.Requirement) bool {
+	switch x.Operator() {
+	case selection.DoesNotExist:
+		return y.Operator() == selection.Exists || isIn(y)
+	case selection.In, selection.Equals, selection.DoubleEquals:
+		if isIn(y) {
+			return !x.Values().HasAny(y.Values().List()...)
+		}
+		if y.Operator() == selection.NotIn || y.Operator() == selection.NotEquals {
+			return y.Values().IsSuperset(x.Values())
+		}
+	}
+	return false
+}
+
+func isIn(r *labels.Requirement) bool {
+	op := r.Operator()
+	return op == selection.In || op == selection.Equals || op == selection.DoubleEquals
+}
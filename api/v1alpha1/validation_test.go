@@ -0,0 +1,358 @@
+/*
+Copyright 2023 Grafana Labs <hello@grafana.com>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+func TestValidateSpec_OTLPProtocol(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		otel     OpenTelemetry
+		expected []string
+	}{{
+		name: "defaults",
+	}, {
+		name: "HTTP with path",
+		otel: OpenTelemetry{Protocol: OTLPProtocolHTTPProtobuf, Metrics: OTLPSignal{Path: "/custom"}},
+	}, {
+		name:     "gRPC with path",
+		otel:     OpenTelemetry{Protocol: OTLPProtocolGRPC, Traces: OTLPSignal{Path: "/v1/traces"}},
+		expected: []string{"spec.openTelemetry.traces.path"},
+	}, {
+		name: "gRPC signal overridden to HTTP",
+		otel: OpenTelemetry{Protocol: OTLPProtocolGRPC, Traces: OTLPSignal{
+			Path: "/v1/traces", Protocol: OTLPProtocolHTTPProtobuf,
+		}},
+	}, {
+		name: "gRPC signal with path",
+		otel: OpenTelemetry{Metrics: OTLPSignal{
+			Path: "/v1/metrics", Protocol: OTLPProtocolGRPC,
+		}},
+		expected: []string{"spec.openTelemetry.metrics.path"},
+	}, {
+		name:     "unsupported protocols",
+		otel:     OpenTelemetry{Protocol: "http/json", Metrics: OTLPSignal{Protocol: "udp"}},
+		expected: []string{"spec.openTelemetry.protocol", "spec.openTelemetry.metrics.protocol"},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			errs := validateSpec(&InstrumenterSpec{OpenTelemetry: tc.otel}, field.NewPath("spec"))
+			if len(errs) != len(tc.expected) {
+				t.Fatalf("expected %d errors. Got %v", len(tc.expected), errs)
+			}
+			for i := range errs {
+				if errs[i].Field != tc.expected[i] {
+					t.Errorf("expected error in field %s. Got %v", tc.expected[i], errs[i])
+				}
+			}
+		})
+	}
+}
+
+func TestValidateSpec_OTLPHeaders(t *testing.T) {
+	secretRef := &v1.SecretKeySelector{LocalObjectReference: v1.LocalObjectReference{Name: "secret"}, Key: "key"}
+	headers := []OTLPHeader{
+		{Name: "X-Scope-OrgID", Value: "tenant"},
+		{Name: "Authorization", ValueFrom: &OTLPHeaderSource{SecretKeyRef: secretRef}},
+		{Name: "", Value: "no-name"},
+		{Name: "A=B", Value: "invalid-name"},
+		{Name: "Both", Value: "value", ValueFrom: &OTLPHeaderSource{SecretKeyRef: secretRef}},
+		{Name: "Empty-Source", ValueFrom: &OTLPHeaderSource{}},
+	}
+	errs := validateSpec(&InstrumenterSpec{OpenTelemetry: OpenTelemetry{Headers: headers}}, field.NewPath("spec"))
+	expected := []string{
+		"spec.openTelemetry.headers[2].name",
+		"spec.openTelemetry.headers[3].name",
+		"spec.openTelemetry.headers[4].value",
+		"spec.openTelemetry.headers[5].valueFrom.secretKeyRef",
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("expected %d errors. Got %v", len(expected), errs)
+	}
+	for i := range errs {
+		if errs[i].Field != expected[i] {
+			t.Errorf("expected error in field %s. Got %v", expected[i], errs[i])
+		}
+	}
+}
+
+func TestValidateSpec_CABundle(t *testing.T) {
+	cmRef := &v1.ConfigMapKeySelector{LocalObjectReference: v1.LocalObjectReference{Name: "cm"}, Key: "ca.crt"}
+	secretRef := &v1.SecretKeySelector{LocalObjectReference: v1.LocalObjectReference{Name: "secret"}, Key: "ca.crt"}
+	for _, tc := range []struct {
+		name     string
+		ca       CABundle
+		expected string
+	}{
+		{name: "configmap", ca: CABundle{ConfigMapKeyRef: cmRef}},
+		{name: "secret", ca: CABundle{SecretKeyRef: secretRef}},
+		{name: "none", expected: "spec.openTelemetry.tls.ca"},
+		{name: "both", ca: CABundle{ConfigMapKeyRef: cmRef, SecretKeyRef: secretRef},
+			expected: "spec.openTelemetry.tls.ca.secretKeyRef"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			spec := InstrumenterSpec{OpenTelemetry: OpenTelemetry{TLS: &OTLPTLS{CA: &tc.ca}}}
+			errs := validateSpec(&spec, field.NewPath("spec"))
+			if tc.expected == "" && len(errs) > 0 {
+				t.Errorf("unexpected errors: %v", errs)
+			}
+			if tc.expected != "" && (len(errs) != 1 || errs[0].Field != tc.expected) {
+				t.Errorf("expected an error in field %s. Got %v", tc.expected, errs)
+			}
+		})
+	}
+}
+
+func TestValidateSpec_Sampler(t *testing.T) {
+	for _, tc := range []struct {
+		sampler  Sampler
+		expected string
+	}{
+		{sampler: Sampler{Name: SamplerAlwaysOn}},
+		{sampler: Sampler{Name: SamplerParentBasedAlwaysOff}},
+		{sampler: Sampler{Name: SamplerTraceIDRatio}},
+		{sampler: Sampler{Name: SamplerTraceIDRatio, Ratio: "0.1"}},
+		{sampler: Sampler{Name: SamplerParentBasedTraceIDRatio, Ratio: "1"}},
+		{sampler: Sampler{Name: SamplerTraceIDRatio, Ratio: "1.5"}, expected: "spec.openTelemetry.sampler.ratio"},
+		{sampler: Sampler{Name: SamplerTraceIDRatio, Ratio: "half"}, expected: "spec.openTelemetry.sampler.ratio"},
+		{sampler: Sampler{Name: SamplerAlwaysOff, Ratio: "0.5"}, expected: "spec.openTelemetry.sampler.ratio"},
+		{sampler: Sampler{Name: "jaeger_remote"}, expected: "spec.openTelemetry.sampler.name"},
+	} {
+		t.Run(string(tc.sampler.Name)+"/"+tc.sampler.Ratio, func(t *testing.T) {
+			spec := InstrumenterSpec{OpenTelemetry: OpenTelemetry{Sampler: &tc.sampler}}
+			errs := validateSpec(&spec, field.NewPath("spec"))
+			if tc.expected == "" && len(errs) > 0 {
+				t.Errorf("unexpected errors: %v", errs)
+			}
+			if tc.expected != "" && (len(errs) != 1 || errs[0].Field != tc.expected) {
+				t.Errorf("expected an error in field %s. Got %v", tc.expected, errs)
+			}
+		})
+	}
+}
+
+func TestValidateSpec_OTLPEndpoints(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		spec     InstrumenterSpec
+		expected []string
+	}{{
+		name: "prometheus without endpoint",
+		spec: InstrumenterSpec{Export: []Exporter{ExporterPrometheus}},
+	}, {
+		name: "general endpoint",
+		spec: InstrumenterSpec{Export: []Exporter{ExporterOTELMetrics, ExporterOTELTraces},
+			OpenTelemetry: OpenTelemetry{Endpoint: "https://otel-collector:4318"}},
+	}, {
+		name: "signal endpoints",
+		spec: InstrumenterSpec{Export: []Exporter{ExporterOTELMetrics, ExporterOTELTraces},
+			OpenTelemetry: OpenTelemetry{
+				Metrics: OTLPSignal{Endpoint: "http://mimir:4318"},
+				Traces:  OTLPSignal{Endpoint: "http://tempo:4318"},
+			}},
+	}, {
+		name: "endpoint from env",
+		spec: InstrumenterSpec{Export: []Exporter{ExporterOTELTraces},
+			OverrideEnv: []v1.EnvVar{{Name: "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", Value: "http://tempo:4318"}}},
+	}, {
+		name: "missing endpoints",
+		spec: InstrumenterSpec{Export: []Exporter{ExporterOTELMetrics, ExporterOTELTraces},
+			OpenTelemetry: OpenTelemetry{Metrics: OTLPSignal{Endpoint: "http://mimir:4318"}}},
+		expected: []string{"spec.openTelemetry.endpoint"},
+	}, {
+		name: "malformed URLs",
+		spec: InstrumenterSpec{Export: []Exporter{ExporterOTELMetrics},
+			OpenTelemetry: OpenTelemetry{Endpoint: "otel-collector:4318", Traces: OTLPSignal{Endpoint: "http://"}}},
+		expected: []string{"spec.openTelemetry.endpoint", "spec.openTelemetry.traces.endpoint"},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			errs := validateSpec(&tc.spec, field.NewPath("spec"))
+			if len(errs) != len(tc.expected) {
+				t.Fatalf("expected %d errors. Got %v", len(tc.expected), errs)
+			}
+			for i := range errs {
+				if errs[i].Field != tc.expected[i] {
+					t.Errorf("expected error in field %s. Got %v", tc.expected[i], errs[i])
+				}
+			}
+		})
+	}
+}
+
+func TestValidateSpec_Selector(t *testing.T) {
+	spec := InstrumenterSpec{Selector: Selector{
+		MatchLabels: map[string]string{"app": "backend", "invalid key": "value"},
+		MatchExpressions: []metav1.LabelSelectorRequirement{
+			{Key: "tier", Operator: metav1.LabelSelectorOpIn, Values: []string{"web"}},
+			{Key: "tier", Operator: metav1.LabelSelectorOpIn},
+		},
+		NamespaceSelector: &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{
+			{Key: "team", Operator: "Like", Values: []string{"payments"}},
+		}},
+	}}
+	errs := validateSpec(&spec, field.NewPath("spec"))
+	expected := []string{
+		"spec.selector.matchLabels",
+		"spec.selector.matchExpressions[1]",
+		"spec.selector.namespaceSelector",
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("expected %d errors. Got %v", len(expected), errs)
+	}
+	for i := range errs {
+		if errs[i].Field != expected[i] {
+			t.Errorf("expected error in field %s. Got %v", expected[i], errs[i])
+		}
+	}
+}
+
+func TestValidateSpec_ServiceNameAndPort(t *testing.T) {
+	spec := InstrumenterSpec{
+		ServiceName: ServiceNamePolicy{Sources: []ServiceNameSource{
+			{Type: ServiceNameAnnotation, Key: "app.kubernetes.io/name"},
+			{Type: ServiceNameAnnotation},
+			{Type: ServiceNameLabel},
+			{Type: ServiceNameTemplate, Template: "{namespace}-{owner}"},
+			{Type: ServiceNameTemplate},
+			{Type: ServiceNameOwnerName},
+		}},
+		Prometheus: Prometheus{Port: 70000},
+	}
+	errs := validateSpec(&spec, field.NewPath("spec"))
+	expected := []string{
+		"spec.serviceName.sources[1].key",
+		"spec.serviceName.sources[2].key",
+		"spec.serviceName.sources[4].template",
+		"spec.prometheus.port",
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("expected %d errors. Got %v", len(expected), errs)
+	}
+	for i := range errs {
+		if errs[i].Field != expected[i] {
+			t.Errorf("expected error in field %s. Got %v", expected[i], errs[i])
+		}
+	}
+}
+
+func TestSpecWarnings(t *testing.T) {
+	for _, tc := range []struct {
+		image    string
+		insecure bool
+		warnings int
+	}{
+		{image: "grafana/beyla:1.0.0"},
+		{image: "localhost:5000/beyla@sha256:0123456789abcdef"},
+		{image: "localhost:5000/beyla:1.0.0"},
+		{image: "grafana/beyla", warnings: 1},
+		{image: "localhost:5000/beyla", warnings: 1},
+		{image: "grafana/beyla:latest", warnings: 1},
+		{image: "grafana/beyla:latest", insecure: true, warnings: 2},
+		// the defaulted image
+		{image: DefaultImage},
+	} {
+		t.Run(tc.image, func(t *testing.T) {
+			spec := InstrumenterSpec{
+				Image:         tc.image,
+				Export:        []Exporter{ExporterOTELTraces},
+				OpenTelemetry: OpenTelemetry{InsecureSkipVerify: tc.insecure},
+			}
+			if warnings := specWarnings(&spec, field.NewPath("spec")); len(warnings) != tc.warnings {
+				t.Errorf("expected %d warnings. Got %v", tc.warnings, warnings)
+			}
+		})
+	}
+}
+
+func TestSelectorsOverlap(t *testing.T) {
+	expr := func(key string, op metav1.LabelSelectorOperator, values ...string) []metav1.LabelSelectorRequirement {
+		return []metav1.LabelSelectorRequirement{{Key: key, Operator: op, Values: values}}
+	}
+	for _, tc := range []struct {
+		name    string
+		a, b    Selector
+		overlap bool
+	}{
+		{name: "same port label",
+			a: Selector{PortLabel: "port"}, b: Selector{PortLabel: "port"}, overlap: true},
+		{name: "different port labels",
+			a: Selector{PortLabel: "port"}, b: Selector{PortLabel: "other"}, overlap: true},
+		{name: "different label values",
+			a: Selector{PortLabel: "port", MatchLabels: map[string]string{"app": "foo"}},
+			b: Selector{PortLabel: "port", MatchLabels: map[string]string{"app": "bar"}}},
+		{name: "compatible labels",
+			a: Selector{PortLabel: "port", MatchLabels: map[string]string{"app": "foo"}},
+			b: Selector{PortLabel: "port", MatchLabels: map[string]string{"tier": "backend"}}, overlap: true},
+		{name: "label excluded by expression",
+			a: Selector{PortLabel: "port", MatchLabels: map[string]string{"app": "foo"}},
+			b: Selector{PortLabel: "port", MatchExpressions: expr("app", metav1.LabelSelectorOpNotIn, "foo", "bar")}},
+		{name: "label not excluded by expression",
+			a:       Selector{PortLabel: "port", MatchLabels: map[string]string{"app": "foo"}},
+			b:       Selector{PortLabel: "port", MatchExpressions: expr("app", metav1.LabelSelectorOpNotIn, "bar")},
+			overlap: true},
+		{name: "disjoint sets",
+			a: Selector{PortLabel: "port", MatchExpressions: expr("app", metav1.LabelSelectorOpIn, "foo", "bar")},
+			b: Selector{PortLabel: "port", MatchExpressions: expr("app", metav1.LabelSelectorOpIn, "baz")}},
+		{name: "port label required not to exist",
+			a: Selector{PortLabel: "port"},
+			b: Selector{PortLabel: "other", MatchExpressions: expr("port", metav1.LabelSelectorOpDoesNotExist)}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if overlap := selectorsOverlap(&tc.a, &tc.b); overlap != tc.overlap {
+				t.Errorf("expected overlap to be %v. Got %v", tc.overlap, overlap)
+			}
+			if overlap := selectorsOverlap(&tc.b, &tc.a); overlap != tc.overlap {
+				t.Errorf("expected reverse overlap to be %v. Got %v", tc.overlap, overlap)
+			}
+		})
+	}
+}
+
+func TestPrometheusPortClash(t *testing.T) {
+	iq := &ClusterInstrumenter{Spec: ClusterInstrumenterSpec{InstrumenterSpec: InstrumenterSpec{
+		Export:     []Exporter{ExporterPrometheus},
+		Selector:   Selector{PortLabel: "port"},
+		Prometheus: Prometheus{Port: 9102},
+	}}}
+	pod := func(name, portLabel string, ports ...int32) v1.Pod {
+		p := v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{"port": portLabel}}}
+		container := v1.Container{Name: "app"}
+		for _, port := range ports {
+			container.Ports = append(container.Ports, v1.ContainerPort{ContainerPort: port})
+		}
+		p.Spec.Containers = []v1.Container{container}
+		return p
+	}
+	if _, _, ok := prometheusPortClash(iq, []v1.Pod{pod("a", "8080", 8080, 9090)}); ok {
+		t.Error("not expecting a port clash")
+	}
+	if p, _, ok := prometheusPortClash(iq, []v1.Pod{pod("a", "8080", 8080), pod("b", "8080", 9102)}); !ok || p.Name != "b" {
+		t.Errorf("expecting a port clash with Pod b. Got %v", p)
+	}
+	if p, _, ok := prometheusPortClash(iq, []v1.Pod{pod("c", "9102")}); !ok || p.Name != "c" {
+		t.Errorf("expecting a port clash with the instrumented port of Pod c. Got %v", p)
+	}
+	iq.Spec.Mode = ModeDaemonSet
+	if _, _, ok := prometheusPortClash(iq, []v1.Pod{pod("c", "9102")}); ok {
+		t.Error("not expecting a port clash in DaemonSet mode")
+	}
+}
@@ -23,16 +23,288 @@ package v1alpha1
 
 import (
 	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 )
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AttributeSelection) DeepCopyInto(out *AttributeSelection) {
+	*out = *in
+	if in.Include != nil {
+		in, out := &in.Include, &out.Include
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Exclude != nil {
+		in, out := &in.Exclude, &out.Exclude
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AttributeSelection.
+func (in *AttributeSelection) DeepCopy() *AttributeSelection {
+	if in == nil {
+		return nil
+	}
+	out := new(AttributeSelection)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BeylaAttributes) DeepCopyInto(out *BeylaAttributes) {
+	*out = *in
+	if in.Select != nil {
+		in, out := &in.Select, &out.Select
+		*out = make(map[string]AttributeSelection, len(*in))
+		for key, val := range *in {
+			(*out)[key] = *val.DeepCopy()
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BeylaAttributes.
+func (in *BeylaAttributes) DeepCopy() *BeylaAttributes {
+	if in == nil {
+		return nil
+	}
+	out := new(BeylaAttributes)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BeylaConfig) DeepCopyInto(out *BeylaConfig) {
+	*out = *in
+	if in.Routes != nil {
+		in, out := &in.Routes, &out.Routes
+		*out = new(BeylaRoutes)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Attributes != nil {
+		in, out := &in.Attributes, &out.Attributes
+		*out = new(BeylaAttributes)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Filters != nil {
+		in, out := &in.Filters, &out.Filters
+		*out = new(BeylaFilters)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Discovery != nil {
+		in, out := &in.Discovery, &out.Discovery
+		*out = new(BeylaDiscovery)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BeylaConfig.
+func (in *BeylaConfig) DeepCopy() *BeylaConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(BeylaConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BeylaDiscovery) DeepCopyInto(out *BeylaDiscovery) {
+	*out = *in
+	if in.ExcludeOTelInstrumentedServices != nil {
+		in, out := &in.ExcludeOTelInstrumentedServices, &out.ExcludeOTelInstrumentedServices
+		*out = new(bool)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BeylaDiscovery.
+func (in *BeylaDiscovery) DeepCopy() *BeylaDiscovery {
+	if in == nil {
+		return nil
+	}
+	out := new(BeylaDiscovery)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BeylaFilters) DeepCopyInto(out *BeylaFilters) {
+	*out = *in
+	if in.Application != nil {
+		in, out := &in.Application, &out.Application
+		*out = make(map[string]MatchFilter, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.Network != nil {
+		in, out := &in.Network, &out.Network
+		*out = make(map[string]MatchFilter, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BeylaFilters.
+func (in *BeylaFilters) DeepCopy() *BeylaFilters {
+	if in == nil {
+		return nil
+	}
+	out := new(BeylaFilters)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BeylaRoutes) DeepCopyInto(out *BeylaRoutes) {
+	*out = *in
+	if in.Patterns != nil {
+		in, out := &in.Patterns, &out.Patterns
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.IgnoredPatterns != nil {
+		in, out := &in.IgnoredPatterns, &out.IgnoredPatterns
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BeylaRoutes.
+func (in *BeylaRoutes) DeepCopy() *BeylaRoutes {
+	if in == nil {
+		return nil
+	}
+	out := new(BeylaRoutes)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CABundle) DeepCopyInto(out *CABundle) {
+	*out = *in
+	if in.ConfigMapKeyRef != nil {
+		in, out := &in.ConfigMapKeyRef, &out.ConfigMapKeyRef
+		*out = new(v1.ConfigMapKeySelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.SecretKeyRef != nil {
+		in, out := &in.SecretKeyRef, &out.SecretKeyRef
+		*out = new(v1.SecretKeySelector)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CABundle.
+func (in *CABundle) DeepCopy() *CABundle {
+	if in == nil {
+		return nil
+	}
+	out := new(CABundle)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClientCertificate) DeepCopyInto(out *ClientCertificate) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClientCertificate.
+func (in *ClientCertificate) DeepCopy() *ClientCertificate {
+	if in == nil {
+		return nil
+	}
+	out := new(ClientCertificate)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClusterInstrumenter) DeepCopyInto(out *ClusterInstrumenter) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClusterInstrumenter.
+func (in *ClusterInstrumenter) DeepCopy() *ClusterInstrumenter {
+	if in == nil {
+		return nil
+	}
+	out := new(ClusterInstrumenter)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *ClusterInstrumenter) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClusterInstrumenterList) DeepCopyInto(out *ClusterInstrumenterList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]ClusterInstrumenter, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClusterInstrumenterList.
+func (in *ClusterInstrumenterList) DeepCopy() *ClusterInstrumenterList {
+	if in == nil {
+		return nil
+	}
+	out := new(ClusterInstrumenterList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *ClusterInstrumenterList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClusterInstrumenterSpec) DeepCopyInto(out *ClusterInstrumenterSpec) {
+	*out = *in
+	in.InstrumenterSpec.DeepCopyInto(&out.InstrumenterSpec)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClusterInstrumenterSpec.
+func (in *ClusterInstrumenterSpec) DeepCopy() *ClusterInstrumenterSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ClusterInstrumenterSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *Instrumenter) DeepCopyInto(out *Instrumenter) {
 	*out = *in
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
 	in.Spec.DeepCopyInto(&out.Spec)
-	out.Status = in.Status
+	in.Status.DeepCopyInto(&out.Status)
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Instrumenter.
@@ -93,9 +365,16 @@ func (in *InstrumenterSpec) DeepCopyInto(out *InstrumenterSpec) {
 		*out = make([]Exporter, len(*in))
 		copy(*out, *in)
 	}
-	out.Selector = in.Selector
-	out.Prometheus = in.Prometheus
-	out.OpenTelemetry = in.OpenTelemetry
+	in.Selector.DeepCopyInto(&out.Selector)
+	in.SecurityContext.DeepCopyInto(&out.SecurityContext)
+	in.ServiceName.DeepCopyInto(&out.ServiceName)
+	in.Prometheus.DeepCopyInto(&out.Prometheus)
+	in.OpenTelemetry.DeepCopyInto(&out.OpenTelemetry)
+	if in.Beyla != nil {
+		in, out := &in.Beyla, &out.Beyla
+		*out = new(BeylaConfig)
+		(*in).DeepCopyInto(*out)
+	}
 	if in.OverrideEnv != nil {
 		in, out := &in.OverrideEnv, &out.OverrideEnv
 		*out = make([]v1.EnvVar, len(*in))
@@ -118,6 +397,18 @@ func (in *InstrumenterSpec) DeepCopy() *InstrumenterSpec {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *InstrumenterStatus) DeepCopyInto(out *InstrumenterStatus) {
 	*out = *in
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]metav1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Pods != nil {
+		in, out := &in.Pods, &out.Pods
+		*out = make([]PodReference, len(*in))
+		copy(*out, *in)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new InstrumenterStatus.
@@ -130,10 +421,168 @@ func (in *InstrumenterStatus) DeepCopy() *InstrumenterStatus {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *MatchFilter) DeepCopyInto(out *MatchFilter) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new MatchFilter.
+func (in *MatchFilter) DeepCopy() *MatchFilter {
+	if in == nil {
+		return nil
+	}
+	out := new(MatchFilter)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *OTLPBatch) DeepCopyInto(out *OTLPBatch) {
+	*out = *in
+	out.ScheduleDelay = in.ScheduleDelay
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new OTLPBatch.
+func (in *OTLPBatch) DeepCopy() *OTLPBatch {
+	if in == nil {
+		return nil
+	}
+	out := new(OTLPBatch)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *OTLPHeader) DeepCopyInto(out *OTLPHeader) {
+	*out = *in
+	if in.ValueFrom != nil {
+		in, out := &in.ValueFrom, &out.ValueFrom
+		*out = new(OTLPHeaderSource)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new OTLPHeader.
+func (in *OTLPHeader) DeepCopy() *OTLPHeader {
+	if in == nil {
+		return nil
+	}
+	out := new(OTLPHeader)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *OTLPHeaderSource) DeepCopyInto(out *OTLPHeaderSource) {
+	*out = *in
+	if in.SecretKeyRef != nil {
+		in, out := &in.SecretKeyRef, &out.SecretKeyRef
+		*out = new(v1.SecretKeySelector)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new OTLPHeaderSource.
+func (in *OTLPHeaderSource) DeepCopy() *OTLPHeaderSource {
+	if in == nil {
+		return nil
+	}
+	out := new(OTLPHeaderSource)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *OTLPRetry) DeepCopyInto(out *OTLPRetry) {
+	*out = *in
+	out.InitialInterval = in.InitialInterval
+	out.MaxInterval = in.MaxInterval
+	out.MaxElapsedTime = in.MaxElapsedTime
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new OTLPRetry.
+func (in *OTLPRetry) DeepCopy() *OTLPRetry {
+	if in == nil {
+		return nil
+	}
+	out := new(OTLPRetry)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *OTLPSignal) DeepCopyInto(out *OTLPSignal) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new OTLPSignal.
+func (in *OTLPSignal) DeepCopy() *OTLPSignal {
+	if in == nil {
+		return nil
+	}
+	out := new(OTLPSignal)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *OTLPTLS) DeepCopyInto(out *OTLPTLS) {
+	*out = *in
+	if in.CA != nil {
+		in, out := &in.CA, &out.CA
+		*out = new(CABundle)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.ClientCertificate != nil {
+		in, out := &in.ClientCertificate, &out.ClientCertificate
+		*out = new(ClientCertificate)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new OTLPTLS.
+func (in *OTLPTLS) DeepCopy() *OTLPTLS {
+	if in == nil {
+		return nil
+	}
+	out := new(OTLPTLS)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *OpenTelemetry) DeepCopyInto(out *OpenTelemetry) {
 	*out = *in
+	out.Metrics = in.Metrics
+	out.Traces = in.Traces
+	if in.TLS != nil {
+		in, out := &in.TLS, &out.TLS
+		*out = new(OTLPTLS)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Headers != nil {
+		in, out := &in.Headers, &out.Headers
+		*out = make([]OTLPHeader, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.ResourceAttributes != nil {
+		in, out := &in.ResourceAttributes, &out.ResourceAttributes
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
 	out.Interval = in.Interval
+	out.ExportTimeout = in.ExportTimeout
+	if in.Sampler != nil {
+		in, out := &in.Sampler, &out.Sampler
+		*out = new(Sampler)
+		**out = **in
+	}
+	out.Batch = in.Batch
+	out.Retry = in.Retry
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new OpenTelemetry.
@@ -146,10 +595,49 @@ func (in *OpenTelemetry) DeepCopy() *OpenTelemetry {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PodMonitor) DeepCopyInto(out *PodMonitor) {
+	*out = *in
+	if in.Labels != nil {
+		in, out := &in.Labels, &out.Labels
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PodMonitor.
+func (in *PodMonitor) DeepCopy() *PodMonitor {
+	if in == nil {
+		return nil
+	}
+	out := new(PodMonitor)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PodReference) DeepCopyInto(out *PodReference) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PodReference.
+func (in *PodReference) DeepCopy() *PodReference {
+	if in == nil {
+		return nil
+	}
+	out := new(PodReference)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *Prometheus) DeepCopyInto(out *Prometheus) {
 	*out = *in
 	out.Annotations = in.Annotations
+	out.AlternativeAnnotations = in.AlternativeAnnotations
+	in.PodMonitor.DeepCopyInto(&out.PodMonitor)
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Prometheus.
@@ -177,9 +665,63 @@ func (in *PrometheusAnnotations) DeepCopy() *PrometheusAnnotations {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Sampler) DeepCopyInto(out *Sampler) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Sampler.
+func (in *Sampler) DeepCopy() *Sampler {
+	if in == nil {
+		return nil
+	}
+	out := new(Sampler)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SecurityContext) DeepCopyInto(out *SecurityContext) {
+	*out = *in
+	if in.AddCapabilities != nil {
+		in, out := &in.AddCapabilities, &out.AddCapabilities
+		*out = make([]v1.Capability, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SecurityContext.
+func (in *SecurityContext) DeepCopy() *SecurityContext {
+	if in == nil {
+		return nil
+	}
+	out := new(SecurityContext)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *Selector) DeepCopyInto(out *Selector) {
 	*out = *in
+	if in.MatchLabels != nil {
+		in, out := &in.MatchLabels, &out.MatchLabels
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.MatchExpressions != nil {
+		in, out := &in.MatchExpressions, &out.MatchExpressions
+		*out = make([]metav1.LabelSelectorRequirement, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.NamespaceSelector != nil {
+		in, out := &in.NamespaceSelector, &out.NamespaceSelector
+		*out = new(metav1.LabelSelector)
+		(*in).DeepCopyInto(*out)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Selector.
@@ -191,3 +733,38 @@ func (in *Selector) DeepCopy() *Selector {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ServiceNamePolicy) DeepCopyInto(out *ServiceNamePolicy) {
+	*out = *in
+	if in.Sources != nil {
+		in, out := &in.Sources, &out.Sources
+		*out = make([]ServiceNameSource, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ServiceNamePolicy.
+func (in *ServiceNamePolicy) DeepCopy() *ServiceNamePolicy {
+	if in == nil {
+		return nil
+	}
+	out := new(ServiceNamePolicy)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ServiceNameSource) DeepCopyInto(out *ServiceNameSource) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ServiceNameSource.
+func (in *ServiceNameSource) DeepCopy() *ServiceNameSource {
+	if in == nil {
+		return nil
+	}
+	out := new(ServiceNameSource)
+	in.DeepCopyInto(out)
+	return out
+}
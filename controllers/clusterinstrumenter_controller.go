@@ -0,0 +1,296 @@
+/*
+Copyright 2023 Grafana Labs <hello@grafana.com>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	appo11yv1alpha1 "github.com/grafana/ebpf-autoinstrument-operator/api/v1alpha1"
+	"github.com/grafana/ebpf-autoinstrument-operator/pkg/helper/lvl"
+)
+
+// ClusterInstrumenterReconciler reconciles a ClusterInstrumenter object
+type ClusterInstrumenterReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+	// Namespace where the operator is deployed, and where the autoinstrumenter DaemonSets of
+	// the ClusterInstrumenters in DaemonSet mode are created
+	Namespace string
+}
+
+//+kubebuilder:rbac:groups=appo11y.grafana.com,resources=clusterinstrumenters,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=appo11y.grafana.com,resources=clusterinstrumenters/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=appo11y.grafana.com,resources=clusterinstrumenters/finalizers,verbs=update
+//+kubebuilder:rbac:groups=apps,resources=daemonsets,verbs=create;update;delete;deletecollection
+//+kubebuilder:rbac:groups="",resources=serviceaccounts;configmaps,verbs=get;list;watch;create;update;delete;deletecollection
+//+kubebuilder:rbac:groups="",resources=services;nodes,verbs=get;list;watch
+//+kubebuilder:rbac:groups=rbac.authorization.k8s.io,resources=clusterroles;clusterrolebindings,verbs=get;list;watch;create;update;delete;deletecollection
+
+// Reconcile is part of the main kubernetes reconciliation loop which aims to
+// move the current state of the cluster closer to the desired state.
+func (r *ClusterInstrumenterReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+	logger.Info("reconcile loop", "request", req)
+
+	instr := appo11yv1alpha1.ClusterInstrumenter{}
+	if err := r.Get(ctx, req.NamespacedName, &instr); err != nil {
+		if errors.IsNotFound(err) {
+			return r.onDeletion(ctx, req)
+		}
+		return ctrl.Result{}, fmt.Errorf("reading cluster instrumenter: %w", err)
+	}
+
+	if !instr.ObjectMeta.DeletionTimestamp.IsZero() {
+		res, err := r.onDeletion(ctx, req)
+		if err != nil || res.Requeue {
+			return res, err
+		}
+		return res, removeCleanupFinalizer(ctx, r.Client, &instr)
+	}
+	if err := addCleanupFinalizer(ctx, r.Client, &instr); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	return r.onCreateUpdate(ctx, &instr)
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *ClusterInstrumenterReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		// status updates don't need to trigger a new reconciliation
+		For(&appo11yv1alpha1.ClusterInstrumenter{},
+			builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		// keeping the status up to date with the rollout of the DaemonSet mode node agent
+		Owns(&appsv1.DaemonSet{}).
+		// restoring the sidecar and node agent configuration if it is modified or removed
+		Owns(&corev1.ConfigMap{}).
+		// keeping the status up to date with the changes in the Pods
+		Watches(&source.Kind{Type: &corev1.Pod{}},
+			handler.EnqueueRequestsFromMapFunc(r.podClusterInstrumenters),
+			builder.WithPredicates(podChanged)).
+		// Namespace labels might affect the ClusterInstrumenters' NamespaceSelector
+		Watches(&source.Kind{Type: &corev1.Namespace{}},
+			handler.EnqueueRequestsFromMapFunc(r.allClusterInstrumenters),
+			builder.WithPredicates(predicate.LabelChangedPredicate{})).
+		// Namespaced Instrumenters take precedence over ClusterInstrumenters, so any change on them
+		// might require instrumenting or uninstrumenting Pods in their namespace
+		Watches(&source.Kind{Type: &appo11yv1alpha1.Instrumenter{}},
+			handler.EnqueueRequestsFromMapFunc(r.namespaceClusterInstrumenters),
+			builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		// the same applies to the ClusterInstrumenters, depending on their priority
+		Watches(&source.Kind{Type: &appo11yv1alpha1.ClusterInstrumenter{}},
+			handler.EnqueueRequestsFromMapFunc(r.allClusterInstrumenters),
+			builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		Complete(r)
+}
+
+// podClusterInstrumenters enqueues the cluster instrumenters that might select or have
+// instrumented the given Pod
+func (r *ClusterInstrumenterReconciler) podClusterInstrumenters(pod client.Object) []reconcile.Request {
+	return r.selectingClusterInstrumenters(pod.GetNamespace(), func(ci *appo11yv1alpha1.ClusterInstrumenter) bool {
+		return mightSelect(ci, pod)
+	}, func(ci *appo11yv1alpha1.ClusterInstrumenter) bool {
+		// the instrumented Pods are uninstrumented if their namespace isn't selected anymore
+		p, ok := pod.(*corev1.Pod)
+		return ok && appo11yv1alpha1.IsInstrumentedBy(ci, p)
+	})
+}
+
+// namespaceClusterInstrumenters enqueues the cluster instrumenters that select the namespace of the
+// given object
+func (r *ClusterInstrumenterReconciler) namespaceClusterInstrumenters(obj client.Object) []reconcile.Request {
+	return r.selectingClusterInstrumenters(obj.GetNamespace(), nil, nil)
+}
+
+// selectingClusterInstrumenters enqueues the cluster instrumenters accepted by the filter, if any,
+// whose NamespaceSelector selects the given namespace. The keep function accepts the instrumenters
+// that must be enqueued whatever their NamespaceSelector.
+func (r *ClusterInstrumenterReconciler) selectingClusterInstrumenters(
+	namespace string, filter, keep func(*appo11yv1alpha1.ClusterInstrumenter) bool,
+) []reconcile.Request {
+	ctx := context.Background()
+	instrumenters := appo11yv1alpha1.ClusterInstrumenterList{}
+	if err := r.List(ctx, &instrumenters); err != nil {
+		log.Log.Error(err, "can't list cluster instrumenters")
+		return nil
+	}
+	// the Namespace is only fetched if any instrumenter needs to inspect its labels
+	var ns *corev1.Namespace
+	var requests []reconcile.Request
+	for i := range instrumenters.Items {
+		ci := &instrumenters.Items[i]
+		if filter != nil && !filter(ci) {
+			continue
+		}
+		if (keep == nil || !keep(ci)) && ci.Spec.Selector.NamespaceSelector != nil {
+			if ns == nil {
+				ns = &corev1.Namespace{}
+				if err := r.Get(ctx, client.ObjectKey{Name: namespace}, ns); err != nil {
+					// the removed namespaces are handled by the Namespace watch
+					ns = nil
+					continue
+				}
+			}
+			if selected, err := ci.Spec.Selector.SelectsNamespace(ns); err != nil || !selected {
+				continue
+			}
+		}
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: ci.Name}})
+	}
+	return requests
+}
+
+// allClusterInstrumenters enqueues all the cluster instrumenters
+func (r *ClusterInstrumenterReconciler) allClusterInstrumenters(_ client.Object) []reconcile.Request {
+	instrumenters := appo11yv1alpha1.ClusterInstrumenterList{}
+	if err := r.List(context.Background(), &instrumenters); err != nil {
+		log.Log.Error(err, "can't list cluster instrumenters")
+		return nil
+	}
+	requests := make([]reconcile.Request, 0, len(instrumenters.Items))
+	for i := range instrumenters.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{
+			Name: instrumenters.Items[i].Name,
+		}})
+	}
+	return requests
+}
+
+func (r *ClusterInstrumenterReconciler) onDeletion(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := log.FromContext(ctx, "name", req.Name)
+	ctx = log.IntoContext(ctx, logger)
+	logger.Info("deleted cluster instrumenter")
+	// Look for all the pods in the cluster that are instrumented by the removed ClusterInstrumenter
+	logger.V(lvl.Debug).Info("going to remove all the pods whose " + appo11yv1alpha1.InstrumentedLabel +
+		" points to the deleted cluster instrumenter")
+	rp := newReplacer(r.Client)
+	if err := uninstrumentPods(ctx, rp, req.Name, appo11yv1alpha1.KindClusterInstrumenter, nil); err != nil {
+		return ctrl.Result{Requeue: true}, err
+	}
+	if err := cleanupNodeAgent(ctx, r.Client, req.Name, r.Namespace); err != nil {
+		return ctrl.Result{Requeue: true}, err
+	}
+
+	// the instrumenter is kept until the evicted Pods without owners are recreated
+	return ctrl.Result{Requeue: rp.blocked > 0 || rp.pending > 0}, nil
+}
+
+func (r *ClusterInstrumenterReconciler) onCreateUpdate(
+	ctx context.Context, instr *appo11yv1alpha1.ClusterInstrumenter,
+) (ctrl.Result, error) {
+	logger := log.FromContext(ctx, "name", instr.Name)
+	ctx = log.IntoContext(ctx, logger)
+	logger.V(lvl.Debug).Info("onCreateUpdate", "spec", instr.Spec)
+
+	inv := inventory{}
+	rp := newReplacer(r.Client)
+	err := r.instrument(ctx, instr, rp, &inv)
+	inv.blockedEvictions = rp.blocked
+	if serr := updateStatus(ctx, r.Client, instr, &inv, err); serr != nil {
+		if err == nil {
+			return ctrl.Result{}, serr
+		}
+		logger.Error(serr, "can't update cluster instrumenter status")
+	}
+	// evictions blocked by PodDisruptionBudgets are retried with backoff
+	return ctrl.Result{Requeue: rp.blocked > 0, RequeueAfter: inv.requeueAfter}, retryable(ctx, err)
+}
+
+// instrument the Pods selected by the ClusterInstrumenter in all the namespaces, and uninstrument
+// the Pods that aren't selected anymore
+func (r *ClusterInstrumenterReconciler) instrument(
+	ctx context.Context, instr *appo11yv1alpha1.ClusterInstrumenter, rp *replacer, inv *inventory,
+) error {
+	namespaces := corev1.NamespaceList{}
+	if err := r.List(ctx, &namespaces); err != nil {
+		return fmt.Errorf("reading namespaces: %w", err)
+	}
+
+	daemonSet := instr.Spec.Mode == appo11yv1alpha1.ModeDaemonSet
+	if daemonSet && r.Namespace == "" {
+		return invalidSpecError{err: errNoOperatorNamespace}
+	}
+	// the instrumenters that might take precedence are listed once for all the namespaces
+	comp, err := listCompetitors(ctx, r.Client, instr, "")
+	if err != nil {
+		return err
+	}
+	disc := newDiscovery()
+	for i := range namespaces.Items {
+		if err := r.instrumentNamespace(ctx, instr, &namespaces.Items[i], comp, rp, disc, inv); err != nil {
+			return err
+		}
+	}
+	if daemonSet {
+		return reconcileNodeAgent(ctx, r.Client, r.Scheme, instr, r.Namespace, disc, inv)
+	}
+	// removing the node agent in case the instrumenter was previously in DaemonSet mode
+	return cleanupNodeAgent(ctx, r.Client, instr.Name, r.Namespace)
+}
+
+// instrumentNamespace instruments the Pods selected by the ClusterInstrumenter in the given namespace,
+// and uninstruments the Pods that aren't selected anymore. In DaemonSet mode, the selected Pods
+// are added to the provided discovery.
+func (r *ClusterInstrumenterReconciler) instrumentNamespace(
+	ctx context.Context, instr *appo11yv1alpha1.ClusterInstrumenter, ns *corev1.Namespace,
+	comp *competitors, rp *replacer, disc *discovery, inv *inventory,
+) error {
+	nsSelected, err := instr.Spec.Selector.SelectsNamespace(ns)
+	if err != nil {
+		return invalidSpecError{err: err}
+	}
+	// the Pods of the excluded namespaces are uninstrumented, as the Pod webhook doesn't intercept them
+	nsSelected = nsSelected && !isExcludedNamespace(ns.Name, r.Namespace)
+	// the sidecar configuration must exist before any Pod is instrumented
+	if err := reconcileSidecarConfig(ctx, r.Client, r.Scheme, instr, ns.Name, nsSelected); err != nil {
+		return err
+	}
+	// the precedence is only needed to uninstrument the Pods of the selected namespaces
+	var prec *precedence
+	if nsSelected {
+		prec = comp.precedence(instr, ns)
+	}
+	daemonSet := instr.Spec.Mode == appo11yv1alpha1.ModeDaemonSet
+	// in DaemonSet mode, the instrumenter sidecars are removed from all the Pods
+	if err := uninstrumentUnselected(ctx, rp, instr, ns.Name, nsSelected && !daemonSet, prec); err != nil {
+		return err
+	}
+	if !nsSelected {
+		log.FromContext(ctx).V(lvl.Debug).Info("namespace is not selected. Skipping instrumentation",
+			"namespace", ns.Name)
+		return nil
+	}
+	if daemonSet {
+		return discoverPods(ctx, r.Client, instr, ns.Name, prec.skip(inv), disc)
+	}
+	return instrumentPods(ctx, rp, instr, ns.Name, prec.skip(inv), inv)
+}
@@ -0,0 +1,351 @@
+/*
+Copyright 2023 Grafana Labs <hello@grafana.com>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"sort"
+	"strconv"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/yaml"
+
+	appo11yv1alpha1 "github.com/grafana/ebpf-autoinstrument-operator/api/v1alpha1"
+	"github.com/grafana/ebpf-autoinstrument-operator/pkg/beyla"
+	"github.com/grafana/ebpf-autoinstrument-operator/pkg/helper/lvl"
+	"github.com/grafana/ebpf-autoinstrument-operator/pkg/owner"
+)
+
+// Node-level instrumentation logic for the ClusterInstrumenters in DaemonSet mode. The operator creates,
+// for each ClusterInstrumenter, an autoinstrumenter DaemonSet with its ServiceAccount and RBAC
+// permissions, as well as a ConfigMap that tells the autoinstrumenter which Pods to instrument.
+
+// labels and annotations of the resources created for the instrumenters in DaemonSet mode
+const (
+	managedByLabel        = "app.kubernetes.io/managed-by"
+	managedByOperator     = "ebpf-autoinstrument-operator"
+	instrumenterNameLabel = "appo11y.grafana.com/instrumenter"
+	instrumenterKindLabel = "appo11y.grafana.com/instrumenter-kind"
+	instrumenterNsLabel   = "appo11y.grafana.com/instrumenter-namespace"
+
+	// nodeAgentHashAnnotation stores the hash of the desired DaemonSet Pod template, to avoid
+	// updating the DaemonSet if it didn't change
+	nodeAgentHashAnnotation = "grafana.com/node-agent-hash"
+	// nodeAgentConfigHashAnnotation forces a rollout of the DaemonSet when its configuration changes
+	nodeAgentConfigHashAnnotation = "grafana.com/node-agent-config-hash"
+
+	nodeAgentConfigVolume = "config"
+)
+
+// errNoOperatorNamespace is returned when a ClusterInstrumenter in DaemonSet mode can't be
+// reconciled because the namespace of the operator is unknown
+var errNoOperatorNamespace = errors.New("DaemonSet mode requires the operator namespace, " +
+	"provided in the POD_NAMESPACE environment variable")
+
+// permissions required by the autoinstrumenter to decorate the instrumented services with
+// Kubernetes metadata
+var nodeAgentRules = []rbacv1.PolicyRule{{
+	APIGroups: []string{""},
+	Resources: []string{"pods", "services", "nodes"},
+	Verbs:     []string{"get", "list", "watch"},
+}, {
+	APIGroups: []string{"apps"},
+	Resources: []string{"replicasets"},
+	Verbs:     []string{"get", "list", "watch"},
+}}
+
+// discovery accumulates the Pods to be instrumented by an instrumenter in DaemonSet mode,
+// grouped by the workload that owns them
+type discovery struct {
+	pods     []*corev1.Pod
+	services map[discoveryKey]string
+}
+
+type discoveryKey struct {
+	namespace string
+	owner     string
+	// only for ownerless Pods
+	pod  string
+	port string
+}
+
+func newDiscovery() *discovery {
+	return &discovery{services: map[discoveryKey]string{}}
+}
+
+// discoverPods adds to the discovery the Pods from the given namespace that are selected by the
+// instrumenter. The skip function allows excluding the Pods that should be instrumented by other
+// instrumenters with higher precedence.
+func discoverPods(
+	ctx context.Context, c client.Reader, iq appo11yv1alpha1.InstrumenterObject,
+	namespace string, skip func(*corev1.Pod) bool, disc *discovery,
+) error {
+	pods, err := selectedPods(ctx, c, iq, namespace, skip)
+	if err != nil {
+		return err
+	}
+	spec := iq.GetSpec()
+	for _, pod := range pods {
+		if name, _ := appo11yv1alpha1.InstrumentedBy(pod); name != "" && !appo11yv1alpha1.IsInstrumentedBy(iq, pod) {
+			log.FromContext(ctx).V(lvl.Debug).Info("Pod is instrumented by another instrumenter sidecar. Skipping",
+				"podName", pod.Name, "podNamespace", pod.Namespace)
+			continue
+		}
+		owners, err := owner.Resolve(ctx, c, pod)
+		if err != nil {
+			return fmt.Errorf("resolving owners of Pod %s/%s: %w", pod.Namespace, pod.Name, err)
+		}
+		key := discoveryKey{namespace: pod.Namespace, port: pod.Labels[spec.Selector.PortLabel]}
+		if top, ok := owners.Top(); ok {
+			key.owner = top.Name
+		} else {
+			key.pod = pod.Name
+		}
+		if _, ok := disc.services[key]; !ok {
+			disc.services[key] = spec.ServiceName.ServiceName(pod, owners)
+		}
+		disc.pods = append(disc.pods, pod)
+	}
+	return nil
+}
+
+// config returns the autoinstrumenter configuration file that discovers the accumulated Pods,
+// on top of the typed configuration of the instrumenter
+func (d *discovery) config(spec *appo11yv1alpha1.InstrumenterSpec) ([]byte, error) {
+	cfg := appo11yv1alpha1.BeylaConfigFor(spec)
+	if cfg.Attributes == nil {
+		cfg.Attributes = &beyla.Attributes{}
+	}
+	cfg.Attributes.Kubernetes = &beyla.Kubernetes{Enable: true}
+	if cfg.Discovery == nil {
+		cfg.Discovery = &beyla.Discovery{}
+	}
+	for key, name := range d.services {
+		svc := beyla.Service{
+			Name:         name,
+			Namespace:    key.namespace,
+			OpenPorts:    key.port,
+			K8sNamespace: exactly(key.namespace),
+		}
+		if key.owner != "" {
+			svc.K8sOwnerName = exactly(key.owner)
+		} else {
+			svc.K8sPodName = exactly(key.pod)
+		}
+		cfg.Discovery.Services = append(cfg.Discovery.Services, svc)
+	}
+	// providing a stable configuration, to avoid unneeded DaemonSet rollouts
+	sort.Slice(cfg.Discovery.Services, func(i, j int) bool {
+		si, sj := &cfg.Discovery.Services[i], &cfg.Discovery.Services[j]
+		if si.K8sNamespace != sj.K8sNamespace {
+			return si.K8sNamespace < sj.K8sNamespace
+		}
+		if si.K8sOwnerName+si.K8sPodName != sj.K8sOwnerName+sj.K8sPodName {
+			return si.K8sOwnerName+si.K8sPodName < sj.K8sOwnerName+sj.K8sPodName
+		}
+		return si.OpenPorts < sj.OpenPorts
+	})
+	return yaml.Marshal(cfg)
+}
+
+// exactly returns a regular expression that only matches the provided string
+func exactly(s string) string {
+	return "^" + regexp.QuoteMeta(s) + "$"
+}
+
+// nodeAgentLabels returns the labels that identify the resources created for the given instrumenter
+func nodeAgentLabels(name, kind, namespace string) map[string]string {
+	return map[string]string{
+		managedByLabel:        managedByOperator,
+		instrumenterNameLabel: name,
+		instrumenterKindLabel: kind,
+		instrumenterNsLabel:   namespace,
+	}
+}
+
+// nodeAgentName returns the name of the resources created for the given instrumenter. The hash
+// suffix avoids collisions with the resources of other instrumenters or created by the users.
+func nodeAgentName(iq appo11yv1alpha1.InstrumenterObject) string {
+	return "beyla-" + iq.GetName() + "-" + hash([]string{iq.InstrumenterKind(), iq.GetNamespace(), iq.GetName()})
+}
+
+// reconcileNodeAgent creates or updates, in the given namespace, the autoinstrumenter DaemonSet of a
+// ClusterInstrumenter and the resources it requires, recording the discovered Pods in the inventory
+func reconcileNodeAgent(
+	ctx context.Context, c client.Client, scheme *runtime.Scheme, iq *appo11yv1alpha1.ClusterInstrumenter,
+	namespace string, disc *discovery, inv *inventory,
+) error {
+	name := nodeAgentName(iq)
+	clusterName := name
+	labels := nodeAgentLabels(iq.GetName(), iq.InstrumenterKind(), iq.GetNamespace())
+	meta := func(obj client.Object) error {
+		obj.SetLabels(labels)
+		return controllerutil.SetControllerReference(iq, obj, scheme)
+	}
+
+	// the ClusterRole is created first, as it is used to check whether the instrumenter has node agent
+	// resources that need to be removed
+	clusterRole := &rbacv1.ClusterRole{ObjectMeta: metav1.ObjectMeta{Name: clusterName}}
+	if _, err := controllerutil.CreateOrUpdate(ctx, c, clusterRole, func() error {
+		clusterRole.Rules = nodeAgentRules
+		return meta(clusterRole)
+	}); err != nil {
+		return fmt.Errorf("reconciling ClusterRole %s: %w", clusterName, err)
+	}
+	sa := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace}}
+	if _, err := controllerutil.CreateOrUpdate(ctx, c, sa, func() error {
+		return meta(sa)
+	}); err != nil {
+		return fmt.Errorf("reconciling ServiceAccount %s/%s: %w", namespace, name, err)
+	}
+	binding := &rbacv1.ClusterRoleBinding{ObjectMeta: metav1.ObjectMeta{Name: clusterName}}
+	if _, err := controllerutil.CreateOrUpdate(ctx, c, binding, func() error {
+		binding.RoleRef = rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: clusterName}
+		binding.Subjects = []rbacv1.Subject{{Kind: rbacv1.ServiceAccountKind, Name: name, Namespace: namespace}}
+		return meta(binding)
+	}); err != nil {
+		return fmt.Errorf("reconciling ClusterRoleBinding %s: %w", clusterName, err)
+	}
+
+	config, err := disc.config(iq.GetSpec())
+	if err != nil {
+		return fmt.Errorf("generating node agent configuration: %w", err)
+	}
+	configMap := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace}}
+	if _, err := controllerutil.CreateOrUpdate(ctx, c, configMap, func() error {
+		configMap.Data = map[string]string{appo11yv1alpha1.BeylaConfigFile: string(config)}
+		return meta(configMap)
+	}); err != nil {
+		return fmt.Errorf("reconciling ConfigMap %s/%s: %w", namespace, name, err)
+	}
+
+	ds := &appsv1.DaemonSet{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace}}
+	if _, err := controllerutil.CreateOrUpdate(ctx, c, ds, func() error {
+		setDaemonSetSpec(iq, ds, labels, hash(config))
+		return meta(ds)
+	}); err != nil {
+		return fmt.Errorf("reconciling DaemonSet %s/%s: %w", namespace, name, err)
+	}
+
+	for _, pod := range disc.pods {
+		if rolledOut(ds) {
+			inv.add(pod, appo11yv1alpha1.PodInstrumented, "")
+		} else {
+			inv.add(pod, appo11yv1alpha1.PodPending, "waiting for the rollout of DaemonSet "+name)
+		}
+	}
+	return nil
+}
+
+// setDaemonSetSpec updates the specification of the provided DaemonSet, unless it is up to date
+func setDaemonSetSpec(
+	iq appo11yv1alpha1.InstrumenterObject, ds *appsv1.DaemonSet, labels map[string]string, configHash string,
+) {
+	if ds.CreationTimestamp.IsZero() {
+		// the selector is immutable
+		ds.Spec.Selector = &metav1.LabelSelector{MatchLabels: labels}
+	}
+	agent, annotations := appo11yv1alpha1.BuildNodeAgent(iq)
+	agent.VolumeMounts = append(agent.VolumeMounts, corev1.VolumeMount{
+		Name: nodeAgentConfigVolume, MountPath: appo11yv1alpha1.BeylaConfigDir, ReadOnly: true,
+	})
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[nodeAgentConfigHashAnnotation] = configHash
+	template := corev1.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{Labels: labels, Annotations: annotations},
+		Spec: corev1.PodSpec{
+			ServiceAccountName: ds.Name,
+			// the autoinstrumenter needs to access the processes of the Pods running in the node
+			HostPID:    true,
+			Containers: []corev1.Container{*agent},
+			Volumes: append([]corev1.Volume{{
+				Name: nodeAgentConfigVolume,
+				VolumeSource: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{
+					LocalObjectReference: corev1.LocalObjectReference{Name: ds.Name},
+				}},
+			}}, appo11yv1alpha1.ExporterVolumes(iq.GetSpec())...),
+		},
+	}
+	// comparing the hash of the template, as the API server sets default values to the stored one
+	templateHash := hash(&template)
+	if ds.Annotations[nodeAgentHashAnnotation] == templateHash {
+		return
+	}
+	if ds.Annotations == nil {
+		ds.Annotations = map[string]string{}
+	}
+	ds.Annotations[nodeAgentHashAnnotation] = templateHash
+	ds.Spec.Template = template
+}
+
+// rolledOut returns whether all the DaemonSet Pods are available and up to date
+func rolledOut(ds *appsv1.DaemonSet) bool {
+	return ds.Status.DesiredNumberScheduled > 0 &&
+		ds.Status.ObservedGeneration >= ds.Generation &&
+		ds.Status.UpdatedNumberScheduled == ds.Status.DesiredNumberScheduled &&
+		ds.Status.NumberAvailable == ds.Status.DesiredNumberScheduled
+}
+
+// cleanupNodeAgent removes the resources that were created for the ClusterInstrumenter with the given
+// name, if it was in DaemonSet mode. The namespaced resources are looked for in the agentNamespace.
+func cleanupNodeAgent(ctx context.Context, c client.Client, name, agentNamespace string) error {
+	selector := client.MatchingLabels(nodeAgentLabels(name, appo11yv1alpha1.KindClusterInstrumenter, ""))
+	clusterRoles := rbacv1.ClusterRoleList{}
+	if err := c.List(ctx, &clusterRoles, selector); err != nil {
+		return fmt.Errorf("reading ClusterRoles: %w", err)
+	}
+	if len(clusterRoles.Items) == 0 {
+		return nil
+	}
+	log.FromContext(ctx).V(lvl.Debug).Info("removing node agent resources")
+	if agentNamespace != "" {
+		for _, obj := range []client.Object{&appsv1.DaemonSet{}, &corev1.ConfigMap{}, &corev1.ServiceAccount{}} {
+			if err := c.DeleteAllOf(ctx, obj, selector, client.InNamespace(agentNamespace)); err != nil {
+				return fmt.Errorf("removing node agent %T: %w", obj, err)
+			}
+		}
+	}
+	for _, obj := range []client.Object{&rbacv1.ClusterRoleBinding{}, &rbacv1.ClusterRole{}} {
+		if err := c.DeleteAllOf(ctx, obj, selector); err != nil {
+			return fmt.Errorf("removing node agent %T: %w", obj, err)
+		}
+	}
+	return nil
+}
+
+// hash returns a short, deterministic hash of the provided value
+func hash(v any) string {
+	h := fnv.New64a()
+	// marshalling the node agent resources can't fail, as they only contain serializable fields
+	spec, _ := json.Marshal(v)
+	_, _ = h.Write(spec)
+	return strconv.FormatUint(h.Sum64(), 36)
+}
@@ -0,0 +1,133 @@
+/*
+Copyright 2023 Grafana Labs <hello@grafana.com>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	appo11yv1alpha1 "github.com/grafana/ebpf-autoinstrument-operator/api/v1alpha1"
+	"github.com/grafana/ebpf-autoinstrument-operator/pkg/helper"
+)
+
+var _ = Describe("Node agent", Ordered, func() {
+	const ns = "node-agent"
+	BeforeAll(func() {
+		createNamespace(ns)
+	})
+
+	It("should discover the selected Pods grouped by workload", func() {
+		instr := &appo11yv1alpha1.ClusterInstrumenter{Spec: appo11yv1alpha1.ClusterInstrumenterSpec{
+			Mode: appo11yv1alpha1.ModeDaemonSet,
+			InstrumenterSpec: appo11yv1alpha1.InstrumenterSpec{
+				Selector: appo11yv1alpha1.Selector{PortLabel: "node-agent-instrument-port"},
+			},
+		}}
+		labels := map[string]string{"node-agent-instrument-port": "8080"}
+		backend1 := newTestPod(ns, "backend-0", labels)
+		backend2 := newTestPod(ns, "backend-1", labels)
+		standalone := newTestPod(ns, "standalone", labels)
+		backend1.OwnerReferences = []metav1.OwnerReference{{
+			APIVersion: "apps/v1", Kind: "StatefulSet", Name: "backend", UID: "1234", Controller: helper.Ptr(true),
+		}}
+		backend2.OwnerReferences = backend1.OwnerReferences
+		for _, pod := range []*corev1.Pod{backend1, backend2, standalone} {
+			Expect(k8sClient.Create(ctx, pod)).To(Succeed())
+		}
+
+		disc := newDiscovery()
+		Expect(discoverPods(ctx, k8sClient, instr, ns, nil, disc)).To(Succeed())
+		Expect(disc.pods).To(HaveLen(3))
+		config, err := disc.config(instr.GetSpec())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(config)).To(Equal(`attributes:
+  kubernetes:
+    enable: true
+discovery:
+  services:
+  - k8s_namespace: ^node-agent$
+    k8s_owner_name: ^backend$
+    name: backend
+    namespace: node-agent
+    open_ports: "8080"
+  - k8s_namespace: ^node-agent$
+    k8s_pod_name: ^standalone$
+    name: standalone
+    namespace: node-agent
+    open_ports: "8080"
+`))
+	})
+
+	It("should deploy the node agent of the ClusterInstrumenter, and remove it on deletion", func() {
+		instr := &appo11yv1alpha1.ClusterInstrumenter{
+			ObjectMeta: metav1.ObjectMeta{Name: "node-agent"},
+			Spec: appo11yv1alpha1.ClusterInstrumenterSpec{
+				Mode: appo11yv1alpha1.ModeDaemonSet,
+				InstrumenterSpec: appo11yv1alpha1.InstrumenterSpec{
+					Image:    "grafana/beyla:latest",
+					Selector: appo11yv1alpha1.Selector{PortLabel: "node-agent-instrument-port"},
+				},
+			},
+		}
+		Expect(k8sClient.Create(ctx, instr)).To(Succeed())
+		name := nodeAgentName(instr)
+		Expect(name).To(HavePrefix("beyla-node-agent-"))
+		ds := appsv1.DaemonSet{}
+		Eventually(func() error {
+			return k8sClient.Get(ctx, client.ObjectKey{Namespace: operatorNS, Name: name}, &ds)
+		}, timeout, interval).Should(Succeed())
+		Expect(ds.OwnerReferences).To(HaveLen(1))
+		Expect(ds.OwnerReferences[0].UID).To(Equal(instr.UID))
+		podSpec := &ds.Spec.Template.Spec
+		Expect(podSpec.HostPID).To(BeTrue())
+		Expect(podSpec.ServiceAccountName).To(Equal(name))
+		Expect(podSpec.Containers[0].Image).To(Equal("grafana/beyla:latest"))
+		cm := corev1.ConfigMap{}
+		Expect(k8sClient.Get(ctx, client.ObjectKey{Namespace: operatorNS, Name: name}, &cm)).To(Succeed())
+		Expect(cm.Data[appo11yv1alpha1.BeylaConfigFile]).To(ContainSubstring("k8s_owner_name: ^backend$"))
+		binding := rbacv1.ClusterRoleBinding{}
+		Expect(k8sClient.Get(ctx, client.ObjectKey{Name: name}, &binding)).To(Succeed())
+		Expect(binding.Subjects[0].Name).To(Equal(name))
+		Expect(binding.Subjects[0].Namespace).To(Equal(operatorNS))
+		Expect(binding.OwnerReferences).To(HaveLen(1))
+		Expect(binding.OwnerReferences[0].UID).To(Equal(instr.UID))
+
+		By("reporting the discovered Pods as pending until the DaemonSet rolls out")
+		Eventually(func() (int32, error) {
+			err := k8sClient.Get(ctx, client.ObjectKeyFromObject(instr), instr)
+			return instr.Status.PendingPods, err
+		}, timeout, interval).Should(BeEquivalentTo(3))
+
+		By("distinguishing the resources of instrumenters with the same name but different kind")
+		other := &appo11yv1alpha1.Instrumenter{ObjectMeta: metav1.ObjectMeta{Name: "node-agent", Namespace: ns}}
+		Expect(nodeAgentName(other)).ToNot(Equal(name))
+
+		By("removing the node agent resources with the ClusterInstrumenter")
+		Expect(k8sClient.Delete(ctx, instr)).To(Succeed())
+		expectNotFound(instr)
+		roles := rbacv1.ClusterRoleList{}
+		Expect(k8sClient.List(ctx, &roles, client.MatchingLabels(
+			nodeAgentLabels(instr.Name, appo11yv1alpha1.KindClusterInstrumenter, "")))).To(Succeed())
+		Expect(roles.Items).To(BeEmpty())
+		expectNotFound(&ds)
+	})
+})
@@ -23,9 +23,15 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	appo11yv1alpha1 "github.com/grafana/ebpf-autoinstrument-operator/api/v1alpha1"
 	"github.com/grafana/ebpf-autoinstrument-operator/pkg/helper/lvl"
@@ -35,12 +41,21 @@ import (
 type InstrumenterReconciler struct {
 	client.Client
 	Scheme *runtime.Scheme
+	// Namespace where the operator is deployed. Its Pods are never instrumented.
+	Namespace string
 }
 
 //+kubebuilder:rbac:groups=appo11y.grafana.com,resources=instrumenters,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=appo11y.grafana.com,resources=instrumenters/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=appo11y.grafana.com,resources=instrumenters/finalizers,verbs=update
-//+kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch;update;delete
+//+kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch;create;update;delete
+//+kubebuilder:rbac:groups="",resources=pods/eviction,verbs=create
+//+kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list;watch
+//+kubebuilder:rbac:groups=apps,resources=replicasets,verbs=get;list;watch
+//+kubebuilder:rbac:groups=apps,resources=deployments;statefulsets;daemonsets,verbs=get;list;watch;patch
+//+kubebuilder:rbac:groups=batch,resources=jobs;cronjobs,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch;create;update;delete
+//+kubebuilder:rbac:groups=monitoring.coreos.com,resources=podmonitors,verbs=get;list;watch;create;update;delete
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -57,7 +72,14 @@ func (r *InstrumenterReconciler) Reconcile(ctx context.Context, req ctrl.Request
 	}
 
 	if !instr.ObjectMeta.DeletionTimestamp.IsZero() {
-		return r.onDeletion(ctx, req)
+		res, err := r.onDeletion(ctx, req)
+		if err != nil || res.Requeue {
+			return res, err
+		}
+		return res, removeCleanupFinalizer(ctx, r.Client, &instr)
+	}
+	if err := addCleanupFinalizer(ctx, r.Client, &instr); err != nil {
+		return ctrl.Result{}, err
 	}
 
 	return r.onCreateUpdate(ctx, &instr)
@@ -66,95 +88,146 @@ func (r *InstrumenterReconciler) Reconcile(ctx context.Context, req ctrl.Request
 // SetupWithManager sets up the controller with the Manager.
 func (r *InstrumenterReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
-		For(&appo11yv1alpha1.Instrumenter{}).
-		Owns(&corev1.Pod{}).
+		// status updates don't need to trigger a new reconciliation
+		For(&appo11yv1alpha1.Instrumenter{},
+			builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		// restoring the sidecar configuration if it is modified or removed
+		Owns(&corev1.ConfigMap{}).
+		// keeping the status up to date with the changes in the Pods
+		Watches(&source.Kind{Type: &corev1.Pod{}},
+			handler.EnqueueRequestsFromMapFunc(r.podInstrumenters),
+			builder.WithPredicates(podChanged)).
+		// Namespace labels might affect the Instrumenters' NamespaceSelector
+		Watches(&source.Kind{Type: &corev1.Namespace{}},
+			handler.EnqueueRequestsFromMapFunc(r.instrumentersInNamespace),
+			builder.WithPredicates(predicate.LabelChangedPredicate{})).
+		// Instrumenters with higher priority might take over the Pods of the others in their namespace
+		Watches(&source.Kind{Type: &appo11yv1alpha1.Instrumenter{}},
+			handler.EnqueueRequestsFromMapFunc(r.siblingInstrumenters),
+			builder.WithPredicates(predicate.GenerationChangedPredicate{})).
 		Complete(r)
 }
 
+// instrumentersInNamespace enqueues all the instrumenters from a given namespace
+func (r *InstrumenterReconciler) instrumentersInNamespace(ns client.Object) []reconcile.Request {
+	return r.enqueueNamespace(ns.GetName())
+}
+
+// siblingInstrumenters enqueues all the instrumenters from the namespace of the given instrumenter
+func (r *InstrumenterReconciler) siblingInstrumenters(instr client.Object) []reconcile.Request {
+	return r.enqueueNamespace(instr.GetNamespace())
+}
+
+func (r *InstrumenterReconciler) enqueueNamespace(namespace string) []reconcile.Request {
+	instrumenters := appo11yv1alpha1.InstrumenterList{}
+	if err := r.List(context.Background(), &instrumenters, client.InNamespace(namespace)); err != nil {
+		log.Log.Error(err, "can't list instrumenters in namespace", "namespace", namespace)
+		return nil
+	}
+	requests := make([]reconcile.Request, 0, len(instrumenters.Items))
+	for i := range instrumenters.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{
+			Name:      instrumenters.Items[i].Name,
+			Namespace: instrumenters.Items[i].Namespace,
+		}})
+	}
+	return requests
+}
+
+// podInstrumenters enqueues the instrumenters from the Pod namespace that might select or have
+// instrumented the given Pod
+func (r *InstrumenterReconciler) podInstrumenters(pod client.Object) []reconcile.Request {
+	instrumenters := appo11yv1alpha1.InstrumenterList{}
+	if err := r.List(context.Background(), &instrumenters, client.InNamespace(pod.GetNamespace())); err != nil {
+		log.Log.Error(err, "can't list instrumenters in namespace", "namespace", pod.GetNamespace())
+		return nil
+	}
+	var requests []reconcile.Request
+	for i := range instrumenters.Items {
+		if mightSelect(&instrumenters.Items[i], pod) {
+			requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{
+				Name:      instrumenters.Items[i].Name,
+				Namespace: instrumenters.Items[i].Namespace,
+			}})
+		}
+	}
+	return requests
+}
+
 func (r *InstrumenterReconciler) onDeletion(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	logger := log.FromContext(ctx, "name", req.Name, "namespace", req.Namespace)
+	ctx = log.IntoContext(ctx, logger)
 	logger.Info("deleted instrumenter")
-	dbg := logger.V(lvl.Debug)
 	// Look for all the pods in the NS that are instrumented by the removed Instrumenter
-	podList := corev1.PodList{}
-	if err := r.List(ctx, &podList,
-		client.InNamespace(req.Namespace),
-		client.HasLabels{appo11yv1alpha1.InstrumentedLabel}); err != nil {
-		return ctrl.Result{Requeue: true}, fmt.Errorf("reading pods: %w", err)
-	}
-	dbg.Info("going to remove all the pods whose "+appo11yv1alpha1.InstrumentedLabel+" points to the deleted instrumenter",
-		"candidatePods", len(podList.Items))
-	for i := range podList.Items {
-		p := &podList.Items[i]
-		if instrumenterName := p.Labels[appo11yv1alpha1.InstrumentedLabel]; instrumenterName == req.Name {
-			dbg := dbg.WithValues("podName", p.Name, "podNamespace", p.Namespace)
-			dbg.Info("removing Pod")
-			if err := r.Delete(ctx, p); err != nil {
-				return ctrl.Result{Requeue: true}, fmt.Errorf("deleting pod: %w", err)
-			}
-			// Pods belonging to a Service or ReplicaSet will be recreated automatically. Simple Pods
-			// need to be explicitly recreated
-			if len(p.OwnerReferences) == 0 {
-				dbg.Info("Recreating pod")
-				// Pods belonging to a Service or ReplicaSet will be recreated automatically. Simple Pods
-				// need to be created again
-				if len(p.OwnerReferences) == 0 {
-					dbg.Info("Recreating pod")
-					appo11yv1alpha1.RemoveInstrumenter(p)
-					p.ResourceVersion = ""
-					p.UID = ""
-					p.Status = corev1.PodStatus{}
-					if err := r.Create(ctx, p); err != nil {
-						return ctrl.Result{}, fmt.Errorf("can't recreate Pod %s/%s: %w", p.Namespace, p.Name, err)
-					}
-				}
-			}
-		} else {
-			dbg.Info("this Pod is instumented by another instrumenter. Skipping",
-				"instrumentedBy", instrumenterName, "podName", p.Name, "podNamespace", p.Namespace)
-		}
+	logger.V(lvl.Debug).Info("going to remove all the pods whose " + appo11yv1alpha1.InstrumentedLabel +
+		" points to the deleted instrumenter")
+	rp := newReplacer(r.Client)
+	if err := uninstrumentPods(ctx, rp, req.Name, appo11yv1alpha1.KindInstrumenter,
+		nil, client.InNamespace(req.Namespace)); err != nil {
+		return ctrl.Result{Requeue: true}, err
 	}
 
-	return ctrl.Result{}, nil
+	// the instrumenter is kept until the evicted Pods without owners are recreated
+	return ctrl.Result{Requeue: rp.blocked > 0 || rp.pending > 0}, nil
 }
 
 func (r *InstrumenterReconciler) onCreateUpdate(ctx context.Context, instr *appo11yv1alpha1.Instrumenter) (ctrl.Result, error) {
 	logger := log.FromContext(ctx, "name", instr.Name, "namespace", instr.Namespace)
-	dbg := logger.V(lvl.Debug)
-	dbg.Info("onCreateUpdate", "spec", instr.Spec)
-
-	podList := corev1.PodList{}
-	if err := r.List(ctx, &podList,
-		client.InNamespace(instr.Namespace),
-		client.HasLabels{instr.Spec.Selector.PortLabel}); err != nil {
-		return ctrl.Result{}, fmt.Errorf("reading pods: %w", err)
-	}
-
-	dbg.Info("list of pods to instrument", "len", len(podList.Items))
-
-	for i := range podList.Items {
-		pod := &podList.Items[i]
-		podLog := dbg.WithValues("podName", pod.Name, "podNamespace", pod.Namespace)
-		podLog.Info("checking if Pod needs to be instrumented")
-		if sidec, ok := appo11yv1alpha1.NeedsInstrumentation(instr, pod); ok {
-			podLog.Info("Destroying Pod to recreate it with an instrumenter sidecar")
-			if err := r.Delete(ctx, pod); err != nil {
-				return ctrl.Result{}, fmt.Errorf("deleting Pod %s/%s: %w", pod.Namespace, pod.Name, err)
-			}
-			// Pods belonging to a Service or ReplicaSet will be recreated automatically. Simple Pods
-			// need to be explicitly recreated
-			if len(pod.OwnerReferences) == 0 {
-				podLog.Info("Recreating pod")
-				pod.ResourceVersion = ""
-				pod.UID = ""
-				pod.Status = corev1.PodStatus{}
-				appo11yv1alpha1.AddInstrumenter(instr.Name, sidec, pod)
-				if err := r.Create(ctx, pod); err != nil {
-					return ctrl.Result{}, fmt.Errorf("can't recreate Pod %s/%s: %w", pod.Namespace, pod.Name, err)
-				}
-			}
+	ctx = log.IntoContext(ctx, logger)
+	logger.V(lvl.Debug).Info("onCreateUpdate", "spec", instr.Spec)
+
+	inv := inventory{}
+	rp := newReplacer(r.Client)
+	err := r.instrument(ctx, instr, rp, &inv)
+	inv.blockedEvictions = rp.blocked
+	if serr := updateStatus(ctx, r.Client, instr, &inv, err); serr != nil {
+		if err == nil {
+			return ctrl.Result{}, serr
 		}
+		logger.Error(serr, "can't update instrumenter status")
+	}
+	// evictions blocked by PodDisruptionBudgets are retried with backoff
+	return ctrl.Result{Requeue: rp.blocked > 0, RequeueAfter: inv.requeueAfter}, retryable(ctx, err)
+}
+
+// instrument the Pods selected by the Instrumenter, and uninstrument the Pods that aren't selected anymore
+func (r *InstrumenterReconciler) instrument(
+	ctx context.Context, instr *appo11yv1alpha1.Instrumenter, rp *replacer, inv *inventory,
+) error {
+	ns := corev1.Namespace{}
+	if err := r.Get(ctx, client.ObjectKey{Name: instr.Namespace}, &ns); err != nil {
+		return fmt.Errorf("reading namespace: %w", err)
+	}
+	nsSelected, err := instr.Spec.Selector.SelectsNamespace(&ns)
+	if err != nil {
+		return invalidSpecError{err: err}
+	}
+	// the Instrumenter is reported as failed once the sidecars are removed from its namespace
+	excluded := isExcludedNamespace(instr.Namespace, r.Namespace)
+	nsSelected = nsSelected && !excluded
+	if err := reconcilePodMonitor(ctx, r.Client, r.Scheme, instr); err != nil {
+		return err
+	}
+	// the sidecar configuration must exist before any Pod is instrumented
+	if err := reconcileSidecarConfig(ctx, r.Client, r.Scheme, instr, instr.Namespace, nsSelected); err != nil {
+		return err
+	}
+
+	prec, err := precedingInstrumenters(ctx, r.Client, instr, &ns)
+	if err != nil {
+		return err
+	}
+
+	if err := uninstrumentUnselected(ctx, rp, instr, instr.Namespace, nsSelected, prec); err != nil {
+		return err
+	}
+	if excluded {
+		return invalidSpecError{err: errExcludedNamespace}
+	}
+	if !nsSelected {
+		log.FromContext(ctx).V(lvl.Debug).Info("namespace is not selected. Skipping instrumentation")
+		return nil
 	}
 
-	return ctrl.Result{}, nil
+	return instrumentPods(ctx, rp, instr, instr.Namespace, prec.skip(inv), inv)
 }
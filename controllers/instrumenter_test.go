@@ -9,6 +9,7 @@ import (
 	"github.com/grafana/ebpf-autoinstrument-operator/pkg/helper"
 	"github.com/mariomac/gostream/stream"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	"k8s.io/apimachinery/pkg/types"
@@ -73,6 +74,23 @@ var _ = Describe("Instrumenter Controller", Ordered, Serial, func() {
 				return assertPod(&pod)
 			}, timeout, interval).Should(Succeed())
 		})
+		It("should report the instrumented Pod in the Instrumenter status", func() {
+			Eventually(func() error {
+				instr := v1alpha1.Instrumenter{}
+				if err := k8sClient.Get(ctx,
+					types.NamespacedName{Name: instrumenter.Name, Namespace: defaultNS},
+					&instr); err != nil {
+					return err
+				}
+				if instr.Status.MatchedPods != 1 || instr.Status.InstrumentedPods != 1 {
+					return fmt.Errorf("expecting 1 matched and instrumented Pod. Got %+v", instr.Status)
+				}
+				if !meta.IsStatusConditionTrue(instr.Status.Conditions, v1alpha1.ConditionReady) {
+					return fmt.Errorf("expecting Ready condition. Got %+v", instr.Status.Conditions)
+				}
+				return nil
+			}, timeout, interval).Should(Succeed())
+		})
 		It("should properly remove the created resources", func() {
 			Expect(k8sClient.Delete(ctx, &singleTestPod)).Should(Succeed())
 			Expect(k8sClient.Delete(ctx, &instrumenter)).Should(Succeed())
@@ -183,6 +201,125 @@ var _ = Describe("Instrumenter Controller", Ordered, Serial, func() {
 		})
 	})
 
+	Context("Ignoring pods that don't match the label selector", func() {
+		ignorablePod, instrumenter := singleTestPodTemplate, instrumenterTemplate
+		ignorablePod.Labels = map[string]string{
+			"grafana.com/instrument-port": "8080",
+			"tier":                        "frontend",
+		}
+		instrumenter.Spec.Selector.MatchLabels = map[string]string{"tier": "backend"}
+		It("should NOT add an instrumenter sidecar to that Pod", func() {
+			By("Creating ignorable Pod")
+			Expect(k8sClient.Create(ctx, &ignorablePod)).To(Succeed())
+
+			By("Deploying an instrumenter instance")
+			Expect(k8sClient.Create(ctx, &instrumenter)).To(Succeed())
+
+			Consistently(func() interface{} {
+				pod := &v1.Pod{}
+				if err := k8sClient.Get(ctx, types.NamespacedName{
+					Name:      ignorablePod.Name,
+					Namespace: ignorablePod.Namespace,
+				}, pod); err != nil {
+					return err
+				}
+				return pod.Spec.Containers
+			}).Should(HaveLen(1))
+		})
+		It("should properly remove the created resources", func() {
+			Expect(k8sClient.Delete(ctx, &ignorablePod)).Should(Succeed())
+			Expect(k8sClient.Delete(ctx, &instrumenter)).Should(Succeed())
+			expectNotFound(&instrumenter)
+		})
+	})
+
+	Context("Ignoring pods whose namespace doesn't match the namespace selector", func() {
+		ignorablePod, instrumenter := singleTestPodTemplate, instrumenterTemplate
+		instrumenter.Spec.Selector.NamespaceSelector = &metav1.LabelSelector{
+			MatchLabels: map[string]string{"team": "payments"},
+		}
+		It("should NOT add an instrumenter sidecar to that Pod", func() {
+			By("Creating ignorable Pod")
+			Expect(k8sClient.Create(ctx, &ignorablePod)).To(Succeed())
+
+			By("Deploying an instrumenter instance")
+			Expect(k8sClient.Create(ctx, &instrumenter)).To(Succeed())
+
+			Consistently(func() interface{} {
+				pod := &v1.Pod{}
+				if err := k8sClient.Get(ctx, types.NamespacedName{
+					Name:      ignorablePod.Name,
+					Namespace: ignorablePod.Namespace,
+				}, pod); err != nil {
+					return err
+				}
+				return pod.Spec.Containers
+			}).Should(HaveLen(1))
+		})
+		It("should properly remove the created resources", func() {
+			Expect(k8sClient.Delete(ctx, &ignorablePod)).Should(Succeed())
+			Expect(k8sClient.Delete(ctx, &instrumenter)).Should(Succeed())
+			expectNotFound(&instrumenter)
+		})
+	})
+
+	Context("Instrumenting Pods from a ClusterInstrumenter", func() {
+		singleTestPod := singleTestPodTemplate
+		clusterInstrumenter := v1alpha1.ClusterInstrumenter{
+			ObjectMeta: controllerruntime.ObjectMeta{Name: "my-cluster-instrumenter"},
+			Spec:       v1alpha1.ClusterInstrumenterSpec{InstrumenterSpec: instrumenterTemplate.Spec},
+		}
+		It("should add an instrumenter sidecar to that Pod", func() {
+			By("Creating target Pod")
+			Expect(k8sClient.Create(ctx, &singleTestPod)).To(Succeed())
+
+			By("Deploying a cluster instrumenter instance")
+			Expect(k8sClient.Create(ctx, &clusterInstrumenter)).To(Succeed())
+
+			By("waiting to the Pod to be restarted and regenerated")
+			Eventually(func() error {
+				pod := v1.Pod{}
+				if err := k8sClient.Get(ctx,
+					types.NamespacedName{Name: "instrumentable-pod", Namespace: defaultNS},
+					&pod); err != nil {
+					return err
+				}
+				if pod.Labels[v1alpha1.InstrumentedKindLabel] != v1alpha1.KindClusterInstrumenter {
+					return fmt.Errorf("expecting Pod to be instrumented by a ClusterInstrumenter. Labels: %v",
+						pod.Labels)
+				}
+				return assertPod(&pod)
+			}, timeout, interval).Should(Succeed())
+		})
+		It("should give precedence to namespaced Instrumenters", func() {
+			instrumenter := instrumenterTemplate
+			By("Deploying an instrumenter instance")
+			Expect(k8sClient.Create(ctx, &instrumenter)).To(Succeed())
+
+			By("waiting to the Pod to be restarted and regenerated")
+			Eventually(func() error {
+				pod := v1.Pod{}
+				if err := k8sClient.Get(ctx,
+					types.NamespacedName{Name: "instrumentable-pod", Namespace: defaultNS},
+					&pod); err != nil {
+					return err
+				}
+				if name, kind := v1alpha1.InstrumentedBy(&pod); name != instrumenter.Name || kind != v1alpha1.KindInstrumenter {
+					return fmt.Errorf("expecting Pod to be instrumented by %s. Got %s/%s", instrumenter.Name, kind, name)
+				}
+				return assertPod(&pod)
+			}, timeout, interval).Should(Succeed())
+
+			Expect(k8sClient.Delete(ctx, &instrumenter)).Should(Succeed())
+			expectNotFound(&instrumenter)
+		})
+		It("should properly remove the created resources", func() {
+			Expect(k8sClient.Delete(ctx, &singleTestPod)).Should(Succeed())
+			Expect(k8sClient.Delete(ctx, &clusterInstrumenter)).Should(Succeed())
+			expectNotFound(&clusterInstrumenter)
+		})
+	})
+
 	Context("Instrumenting ReplicaSets", func() {
 		replicaSet := appsv1.ReplicaSet{
 			ObjectMeta: controllerruntime.ObjectMeta{
@@ -252,11 +389,15 @@ func assertPod(pod *v1.Pod) error {
 	if pod.Spec.ShareProcessNamespace == nil || *pod.Spec.ShareProcessNamespace != true {
 		return fmt.Errorf("expecting ShareProcessNamespace=true. Got %v", pod.Spec.ShareProcessNamespace)
 	}
+	// the Pod name is resolved from the Downward API, as it might not be assigned yet on admission
+	if err := assertEnvFieldRef(instrum.Env, "K8S_POD_NAME", "metadata.name"); err != nil {
+		return err
+	}
 	return assertEnvContains(instrum.Env, map[string]string{
 		"OPEN_PORT":               "8080",
-		"SERVICE_NAME":            "instrumentable-pod",
+		"SERVICE_NAME":            "$(K8S_POD_NAME)",
 		"SERVICE_NAMESPACE":       "default",
-		"PROMETHEUS_SERVICE_NAME": "instrumentable-pod",
+		"PROMETHEUS_SERVICE_NAME": "$(K8S_POD_NAME)",
 		"PROMETHEUS_PORT":         "9102",
 		"PROMETHEUS_PATH":         "/metrics",
 	})
@@ -276,6 +417,18 @@ func assertEnvContains(slice []v1.EnvVar, values map[string]string) error {
 	return nil
 }
 
+func assertEnvFieldRef(slice []v1.EnvVar, name, fieldPath string) error {
+	for _, e := range slice {
+		if e.Name == name {
+			if e.ValueFrom == nil || e.ValueFrom.FieldRef == nil || e.ValueFrom.FieldRef.FieldPath != fieldPath {
+				return fmt.Errorf("expecting env %s to reference field %s. Got %+v", name, fieldPath, e)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("expecting env %v to contain %s", slice, name)
+}
+
 func expectNotFound(obj client.Object) {
 	Eventually(func() error {
 		err := k8sClient.Get(ctx, types.NamespacedName{
@@ -0,0 +1,135 @@
+/*
+Copyright 2023 Grafana Labs <hello@grafana.com>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	appo11yv1alpha1 "github.com/grafana/ebpf-autoinstrument-operator/api/v1alpha1"
+)
+
+// The PodMonitor is managed as an unstructured object, so the operator doesn't depend on the
+// prometheus-operator API module, and it can run in clusters without its CRDs.
+var podMonitorGVK = schema.GroupVersionKind{Group: "monitoring.coreos.com", Version: "v1", Kind: "PodMonitor"}
+
+// labels that the PodMonitor relabeling adds to the scraped autoinstrumenter metrics
+const (
+	serviceNameTargetLabel      = "service_name"
+	serviceNamespaceTargetLabel = "namespace"
+)
+
+// podMonitorEnabled returns whether the Instrumenter requires a PodMonitor for its instrumented Pods
+func podMonitorEnabled(iq *appo11yv1alpha1.Instrumenter) bool {
+	return iq.Spec.Prometheus.PodMonitor.Enabled && appo11yv1alpha1.ExportsPrometheus(&iq.Spec)
+}
+
+// reconcilePodMonitor creates or updates the PodMonitor that scrapes the metrics of the Pods
+// instrumented by the provided Instrumenter, or removes it if it isn't required anymore
+func reconcilePodMonitor(ctx context.Context, c client.Client, scheme *runtime.Scheme, iq *appo11yv1alpha1.Instrumenter) error {
+	pm := &unstructured.Unstructured{}
+	pm.SetGroupVersionKind(podMonitorGVK)
+	pm.SetNamespace(iq.Namespace)
+	pm.SetName("beyla-" + iq.Name)
+	if !podMonitorEnabled(iq) {
+		return removePodMonitor(ctx, c, iq, pm)
+	}
+	if _, err := controllerutil.CreateOrUpdate(ctx, c, pm, func() error {
+		pm.SetLabels(iq.Spec.Prometheus.PodMonitor.Labels)
+		if err := unstructured.SetNestedField(pm.Object, podMonitorSpec(iq), "spec"); err != nil {
+			return err
+		}
+		return controllerutil.SetControllerReference(iq, pm, scheme)
+	}); err != nil {
+		if meta.IsNoMatchError(err) {
+			return invalidSpecError{err: fmt.Errorf("can't create the PodMonitor, as the "+
+				"prometheus-operator CustomResourceDefinitions aren't installed: %w", err)}
+		}
+		return fmt.Errorf("reconciling PodMonitor %s/%s: %w", pm.GetNamespace(), pm.GetName(), err)
+	}
+	iq.Status.PodMonitor = pm.GetName()
+	return nil
+}
+
+// podMonitorSpec selects the Pods instrumented by the Instrumenter, and scrapes the metrics port of
+// their sidecar, labeling the metrics with the instrumented service name and namespace
+func podMonitorSpec(iq *appo11yv1alpha1.Instrumenter) map[string]interface{} {
+	return map[string]interface{}{
+		"selector": map[string]interface{}{
+			"matchLabels": map[string]interface{}{
+				appo11yv1alpha1.InstrumentedLabel:     iq.Name,
+				appo11yv1alpha1.InstrumentedKindLabel: iq.InstrumenterKind(),
+			},
+		},
+		"podMetricsEndpoints": []interface{}{
+			map[string]interface{}{
+				"port":   appo11yv1alpha1.PrometheusPortName,
+				"path":   iq.Spec.Prometheus.Path,
+				"scheme": "http",
+				// the labels reported by the autoinstrumenter take precedence over the target labels
+				"honorLabels": true,
+				"relabelings": []interface{}{
+					map[string]interface{}{
+						"sourceLabels": []interface{}{
+							"__meta_kubernetes_pod_annotation_" +
+								sanitizeLabelName(appo11yv1alpha1.ReportedServiceNameAnnotation),
+						},
+						"targetLabel": serviceNameTargetLabel,
+					},
+					map[string]interface{}{
+						"sourceLabels": []interface{}{"__meta_kubernetes_namespace"},
+						"targetLabel":  serviceNamespaceTargetLabel,
+					},
+				},
+			},
+		},
+	}
+}
+
+// removePodMonitor removes the provided PodMonitor, if the Instrumenter might have created it: either
+// it is recorded in the status, or the specification changed since the last reconciliation (e.g.
+// the status update failed). This avoids sending a request to the API server on each reconciliation.
+func removePodMonitor(ctx context.Context, c client.Client, iq *appo11yv1alpha1.Instrumenter, pm *unstructured.Unstructured) error {
+	if iq.Status.PodMonitor == "" && iq.Status.ObservedGeneration == iq.Generation {
+		return nil
+	}
+	if err := c.Delete(ctx, pm); err != nil && !apierrors.IsNotFound(err) && !meta.IsNoMatchError(err) {
+		return fmt.Errorf("removing PodMonitor %s/%s: %w", pm.GetNamespace(), pm.GetName(), err)
+	}
+	iq.Status.PodMonitor = ""
+	return nil
+}
+
+// sanitizeLabelName converts a Kubernetes label or annotation name into the format of the
+// Prometheus service discovery meta labels
+func sanitizeLabelName(name string) string {
+	out := []byte(name)
+	for i, c := range out {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_') {
+			out[i] = '_'
+		}
+	}
+	return string(out)
+}
@@ -0,0 +1,129 @@
+/*
+Copyright 2023 Grafana Labs <hello@grafana.com>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/envtest"
+
+	appo11yv1alpha1 "github.com/grafana/ebpf-autoinstrument-operator/api/v1alpha1"
+)
+
+var _ = Describe("PodMonitor", Ordered, func() {
+	const ns = "pod-monitor"
+	// the Instrumenter isn't stored, so it isn't reconciled by the suite manager
+	var instr *appo11yv1alpha1.Instrumenter
+	BeforeAll(func() {
+		createNamespace(ns)
+	})
+	BeforeEach(func() {
+		instr = &appo11yv1alpha1.Instrumenter{
+			ObjectMeta: metav1.ObjectMeta{Name: "instr", Namespace: ns, UID: "1234"},
+			Spec: appo11yv1alpha1.InstrumenterSpec{
+				Export: []appo11yv1alpha1.Exporter{appo11yv1alpha1.ExporterPrometheus},
+				Prometheus: appo11yv1alpha1.Prometheus{
+					Path: "/metrics",
+					PodMonitor: appo11yv1alpha1.PodMonitor{
+						Enabled: true,
+						Labels:  map[string]string{"release": "prometheus"},
+					},
+				},
+			},
+		}
+	})
+
+	It("should report an invalid specification if the prometheus-operator isn't installed", func() {
+		err := reconcilePodMonitor(ctx, k8sClient, scheme.Scheme, instr)
+		Expect(err).To(BeAssignableToTypeOf(invalidSpecError{}))
+	})
+
+	It("should scrape the Pods instrumented by the Instrumenter", func() {
+		installPodMonitorCRD()
+		Eventually(func() error {
+			return reconcilePodMonitor(ctx, k8sClient, scheme.Scheme, instr)
+		}, timeout, interval).Should(Succeed())
+		pm := &unstructured.Unstructured{}
+		pm.SetGroupVersionKind(podMonitorGVK)
+		Expect(k8sClient.Get(ctx, client.ObjectKey{Namespace: ns, Name: "beyla-instr"}, pm)).To(Succeed())
+		Expect(pm.GetLabels()).To(HaveKeyWithValue("release", "prometheus"))
+		Expect(pm.GetOwnerReferences()).To(HaveLen(1))
+		Expect(pm.GetOwnerReferences()[0].UID).To(BeEquivalentTo("1234"))
+		Expect(instr.Status.PodMonitor).To(Equal("beyla-instr"))
+		selected, _, _ := unstructured.NestedString(pm.Object,
+			"spec", "selector", "matchLabels", appo11yv1alpha1.InstrumentedLabel)
+		Expect(selected).To(Equal("instr"))
+		endpoints, _, _ := unstructured.NestedSlice(pm.Object, "spec", "podMetricsEndpoints")
+		Expect(endpoints).To(HaveLen(1))
+		Expect(endpoints[0]).To(HaveKeyWithValue("port", appo11yv1alpha1.PrometheusPortName))
+		relabelings := endpoints[0].(map[string]interface{})["relabelings"].([]interface{})
+		Expect(relabelings[0]).To(HaveKeyWithValue("sourceLabels",
+			ConsistOf("__meta_kubernetes_pod_annotation_grafana_com_instrumenter_service_name")))
+
+		By("removing the PodMonitor when it is disabled")
+		instr.Spec.Prometheus.PodMonitor.Enabled = false
+		Expect(reconcilePodMonitor(ctx, k8sClient, scheme.Scheme, instr)).To(Succeed())
+		expectNotFound(pm)
+		Expect(instr.Status.PodMonitor).To(BeEmpty())
+
+		By("not looking for the PodMonitor again if the Instrumenter didn't change since its removal")
+		deletes := &deleteCountingClient{Client: k8sClient}
+		Expect(reconcilePodMonitor(ctx, deletes, scheme.Scheme, instr)).To(Succeed())
+		Expect(deletes.count).To(BeZero())
+	})
+})
+
+// installPodMonitorCRD installs a schemaless version of the prometheus-operator PodMonitor CRD
+func installPodMonitorCRD() {
+	preserveUnknownFields := true
+	_, err := envtest.InstallCRDs(cfg, envtest.CRDInstallOptions{CRDs: []*apiextensionsv1.CustomResourceDefinition{{
+		ObjectMeta: metav1.ObjectMeta{Name: "podmonitors." + podMonitorGVK.Group},
+		Spec: apiextensionsv1.CustomResourceDefinitionSpec{
+			Group: podMonitorGVK.Group,
+			Names: apiextensionsv1.CustomResourceDefinitionNames{
+				Kind: podMonitorGVK.Kind, ListKind: podMonitorGVK.Kind + "List",
+				Plural: "podmonitors", Singular: "podmonitor",
+			},
+			Scope: apiextensionsv1.NamespaceScoped,
+			Versions: []apiextensionsv1.CustomResourceDefinitionVersion{{
+				Name: podMonitorGVK.Version, Served: true, Storage: true,
+				Schema: &apiextensionsv1.CustomResourceValidation{OpenAPIV3Schema: &apiextensionsv1.JSONSchemaProps{
+					Type: "object", XPreserveUnknownFields: &preserveUnknownFields,
+				}},
+			}},
+		},
+	}}})
+	ExpectWithOffset(1, err).ToNot(HaveOccurred())
+}
+
+// deleteCountingClient counts the removal requests sent to the API server
+type deleteCountingClient struct {
+	client.Client
+	count int
+}
+
+func (c *deleteCountingClient) Delete(ctx context.Context, obj client.Object, opts ...client.DeleteOption) error {
+	c.count++
+	return c.Client.Delete(ctx, obj, opts...)
+}
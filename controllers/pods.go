@@ -0,0 +1,435 @@
+/*
+Copyright 2023 Grafana Labs <hello@grafana.com>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	appo11yv1alpha1 "github.com/grafana/ebpf-autoinstrument-operator/api/v1alpha1"
+	"github.com/grafana/ebpf-autoinstrument-operator/pkg/helper/lvl"
+	"github.com/grafana/ebpf-autoinstrument-operator/pkg/owner"
+)
+
+// Pod instrumentation logic that is common to the Instrumenter and ClusterInstrumenter reconcilers
+
+// missedAdmissionGracePeriod is the minimum age of a Pod that was admitted without the instrumenter
+// sidecar before it is evicted
+const missedAdmissionGracePeriod = time.Minute
+
+// errExcludedNamespace is returned when an Instrumenter is in a namespace that is never instrumented
+var errExcludedNamespace = errors.New("the Pods of the system namespaces and the operator namespace are never instrumented")
+
+// excludedNamespaces returns the namespaces whose Pods are never instrumented: the system namespaces
+// and the operator namespace, if known. As the Pod webhook doesn't intercept them, instrumenting
+// their Pods would require restarting them after each admission.
+func excludedNamespaces(operatorNamespace string) []string {
+	excluded := append([]string{}, appo11yv1alpha1.SystemNamespaces...)
+	if operatorNamespace != "" {
+		excluded = append(excluded, operatorNamespace)
+	}
+	return excluded
+}
+
+// isExcludedNamespace returns whether the Pods of the given namespace are never instrumented
+func isExcludedNamespace(namespace, operatorNamespace string) bool {
+	for _, ns := range excludedNamespaces(operatorNamespace) {
+		if ns == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// cleanupFinalizer prevents the instrumenters from being removed before their Pods are
+// uninstrumented and the cluster-scoped resources they might have created are removed
+const cleanupFinalizer = "appo11y.grafana.com/cleanup"
+
+// addCleanupFinalizer adds the cleanup finalizer to the instrumenter, if it doesn't have it yet
+func addCleanupFinalizer(ctx context.Context, c client.Client, iq appo11yv1alpha1.InstrumenterObject) error {
+	if !controllerutil.AddFinalizer(iq, cleanupFinalizer) {
+		return nil
+	}
+	if err := c.Update(ctx, iq); err != nil {
+		return fmt.Errorf("adding finalizer: %w", err)
+	}
+	return nil
+}
+
+// removeCleanupFinalizer removes the cleanup finalizer from the instrumenter, once it has been cleaned up
+func removeCleanupFinalizer(ctx context.Context, c client.Client, iq appo11yv1alpha1.InstrumenterObject) error {
+	if !controllerutil.RemoveFinalizer(iq, cleanupFinalizer) {
+		return nil
+	}
+	if err := c.Update(ctx, iq); err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("removing finalizer: %w", err)
+	}
+	return nil
+}
+
+// instrumentPods replaces the selected Pods of the namespace that lack an up-to-date instrumenter sidecar,
+// except those accepted by the skip function, and records the selected Pods in the inventory
+func instrumentPods(
+	ctx context.Context, c *replacer, iq appo11yv1alpha1.InstrumenterObject,
+	namespace string, skip func(*corev1.Pod) bool, inv *inventory,
+) error {
+	pods, err := selectedPods(ctx, c, iq, namespace, skip)
+	if err != nil {
+		return err
+	}
+	for _, pod := range pods {
+		podLog := log.FromContext(ctx).V(lvl.Debug).WithValues("podName", pod.Name, "podNamespace", pod.Namespace)
+		if pending, err := c.recreatePod(ctx, pod); err != nil {
+			return err
+		} else if pending {
+			inv.add(pod, appo11yv1alpha1.PodPending, "waiting for the Pod to terminate to recreate it")
+			continue
+		}
+		owners, err := owner.Resolve(ctx, c, pod)
+		if err != nil {
+			return fmt.Errorf("resolving owners of Pod %s/%s: %w", pod.Namespace, pod.Name, err)
+		}
+		sidec, ok := appo11yv1alpha1.NeedsInstrumentation(iq, pod, owners)
+		switch {
+		case ok && !pod.DeletionTimestamp.IsZero():
+			inv.add(pod, appo11yv1alpha1.PodPending, "waiting for the Pod to terminate")
+		case ok:
+			podLog.Info("Replacing Pod to recreate it with an instrumenter sidecar")
+			if err := addInstrumenter(ctx, c, iq, pod, owners, sidec, inv); err != nil {
+				return err
+			}
+		case appo11yv1alpha1.IsInstrumentedBy(iq, pod):
+			inv.addInstrumented(pod)
+			inv.checkPrometheusConflict(iq, pod)
+		default:
+			podLog.Info("Pod is instrumented by another instrumenter. Skipping")
+		}
+	}
+	return nil
+}
+
+// selectedPods returns the Pods from the given namespace that are selected by the provided
+// instrumenter, excluding those accepted by the skip function.
+func selectedPods(
+	ctx context.Context, c client.Reader, iq appo11yv1alpha1.InstrumenterObject,
+	namespace string, skip func(*corev1.Pod) bool,
+) ([]*corev1.Pod, error) {
+	dbg := log.FromContext(ctx).V(lvl.Debug)
+	podList := corev1.PodList{}
+	if err := c.List(ctx, &podList,
+		client.InNamespace(namespace),
+		client.HasLabels{iq.GetSpec().Selector.PortLabel}); err != nil {
+		return nil, fmt.Errorf("reading pods: %w", err)
+	}
+
+	dbg.Info("list of pods to instrument", "len", len(podList.Items), "namespace", namespace)
+
+	var pods []*corev1.Pod
+	for i := range podList.Items {
+		pod := &podList.Items[i]
+		if selected, err := iq.GetSpec().Selector.SelectsPod(pod); err != nil || !selected {
+			continue
+		}
+		if skip != nil && skip(pod) {
+			dbg.Info("Pod is selected by another instrumenter with higher precedence. Skipping",
+				"podName", pod.Name, "podNamespace", pod.Namespace)
+			continue
+		}
+		pods = append(pods, pod)
+	}
+	return pods, nil
+}
+
+// addInstrumenter replaces the provided Pod to recreate it with the instrumenter sidecar, and
+// records it as pending in the inventory
+func addInstrumenter(
+	ctx context.Context, c *replacer, iq appo11yv1alpha1.InstrumenterObject,
+	pod *corev1.Pod, owners owner.Chain, sidecar *corev1.Container, inv *inventory,
+) error {
+	inv.checkPrometheusConflict(iq, pod)
+	if missedAdmission(iq, pod) {
+		return replaceMissed(ctx, c, iq, pod, sidecar, inv)
+	}
+	workload, err := c.replace(ctx, pod, owners, instrumentReason(iq), func(pod *corev1.Pod) {
+		appo11yv1alpha1.AddInstrumenter(iq, sidecar, pod)
+	})
+	switch {
+	case errors.Is(err, errEvictionBlocked):
+		inv.add(pod, appo11yv1alpha1.PodPending, err.Error())
+	case errors.Is(err, errJobOwned):
+		// the finished Pods won't run again, so they don't need to be instrumented
+		if pod.Status.Phase != corev1.PodSucceeded && pod.Status.Phase != corev1.PodFailed {
+			inv.add(pod, appo11yv1alpha1.PodPending, "owned by a Job. The next Pods of the Job will be instrumented")
+		}
+	case err != nil:
+		return err
+	case workload != "":
+		inv.add(pod, appo11yv1alpha1.PodPending, "waiting for the rollout of "+workload)
+	default:
+		inv.add(pod, appo11yv1alpha1.PodPending, "replaced to add an up-to-date instrumenter sidecar")
+	}
+	return nil
+}
+
+// missedAdmission returns whether the Pod was created from a workload that had already been
+// restarted for the current instrumenter configuration, so the webhook should have added the
+// instrumenter sidecar to it.
+func missedAdmission(iq appo11yv1alpha1.InstrumenterObject, pod *corev1.Pod) bool {
+	return pod.Annotations[restartedForAnnotation] == instrumentReason(iq)
+}
+
+// replaceMissed evicts a Pod that was admitted without the instrumenter sidecar, once the grace period
+// since its creation elapses, as restarting its workload again wouldn't have any effect
+func replaceMissed(
+	ctx context.Context, c *replacer, iq appo11yv1alpha1.InstrumenterObject,
+	pod *corev1.Pod, sidecar *corev1.Container, inv *inventory,
+) error {
+	inv.missedAdmissions++
+	if wait := missedAdmissionGracePeriod - time.Since(pod.CreationTimestamp.Time); wait > 0 {
+		inv.requeueIn(wait)
+		inv.add(pod, appo11yv1alpha1.PodPending, "admitted without the instrumenter sidecar. Waiting to replace it")
+		return nil
+	}
+	log.FromContext(ctx).Info("Pod admitted without the instrumenter sidecar. Evicting it",
+		"podName", pod.Name, "podNamespace", pod.Namespace)
+	err := c.replacePod(ctx, pod, func(pod *corev1.Pod) {
+		appo11yv1alpha1.AddInstrumenter(iq, sidecar, pod)
+	})
+	switch {
+	case errors.Is(err, errEvictionBlocked):
+		inv.add(pod, appo11yv1alpha1.PodPending, err.Error())
+	case err != nil:
+		return err
+	default:
+		inv.add(pod, appo11yv1alpha1.PodPending, "admitted without the instrumenter sidecar. Evicted to recreate it")
+	}
+	return nil
+}
+
+// mightSelect returns whether the provided Pod could be selected by the instrumenter, or has
+// been instrumented by it, without taking into account the namespace nor the instrumenters'
+// precedence. It is used to filter the Pod events that might change the instrumenter status.
+func mightSelect(iq appo11yv1alpha1.InstrumenterObject, pod client.Object) bool {
+	labels := pod.GetLabels()
+	if _, ok := labels[iq.GetSpec().Selector.PortLabel]; ok {
+		return true
+	}
+	name, kind := labels[appo11yv1alpha1.InstrumentedLabel], labels[appo11yv1alpha1.InstrumentedKindLabel]
+	if kind == "" {
+		kind = appo11yv1alpha1.KindInstrumenter
+	}
+	return name == iq.GetName() && kind == iq.InstrumenterKind()
+}
+
+// precedence resolves the conflicts between an instrumenter and the instrumenters that take
+// precedence over it in a namespace (see appo11yv1alpha1.Precedes)
+type precedence struct {
+	ns *corev1.Namespace
+	// preceding instrumenters, sorted by precedence
+	preceding []appo11yv1alpha1.InstrumenterObject
+}
+
+// podChanged filters out the Pod updates that can't change how the instrumenters select, instrument
+// or report the Pod, such as the readiness updates of its containers
+var podChanged = predicate.Funcs{
+	UpdateFunc: func(e event.UpdateEvent) bool {
+		old, okOld := e.ObjectOld.(*corev1.Pod)
+		pod, ok := e.ObjectNew.(*corev1.Pod)
+		if !okOld || !ok {
+			return true
+		}
+		oldSidecar, _ := appo11yv1alpha1.SidecarStatus(old)
+		sidecar, _ := appo11yv1alpha1.SidecarStatus(pod)
+		return !equality.Semantic.DeepEqual(old.Labels, pod.Labels) ||
+			!equality.Semantic.DeepEqual(old.Annotations, pod.Annotations) ||
+			!equality.Semantic.DeepEqual(old.OwnerReferences, pod.OwnerReferences) ||
+			!equality.Semantic.DeepEqual(old.Finalizers, pod.Finalizers) ||
+			old.DeletionTimestamp.IsZero() != pod.DeletionTimestamp.IsZero() ||
+			// the kubelet confirms the termination of the evicted Pods that wait to be recreated
+			!equality.Semantic.DeepEqual(old.DeletionGracePeriodSeconds, pod.DeletionGracePeriodSeconds) ||
+			old.Status.Phase != pod.Status.Phase ||
+			!equality.Semantic.DeepEqual(oldSidecar, sidecar)
+	},
+}
+
+// competitors are the instrumenters that might take precedence over an instrumenter, listed once
+// per reconciliation and grouped by namespace
+type competitors struct {
+	namespaced map[string][]appo11yv1alpha1.InstrumenterObject
+	// cluster instrumenters, which only compete with ClusterInstrumenters
+	cluster []appo11yv1alpha1.InstrumenterObject
+}
+
+// listCompetitors lists the Instrumenters of the given namespace, or of all the namespaces if empty,
+// as well as all the ClusterInstrumenters when the provided instrumenter is a ClusterInstrumenter
+func listCompetitors(
+	ctx context.Context, c client.Reader, iq appo11yv1alpha1.InstrumenterObject, namespace string,
+) (*competitors, error) {
+	instrumenters := appo11yv1alpha1.InstrumenterList{}
+	if err := c.List(ctx, &instrumenters, client.InNamespace(namespace)); err != nil {
+		return nil, fmt.Errorf("reading instrumenters: %w", err)
+	}
+	comp := &competitors{namespaced: map[string][]appo11yv1alpha1.InstrumenterObject{}}
+	for i := range instrumenters.Items {
+		instr := &instrumenters.Items[i]
+		comp.namespaced[instr.Namespace] = append(comp.namespaced[instr.Namespace], instr)
+	}
+	if iq.InstrumenterKind() == appo11yv1alpha1.KindClusterInstrumenter {
+		clusterInstrumenters := appo11yv1alpha1.ClusterInstrumenterList{}
+		if err := c.List(ctx, &clusterInstrumenters); err != nil {
+			return nil, fmt.Errorf("reading cluster instrumenters: %w", err)
+		}
+		for i := range clusterInstrumenters.Items {
+			comp.cluster = append(comp.cluster, &clusterInstrumenters.Items[i])
+		}
+	}
+	return comp, nil
+}
+
+// precedence returns the competitors that take precedence over the provided instrumenter in the given namespace
+func (comp *competitors) precedence(iq appo11yv1alpha1.InstrumenterObject, ns *corev1.Namespace) *precedence {
+	p := &precedence{ns: ns}
+	for _, candidates := range [][]appo11yv1alpha1.InstrumenterObject{comp.namespaced[ns.Name], comp.cluster} {
+		for _, other := range candidates {
+			if appo11yv1alpha1.Precedes(other, iq) {
+				p.preceding = append(p.preceding, other)
+			}
+		}
+	}
+	sort.Slice(p.preceding, func(i, j int) bool {
+		return appo11yv1alpha1.Precedes(p.preceding[i], p.preceding[j])
+	})
+	return p
+}
+
+// precedingInstrumenters returns the instrumenters that take precedence over the provided one in the
+// given namespace: the namespaced Instrumenters of that namespace and, for ClusterInstrumenters,
+// also the other ClusterInstrumenters.
+func precedingInstrumenters(
+	ctx context.Context, c client.Reader, iq appo11yv1alpha1.InstrumenterObject, ns *corev1.Namespace,
+) (*precedence, error) {
+	comp, err := listCompetitors(ctx, c, iq, ns.Name)
+	if err != nil {
+		return nil, err
+	}
+	return comp.precedence(iq, ns), nil
+}
+
+// winner returns the instrumenter with the highest precedence that selects the Pod, if any
+func (p *precedence) winner(pod *corev1.Pod) (appo11yv1alpha1.InstrumenterObject, bool) {
+	for _, other := range p.preceding {
+		sel := &other.GetSpec().Selector
+		if nsSelected, err := sel.SelectsNamespace(p.ns); err != nil || !nsSelected {
+			continue
+		}
+		if podSelected, err := sel.SelectsPod(pod); err == nil && podSelected {
+			return other, true
+		}
+	}
+	return nil, false
+}
+
+// skip returns a function that skips the Pods selected by any instrumenter that takes precedence,
+// recording them as contested in the provided inventory
+func (p *precedence) skip(inv *inventory) func(*corev1.Pod) bool {
+	return func(pod *corev1.Pod) bool {
+		winner, ok := p.winner(pod)
+		if ok {
+			inv.addContested(pod, winner)
+		}
+		return ok
+	}
+}
+
+// uninstrumentUnselected removes the instrumenter sidecar from the Pods of the namespace that aren't
+// selected anymore, or are selected by a preceding instrumenter of the same kind
+func uninstrumentUnselected(
+	ctx context.Context, c *replacer, iq appo11yv1alpha1.InstrumenterObject,
+	namespace string, nsSelected bool, prec *precedence,
+) error {
+	return uninstrumentPods(ctx, c, iq.GetName(), iq.InstrumenterKind(), func(pod *corev1.Pod) bool {
+		if !nsSelected {
+			return true
+		}
+		selected, err := iq.GetSpec().Selector.SelectsPod(pod)
+		if err != nil {
+			return false
+		}
+		if !selected {
+			return true
+		}
+		winner, ok := prec.winner(pod)
+		return ok && winner.InstrumenterKind() == iq.InstrumenterKind()
+	}, client.InNamespace(namespace))
+}
+
+// uninstrumentPods removes the instrumenter sidecar from the Pods that were instrumented by the
+// instrumenter with the provided name and kind, and accepted by the filter function.
+func uninstrumentPods(
+	ctx context.Context, c *replacer, name, kind string,
+	filter func(*corev1.Pod) bool, opts ...client.ListOption,
+) error {
+	dbg := log.FromContext(ctx).V(lvl.Debug)
+	podList := corev1.PodList{}
+	if err := c.List(ctx, &podList,
+		append(opts, client.MatchingLabels{appo11yv1alpha1.InstrumentedLabel: name})...); err != nil {
+		return fmt.Errorf("reading pods: %w", err)
+	}
+	for i := range podList.Items {
+		pod := &podList.Items[i]
+		if pending, err := c.recreatePod(ctx, pod); err != nil {
+			return err
+		} else if pending {
+			continue
+		}
+		if instrName, instrKind := appo11yv1alpha1.InstrumentedBy(pod); instrName != name || instrKind != kind {
+			dbg.Info("this Pod is instumented by another instrumenter. Skipping",
+				"instrumentedBy", instrName, "kind", instrKind, "podName", pod.Name, "podNamespace", pod.Namespace)
+			continue
+		}
+		if filter != nil && !filter(pod) {
+			continue
+		}
+		dbg.Info("removing instrumenter sidecar from Pod", "podName", pod.Name, "podNamespace", pod.Namespace)
+		owners, err := owner.Resolve(ctx, c, pod)
+		if err != nil {
+			return fmt.Errorf("resolving owners of Pod %s/%s: %w", pod.Namespace, pod.Name, err)
+		}
+		_, err = c.replace(ctx, pod, owners, uninstrumentReason(name, kind), appo11yv1alpha1.RemoveInstrumenter)
+		if errors.Is(err, errEvictionBlocked) {
+			dbg.Info("Pod eviction blocked. Will retry later", "podName", pod.Name, "podNamespace", pod.Namespace)
+		} else if errors.Is(err, errJobOwned) {
+			dbg.Info("Pod owned by a Job. Keeping its instrumenter sidecar until it finishes",
+				"podName", pod.Name, "podNamespace", pod.Namespace)
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,340 @@
+/*
+Copyright 2023 Grafana Labs <hello@grafana.com>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	appo11yv1alpha1 "github.com/grafana/ebpf-autoinstrument-operator/api/v1alpha1"
+)
+
+func TestPodChanged(t *testing.T) {
+	old := testPod("ns", "pod")
+	old.Labels = map[string]string{"instrument-port": "8080"}
+	for _, tc := range []struct {
+		name    string
+		update  func(pod *corev1.Pod)
+		changed bool
+	}{
+		{name: "readiness", update: func(pod *corev1.Pod) {
+			pod.Status.Conditions = []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}}
+		}},
+		{name: "application container", update: func(pod *corev1.Pod) {
+			pod.Status.ContainerStatuses = []corev1.ContainerStatus{{Name: "app", Ready: true}}
+		}},
+		{name: "labels", changed: true, update: func(pod *corev1.Pod) {
+			pod.Labels = map[string]string{"instrument-port": "9090"}
+		}},
+		{name: "deletion", changed: true, update: func(pod *corev1.Pod) {
+			pod.DeletionTimestamp = &metav1.Time{Time: time.Now()}
+		}},
+		{name: "termination", changed: true, update: func(pod *corev1.Pod) {
+			grace := int64(0)
+			pod.DeletionGracePeriodSeconds = &grace
+		}},
+		{name: "sidecar container", changed: true, update: func(pod *corev1.Pod) {
+			pod.Status.ContainerStatuses = []corev1.ContainerStatus{{Name: "grafana-ebpf-autoinstrumenter",
+				State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "CrashLoopBackOff"}}}}
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pod := old.DeepCopy()
+			tc.update(pod)
+			if changed := podChanged.Update(event.UpdateEvent{ObjectOld: old, ObjectNew: pod}); changed != tc.changed {
+				t.Errorf("expected the update to pass the filter: %v. Got %v", tc.changed, changed)
+			}
+		})
+	}
+}
+
+func TestIsExcludedNamespace(t *testing.T) {
+	for _, tc := range []struct {
+		namespace string
+		excluded  bool
+	}{
+		{namespace: "kube-system", excluded: true},
+		{namespace: "operator", excluded: true},
+		{namespace: "ns"},
+	} {
+		if excluded := isExcludedNamespace(tc.namespace, "operator"); excluded != tc.excluded {
+			t.Errorf("expected namespace %s to be excluded: %v. Got %v", tc.namespace, tc.excluded, excluded)
+		}
+	}
+	if isExcludedNamespace("operator", "") {
+		t.Error("not expecting any namespace but the system ones to be excluded if the operator namespace is unknown")
+	}
+}
+
+var _ = Describe("Pods admitted without the instrumenter sidecar", Ordered, func() {
+	const ns = "missed-admission"
+	BeforeAll(func() {
+		createNamespace(ns)
+	})
+
+	It("should be evicted once the grace period since their creation elapses", func() {
+		instr := &appo11yv1alpha1.Instrumenter{
+			ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: "instr", Generation: 2},
+			Spec: appo11yv1alpha1.InstrumenterSpec{
+				Selector: appo11yv1alpha1.Selector{PortLabel: "missed-instrument-port"},
+			},
+		}
+		// the Deployment was already restarted for the current Instrumenter generation
+		reason := instrumentReason(instr)
+		labels := map[string]string{"app": "backend"}
+		deployment := &appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: "backend"},
+			Spec: appsv1.DeploymentSpec{
+				Selector: &metav1.LabelSelector{MatchLabels: labels},
+				Template: corev1.PodTemplateSpec{
+					ObjectMeta: metav1.ObjectMeta{
+						Labels:      labels,
+						Annotations: map[string]string{restartedForAnnotation: reason},
+					},
+					Spec: newTestPod(ns, "", nil).Spec,
+				},
+			},
+		}
+		Expect(k8sClient.Create(ctx, deployment)).To(Succeed())
+		var pods []*corev1.Pod
+		for _, name := range []string{"backend-5d4f8c-aaaaa", "backend-5d4f8c-bbbbb"} {
+			pod := newTestPod(ns, name, map[string]string{
+				"app": "backend", "missed-instrument-port": "8080", appsv1.DefaultDeploymentUniqueLabelKey: "5d4f8c",
+			})
+			pod.Annotations = map[string]string{restartedForAnnotation: reason}
+			controller := true
+			pod.OwnerReferences = []metav1.OwnerReference{{
+				APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "backend-5d4f8c", UID: "1234", Controller: &controller,
+			}}
+			Expect(k8sClient.Create(ctx, pod)).To(Succeed())
+			pods = append(pods, pod)
+		}
+
+		rp := newReplacer(k8sClient)
+		inv := inventory{}
+		Expect(instrumentPods(ctx, rp, instr, ns, nil, &inv)).To(Succeed())
+		Expect(inv.missedAdmissions).To(Equal(2))
+		By("waiting for the grace period of the recently created Pods")
+		Expect(inv.requeueAfter).To(BeNumerically(">", 0))
+		Expect(inv.requeueAfter).To(BeNumerically("<=", missedAdmissionGracePeriod))
+		for _, pod := range pods {
+			Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(pod), &corev1.Pod{})).To(Succeed())
+		}
+		status := appo11yv1alpha1.InstrumenterStatus{}
+		inv.applyTo(&status, 2, nil)
+		expectCondition(&status, appo11yv1alpha1.ConditionMissedAdmission, metav1.ConditionTrue, reasonWebhookMissed)
+
+		By("evicting the Pods created before the grace period")
+		old := pods[1]
+		old.CreationTimestamp = metav1.NewTime(time.Now().Add(-2 * missedAdmissionGracePeriod))
+		sidecar, ok := appo11yv1alpha1.NeedsInstrumentation(instr, old, nil)
+		Expect(ok).To(BeTrue())
+		Expect(replaceMissed(ctx, rp, instr, old, sidecar, &inventory{})).To(Succeed())
+		expectNotFound(old)
+		Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(pods[0]), &corev1.Pod{})).To(Succeed())
+
+		By("not restarting the Deployment again")
+		Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(deployment), deployment)).To(Succeed())
+		Expect(deployment.Spec.Template.Annotations).ToNot(HaveKey(restartedAtAnnotation))
+	})
+})
+
+var _ = Describe("Excluded namespaces", Ordered, func() {
+	const ns = "excluded-namespaces"
+	spec := appo11yv1alpha1.InstrumenterSpec{Selector: appo11yv1alpha1.Selector{PortLabel: "excluded-instrument-port"}}
+	var pods []*corev1.Pod
+	BeforeAll(func() {
+		createNamespace(ns)
+		for _, namespace := range []string{"kube-system", ns} {
+			pod := newTestPod(namespace, "excluded-namespaces", map[string]string{"excluded-instrument-port": "8080"})
+			Expect(k8sClient.Create(ctx, pod)).To(Succeed())
+			pods = append(pods, pod)
+		}
+	})
+	AfterAll(func() {
+		for _, pod := range pods {
+			Expect(client.IgnoreNotFound(k8sClient.Delete(ctx, pod))).To(Succeed())
+		}
+	})
+
+	It("should never have their Pods instrumented by ClusterInstrumenters", func() {
+		clusterInstr := &appo11yv1alpha1.ClusterInstrumenter{
+			ObjectMeta: metav1.ObjectMeta{Name: "excluded-namespaces"},
+			Spec:       appo11yv1alpha1.ClusterInstrumenterSpec{InstrumenterSpec: spec},
+		}
+		Expect(k8sClient.Create(ctx, clusterInstr)).To(Succeed())
+		Eventually(func() bool {
+			pod := corev1.Pod{}
+			return k8sClient.Get(ctx, client.ObjectKeyFromObject(pods[1]), &pod) == nil &&
+				appo11yv1alpha1.IsInstrumentedBy(clusterInstr, &pod)
+		}, timeout, interval).Should(BeTrue())
+		Consistently(func() error {
+			pod := corev1.Pod{}
+			if err := k8sClient.Get(ctx, client.ObjectKeyFromObject(pods[0]), &pod); err != nil {
+				return err
+			}
+			if pod.UID != pods[0].UID || !pod.DeletionTimestamp.IsZero() {
+				return fmt.Errorf("expecting the kube-system Pod to be kept")
+			}
+			return nil
+		}, time.Second, interval).Should(Succeed())
+
+		Expect(k8sClient.Delete(ctx, clusterInstr)).To(Succeed())
+		expectNotFound(clusterInstr)
+	})
+
+	It("should report their Instrumenters as failed", func() {
+		instr := &appo11yv1alpha1.Instrumenter{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "excluded-namespaces"}, Spec: spec,
+		}
+		Expect(k8sClient.Create(ctx, instr)).To(Succeed())
+		Eventually(func() error {
+			if err := k8sClient.Get(ctx, client.ObjectKeyFromObject(instr), instr); err != nil {
+				return err
+			}
+			cond := meta.FindStatusCondition(instr.Status.Conditions, appo11yv1alpha1.ConditionReady)
+			if cond == nil || cond.Status != metav1.ConditionFalse || cond.Reason != reasonReconcileError {
+				return fmt.Errorf("expecting Ready condition to fail. Got %+v", instr.Status.Conditions)
+			}
+			return nil
+		}, timeout, interval).Should(Succeed())
+		pod := corev1.Pod{}
+		Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(pods[0]), &pod)).To(Succeed())
+		Expect(pod.UID).To(Equal(pods[0].UID))
+
+		Expect(k8sClient.Delete(ctx, instr)).To(Succeed())
+		expectNotFound(instr)
+	})
+})
+
+var _ = Describe("Instrumenters precedence", Ordered, func() {
+	const ns = "precedence"
+	BeforeAll(func() {
+		createNamespace(ns)
+	})
+
+	It("should leave the contested Pods to the instrumenters that take precedence", func() {
+		namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: ns}}
+		instrumenter := func(name string, priority int32, matchLabels map[string]string) *appo11yv1alpha1.Instrumenter {
+			return &appo11yv1alpha1.Instrumenter{
+				ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: name},
+				Spec: appo11yv1alpha1.InstrumenterSpec{
+					Priority: priority,
+					Selector: appo11yv1alpha1.Selector{PortLabel: "precedence-instrument-port", MatchLabels: matchLabels},
+				},
+			}
+		}
+		low := instrumenter("a-low", 0, nil)
+		high := instrumenter("b-high", 5, map[string]string{"app": "backend"})
+		comp := &competitors{namespaced: map[string][]appo11yv1alpha1.InstrumenterObject{ns: {low, high}}}
+		// the contested Pod was instrumented by the Instrumenter with lower priority
+		contested := newTestPod(ns, "backend", map[string]string{"precedence-instrument-port": "8080", "app": "backend",
+			appo11yv1alpha1.InstrumentedLabel: low.Name})
+		contested.Spec.NodeName = "node"
+		Expect(k8sClient.Create(ctx, contested)).To(Succeed())
+
+		Expect(comp.precedence(high, namespace).preceding).To(BeEmpty())
+		prec := comp.precedence(low, namespace)
+
+		By("uninstrumenting the contested Pod, so the winner instruments it when it is recreated")
+		rp := newReplacer(k8sClient)
+		Expect(uninstrumentUnselected(ctx, rp, low, ns, true, prec)).To(Succeed())
+		evicted := corev1.Pod{}
+		Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(contested), &evicted)).To(Succeed())
+		Expect(k8sClient.Delete(ctx, &evicted, client.GracePeriodSeconds(0))).To(Succeed())
+		Expect(uninstrumentUnselected(ctx, rp, low, ns, true, prec)).To(Succeed())
+		pod := corev1.Pod{}
+		Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(contested), &pod)).To(Succeed())
+		Expect(pod.UID).ToNot(Equal(contested.UID))
+		name, _ := appo11yv1alpha1.InstrumentedBy(&pod)
+		Expect(name).To(BeEmpty())
+
+		By("reporting the Pod as contested by the winner")
+		inv := inventory{}
+		Expect(instrumentPods(ctx, rp, low, ns, prec.skip(&inv), &inv)).To(Succeed())
+		Expect(inv.pods).To(BeEmpty())
+		Expect(inv.contested).To(Equal([]string{"precedence/backend (Instrumenter b-high)"}))
+		status := appo11yv1alpha1.InstrumenterStatus{}
+		inv.applyTo(&status, 1, nil)
+		expectCondition(&status, appo11yv1alpha1.ConditionConflicting, metav1.ConditionTrue, reasonLowerPrecedence)
+
+		By("letting the namespaced Instrumenters precede the ClusterInstrumenters whatever their priority")
+		cluster := &appo11yv1alpha1.ClusterInstrumenter{
+			ObjectMeta: metav1.ObjectMeta{Name: "precedence"},
+			Spec: appo11yv1alpha1.ClusterInstrumenterSpec{InstrumenterSpec: appo11yv1alpha1.InstrumenterSpec{
+				Priority: 100,
+				Selector: appo11yv1alpha1.Selector{PortLabel: "precedence-instrument-port"},
+			}},
+		}
+		comp.cluster = []appo11yv1alpha1.InstrumenterObject{cluster}
+		winner, ok := comp.precedence(cluster, namespace).winner(&pod)
+		Expect(ok).To(BeTrue())
+		Expect(winner.GetName()).To(Equal(high.Name))
+	})
+})
+
+var _ = Describe("Instrumenter cleanup", Ordered, func() {
+	const ns = "cleanup"
+	BeforeAll(func() {
+		createNamespace(ns)
+	})
+
+	It("should keep the Instrumenter until its Pods are uninstrumented", func() {
+		instrumented := newTestPod(ns, "instrumented", map[string]string{appo11yv1alpha1.InstrumentedLabel: "instr"})
+		// scheduled Pods are terminated gracefully
+		instrumented.Spec.NodeName = "node"
+		Expect(k8sClient.Create(ctx, instrumented)).To(Succeed())
+		instr := &appo11yv1alpha1.Instrumenter{
+			ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: "instr"},
+			Spec: appo11yv1alpha1.InstrumenterSpec{
+				Selector: appo11yv1alpha1.Selector{PortLabel: "cleanup-instrument-port"},
+			},
+		}
+		Expect(k8sClient.Create(ctx, instr)).To(Succeed())
+		Eventually(func() ([]string, error) {
+			err := k8sClient.Get(ctx, client.ObjectKeyFromObject(instr), instr)
+			return instr.Finalizers, err
+		}, timeout, interval).Should(Equal([]string{cleanupFinalizer}))
+
+		By("waiting for the evicted Pod to be recreated")
+		Expect(k8sClient.Delete(ctx, instr)).To(Succeed())
+		Consistently(func() error {
+			return k8sClient.Get(ctx, client.ObjectKeyFromObject(instr), &appo11yv1alpha1.Instrumenter{})
+		}, time.Second, interval).Should(Succeed())
+		evicted := corev1.Pod{}
+		Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(instrumented), &evicted)).To(Succeed())
+		Expect(evicted.DeletionTimestamp.IsZero()).To(BeFalse())
+
+		By("removing the Instrumenter once the kubelet confirms the Pod termination")
+		Expect(k8sClient.Delete(ctx, &evicted, client.GracePeriodSeconds(0))).To(Succeed())
+		expectNotFound(instr)
+		recreated := corev1.Pod{}
+		Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(instrumented), &recreated)).To(Succeed())
+		Expect(recreated.UID).ToNot(Equal(evicted.UID))
+		Expect(recreated.Labels).ToNot(HaveKey(appo11yv1alpha1.InstrumentedLabel))
+	})
+})
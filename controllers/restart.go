@@ -0,0 +1,263 @@
+/*
+Copyright 2023 Grafana Labs <hello@grafana.com>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	appo11yv1alpha1 "github.com/grafana/ebpf-autoinstrument-operator/api/v1alpha1"
+	"github.com/grafana/ebpf-autoinstrument-operator/pkg/helper/lvl"
+	"github.com/grafana/ebpf-autoinstrument-operator/pkg/owner"
+)
+
+// annotations added to the Pod template of the workloads that are restarted by the operator
+const (
+	// restartedAtAnnotation records when the workload was restarted, in the same way as
+	// "kubectl rollout restart" does
+	restartedAtAnnotation = "grafana.com/restarted-at"
+	// restartedForAnnotation records the instrumentation change that caused the restart, so the
+	// workload isn't restarted again while it is rolling out
+	restartedForAnnotation = "grafana.com/restarted-for"
+)
+
+const (
+	// recreateFinalizer keeps the evicted Pods without owners until the operator recreates them
+	recreateFinalizer = "appo11y.grafana.com/recreate"
+	// recreateAsAnnotation stores the Pod that replaces an evicted Pod without owners
+	recreateAsAnnotation = "grafana.com/recreate-as"
+)
+
+// errEvictionBlocked is returned when a Pod can't be evicted without violating a PodDisruptionBudget
+var errEvictionBlocked = errors.New("eviction blocked by a PodDisruptionBudget")
+
+// errJobOwned is returned when a Pod is owned by a Job, as evicting it might fail the Job
+var errJobOwned = errors.New("the Pods owned by Jobs aren't replaced")
+
+// replacer replaces the Pods by restarting their workload, or by evicting them if they have none.
+// It restarts each workload at most once, so it must be used during a single reconciliation.
+type replacer struct {
+	client.Client
+	restarted map[workloadKey]struct{}
+	// blocked counts the Pods whose eviction was blocked by a PodDisruptionBudget
+	blocked int
+	// pending counts the evicted Pods without owners that are waiting to be recreated
+	pending int
+}
+
+type workloadKey struct {
+	namespace string
+	owner.Ref
+}
+
+func newReplacer(c client.Client) *replacer {
+	return &replacer{Client: c, restarted: map[workloadKey]struct{}{}}
+}
+
+// instrumentReason identifies the restarts caused by the given instrumenter configuration
+func instrumentReason(iq appo11yv1alpha1.InstrumenterObject) string {
+	return fmt.Sprintf("%s/%s/%d", iq.InstrumenterKind(), iq.GetName(), iq.GetGeneration())
+}
+
+// uninstrumentReason identifies the restarts caused by removing the sidecar of the given instrumenter
+func uninstrumentReason(name, kind string) string {
+	return fmt.Sprintf("%s/%s/removed", kind, name)
+}
+
+// replace the provided Pod, either restarting its owning workload or evicting it, and returns the
+// name of the restarted workload, if any. Workloads aren't restarted twice for the same reason.
+func (r *replacer) replace(
+	ctx context.Context, pod *corev1.Pod, owners owner.Chain, reason string, modify func(*corev1.Pod),
+) (string, error) {
+	if _, ok := owners.Find(owner.KindJob); ok {
+		return "", errJobOwned
+	}
+	top, ok := owners.Top()
+	if !ok {
+		return "", r.replacePod(ctx, pod, modify)
+	}
+	workload, template := newWorkload(top.Kind)
+	if workload == nil {
+		return "", r.replacePod(ctx, pod, modify)
+	}
+	key := workloadKey{namespace: pod.Namespace, Ref: top}
+	workloadName := top.Kind + " " + top.Name
+	if _, ok := r.restarted[key]; ok {
+		return workloadName, nil
+	}
+	if err := r.Get(ctx, client.ObjectKey{Namespace: pod.Namespace, Name: top.Name}, workload); err != nil {
+		if apierrors.IsNotFound(err) {
+			// the owner might have been inferred but not be there anymore
+			return "", r.replacePod(ctx, pod, modify)
+		}
+		return "", fmt.Errorf("reading %s %s/%s: %w", top.Kind, pod.Namespace, top.Name, err)
+	}
+	r.restarted[key] = struct{}{}
+	if template.Annotations[restartedForAnnotation] == reason {
+		log.FromContext(ctx).V(lvl.Debug).Info("workload already restarted. Waiting for its rollout",
+			"kind", top.Kind, "name", top.Name, "namespace", pod.Namespace)
+		return workloadName, nil
+	}
+	log.FromContext(ctx).V(lvl.Debug).Info("restarting workload",
+		"kind", top.Kind, "name", top.Name, "namespace", pod.Namespace, "reason", reason)
+	patch := client.MergeFrom(workload.DeepCopyObject().(client.Object))
+	if template.Annotations == nil {
+		template.Annotations = map[string]string{}
+	}
+	template.Annotations[restartedAtAnnotation] = time.Now().Format(time.RFC3339)
+	template.Annotations[restartedForAnnotation] = reason
+	if err := r.Patch(ctx, workload, patch); err != nil {
+		return "", fmt.Errorf("restarting %s %s/%s: %w", top.Kind, pod.Namespace, top.Name, err)
+	}
+	return workloadName, nil
+}
+
+// newWorkload returns an empty workload of the provided kind, as well as a reference to its
+// Pod template, or nil if the kind can't be restarted
+func newWorkload(kind string) (client.Object, *corev1.PodTemplateSpec) {
+	switch kind {
+	case owner.KindDeployment:
+		d := &appsv1.Deployment{}
+		return d, &d.Spec.Template
+	case owner.KindStatefulSet:
+		s := &appsv1.StatefulSet{}
+		return s, &s.Spec.Template
+	case owner.KindDaemonSet:
+		d := &appsv1.DaemonSet{}
+		return d, &d.Spec.Template
+	}
+	return nil, nil
+}
+
+// replacePod evicts the provided Pod. If it has no owners, the modified Pod is stored in it, and
+// a finalizer keeps it until recreatePod replaces it.
+func (r *replacer) replacePod(ctx context.Context, pod *corev1.Pod, modify func(*corev1.Pod)) error {
+	ownerless := len(pod.OwnerReferences) == 0
+	if ownerless {
+		if err := r.markForRecreation(ctx, pod, modify); err != nil {
+			return err
+		}
+	}
+	eviction := &policyv1.Eviction{ObjectMeta: metav1.ObjectMeta{Namespace: pod.Namespace, Name: pod.Name}}
+	if err := r.SubResource("eviction").Create(ctx, pod, eviction); err != nil {
+		if ownerless {
+			r.unmarkForRecreation(ctx, pod)
+		}
+		if apierrors.IsTooManyRequests(err) {
+			r.blocked++
+			return fmt.Errorf("evicting Pod %s/%s: %w", pod.Namespace, pod.Name, errEvictionBlocked)
+		}
+		return fmt.Errorf("evicting Pod %s/%s: %w", pod.Namespace, pod.Name, err)
+	}
+	if ownerless {
+		r.pending++
+	}
+	return nil
+}
+
+// markForRecreation stores the modified Pod in an annotation of the provided Pod, and adds the
+// finalizer that keeps it until it is recreated
+func (r *replacer) markForRecreation(ctx context.Context, pod *corev1.Pod, modify func(*corev1.Pod)) error {
+	recreated := corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Namespace:   pod.Namespace,
+		Name:        pod.Name,
+		Labels:      pod.Labels,
+		Annotations: pod.Annotations,
+	}, Spec: pod.Spec}
+	recreated = *recreated.DeepCopy()
+	delete(recreated.Annotations, recreateAsAnnotation)
+	// the recreated Pod is scheduled again, as its node might have been drained
+	recreated.Spec.NodeName = ""
+	modify(&recreated)
+	spec, err := json.Marshal(&recreated)
+	if err != nil {
+		return fmt.Errorf("storing recreated Pod %s/%s: %w", pod.Namespace, pod.Name, err)
+	}
+	if pod.Annotations == nil {
+		pod.Annotations = map[string]string{}
+	}
+	pod.Annotations[recreateAsAnnotation] = string(spec)
+	controllerutil.AddFinalizer(pod, recreateFinalizer)
+	if err := r.Update(ctx, pod); err != nil {
+		return fmt.Errorf("marking Pod %s/%s for recreation: %w", pod.Namespace, pod.Name, err)
+	}
+	return nil
+}
+
+// unmarkForRecreation reverts markForRecreation when the Pod couldn't be evicted
+func (r *replacer) unmarkForRecreation(ctx context.Context, pod *corev1.Pod) {
+	delete(pod.Annotations, recreateAsAnnotation)
+	controllerutil.RemoveFinalizer(pod, recreateFinalizer)
+	if err := r.Update(ctx, pod); err != nil {
+		log.FromContext(ctx).Error(err, "can't unmark Pod for recreation. Will retry on the next eviction",
+			"podName", pod.Name, "podNamespace", pod.Namespace)
+	}
+}
+
+// recreatePod replaces an evicted Pod without owners by the Pod stored in its annotation, once
+// all its containers are terminated. It returns whether the provided Pod is waiting to be
+// recreated, so it must be left as it is.
+func (r *replacer) recreatePod(ctx context.Context, pod *corev1.Pod) (bool, error) {
+	if !controllerutil.ContainsFinalizer(pod, recreateFinalizer) || pod.DeletionTimestamp.IsZero() {
+		return false, nil
+	}
+	// the kubelet sets a zero grace period once all the containers are terminated
+	if grace := pod.DeletionGracePeriodSeconds; grace == nil || *grace > 0 {
+		r.pending++
+		return true, nil
+	}
+	// the finalizer is kept until the stored Pod is known to be accepted, as it is lost with the evicted Pod
+	recreated := corev1.Pod{}
+	if err := json.Unmarshal([]byte(pod.Annotations[recreateAsAnnotation]), &recreated); err != nil {
+		return true, fmt.Errorf("reading the recreated Pod %s/%s: %w", pod.Namespace, pod.Name, err)
+	}
+	// the evicted Pod must be removed before creating a Pod with the same name, so the recreated Pod
+	// is validated with a generated name
+	probe := recreated.DeepCopy()
+	probe.Name, probe.GenerateName = "", recreated.Name+"-"
+	if err := r.Create(ctx, probe, client.DryRunAll); err != nil {
+		return true, fmt.Errorf("can't recreate Pod %s/%s: %w", pod.Namespace, pod.Name, err)
+	}
+	// removing the finalizer of the terminated Pod removes it, so it can be recreated
+	controllerutil.RemoveFinalizer(pod, recreateFinalizer)
+	if err := r.Update(ctx, pod); err != nil {
+		return true, client.IgnoreNotFound(fmt.Errorf("removing finalizer from Pod %s/%s: %w",
+			pod.Namespace, pod.Name, err))
+	}
+	log.FromContext(ctx).V(lvl.Debug).Info("Recreating pod", "podName", pod.Name, "podNamespace", pod.Namespace)
+	if err := retry.OnError(retry.DefaultBackoff, func(err error) bool {
+		return !apierrors.IsAlreadyExists(err)
+	}, func() error {
+		return r.Create(ctx, recreated.DeepCopy())
+	}); err != nil && !apierrors.IsAlreadyExists(err) {
+		return true, fmt.Errorf("can't recreate Pod %s/%s: %w", pod.Namespace, pod.Name, err)
+	}
+	return true, nil
+}
@@ -0,0 +1,155 @@
+/*
+Copyright 2023 Grafana Labs <hello@grafana.com>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/grafana/ebpf-autoinstrument-operator/pkg/owner"
+)
+
+var _ = Describe("Replacer", Ordered, func() {
+	const ns = "replacer"
+	BeforeAll(func() {
+		createNamespace(ns)
+	})
+
+	It("should restart each workload once", func() {
+		labels := map[string]string{"app": "backend"}
+		deployment := appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: "backend"},
+			Spec: appsv1.DeploymentSpec{
+				Selector: &metav1.LabelSelector{MatchLabels: labels},
+				Template: corev1.PodTemplateSpec{
+					ObjectMeta: metav1.ObjectMeta{Labels: labels},
+					Spec:       newTestPod(ns, "", nil).Spec,
+				},
+			},
+		}
+		Expect(k8sClient.Create(ctx, &deployment)).To(Succeed())
+		owners := owner.Chain{{Kind: owner.KindReplicaSet, Name: "backend-5d4f8c"}, {Kind: owner.KindDeployment, Name: "backend"}}
+		var pods []*corev1.Pod
+		for _, name := range []string{"backend-5d4f8c-aaaaa", "backend-5d4f8c-bbbbb"} {
+			pod := newTestPod(ns, name, labels)
+			Expect(k8sClient.Create(ctx, pod)).To(Succeed())
+			pods = append(pods, pod)
+		}
+
+		rp := newReplacer(k8sClient)
+		for _, pod := range pods {
+			Expect(rp.replace(ctx, pod, owners, "Instrumenter/foo/1", nil)).To(Equal("Deployment backend"))
+		}
+		Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(&deployment), &deployment)).To(Succeed())
+		Expect(deployment.Spec.Template.Annotations).To(HaveKeyWithValue(restartedForAnnotation, "Instrumenter/foo/1"))
+		Expect(deployment.Spec.Template.Annotations).To(HaveKey(restartedAtAnnotation))
+		By("leaving the Pods to the Deployment rollout")
+		for _, pod := range pods {
+			Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(pod), pod)).To(Succeed())
+			Expect(pod.DeletionTimestamp.IsZero()).To(BeTrue())
+		}
+
+		By("not restarting the workload again for the same reason")
+		deployment.Spec.Template.Annotations[restartedAtAnnotation] = "previous"
+		Expect(k8sClient.Update(ctx, &deployment)).To(Succeed())
+		Expect(newReplacer(k8sClient).replace(ctx, pods[0], owners, "Instrumenter/foo/1", nil)).
+			To(Equal("Deployment backend"))
+		Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(&deployment), &deployment)).To(Succeed())
+		Expect(deployment.Spec.Template.Annotations).To(HaveKeyWithValue(restartedAtAnnotation, "previous"))
+	})
+
+	It("should not replace the Pods owned by Jobs, as evicting them might fail the Job", func() {
+		pod := newTestPod(ns, "report-2789-xxxxx", nil)
+		pod.OwnerReferences = []metav1.OwnerReference{{
+			APIVersion: "batch/v1", Kind: owner.KindJob, Name: "report-2789", UID: "1234",
+		}}
+		Expect(k8sClient.Create(ctx, pod)).To(Succeed())
+
+		workload, err := newReplacer(k8sClient).replace(ctx, pod,
+			owner.Chain{{Kind: owner.KindJob, Name: "report-2789"}}, "r", nil)
+		Expect(err).To(MatchError(errJobOwned))
+		Expect(workload).To(BeEmpty())
+		Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(pod), pod)).To(Succeed())
+		Expect(pod.DeletionTimestamp.IsZero()).To(BeTrue())
+	})
+
+	It("should recreate the evicted Pods without owners once they are terminated", func() {
+		ownerless := newTestPod(ns, "standalone", nil)
+		// scheduled Pods are terminated gracefully
+		ownerless.Spec.NodeName = "node"
+		Expect(k8sClient.Create(ctx, ownerless)).To(Succeed())
+
+		rp := newReplacer(k8sClient)
+		Expect(rp.replace(ctx, ownerless, nil, "r", func(pod *corev1.Pod) {
+			pod.Labels = map[string]string{"modified": "true"}
+		})).To(BeEmpty())
+		By("keeping the evicted Pod while it terminates")
+		evicted := corev1.Pod{}
+		Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(ownerless), &evicted)).To(Succeed())
+		Expect(evicted.DeletionTimestamp.IsZero()).To(BeFalse())
+		Expect(evicted.Labels).ToNot(HaveKey("modified"))
+		Expect(rp.recreatePod(ctx, &evicted)).To(BeTrue())
+		Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(ownerless), &evicted)).To(Succeed())
+		Expect(evicted.DeletionTimestamp.IsZero()).To(BeFalse())
+
+		By("recreating the modified Pod once the kubelet confirms its termination")
+		Expect(k8sClient.Delete(ctx, &evicted, client.GracePeriodSeconds(0))).To(Succeed())
+		Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(ownerless), &evicted)).To(Succeed())
+		Expect(rp.recreatePod(ctx, &evicted)).To(BeTrue())
+		recreated := corev1.Pod{}
+		Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(ownerless), &recreated)).To(Succeed())
+		Expect(recreated.UID).ToNot(Equal(evicted.UID))
+		Expect(recreated.DeletionTimestamp.IsZero()).To(BeTrue())
+		Expect(recreated.Labels).To(HaveKeyWithValue("modified", "true"))
+		Expect(recreated.Finalizers).To(BeEmpty())
+		Expect(recreated.Annotations).ToNot(HaveKey(recreateAsAnnotation))
+		Expect(recreated.Spec.NodeName).To(BeEmpty())
+	})
+
+	It("should keep the Pods whose eviction is blocked by a PodDisruptionBudget", func() {
+		labels := map[string]string{"app": "protected"}
+		pod := newTestPod(ns, "protected", labels)
+		Expect(k8sClient.Create(ctx, pod)).To(Succeed())
+		// the PodDisruptionBudgets don't protect the Pods that aren't running
+		pod.Status.Phase = corev1.PodRunning
+		Expect(k8sClient.Status().Update(ctx, pod)).To(Succeed())
+		pdb := policyv1.PodDisruptionBudget{
+			ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: "protected"},
+			Spec: policyv1.PodDisruptionBudgetSpec{
+				MinAvailable: &intstr.IntOrString{IntVal: 1},
+				Selector:     &metav1.LabelSelector{MatchLabels: labels},
+			},
+		}
+		Expect(k8sClient.Create(ctx, &pdb)).To(Succeed())
+
+		rp := newReplacer(k8sClient)
+		_, err := rp.replace(ctx, pod, nil, "r", func(*corev1.Pod) {})
+		Expect(err).To(MatchError(errEvictionBlocked))
+		Expect(rp.blocked).To(Equal(1))
+		kept := corev1.Pod{}
+		Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(pod), &kept)).To(Succeed())
+		Expect(kept.DeletionTimestamp.IsZero()).To(BeTrue())
+		Expect(kept.Finalizers).To(BeEmpty())
+		Expect(kept.Annotations).ToNot(HaveKey(recreateAsAnnotation))
+	})
+})
@@ -0,0 +1,93 @@
+/*
+Copyright 2023 Grafana Labs <hello@grafana.com>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	appo11yv1alpha1 "github.com/grafana/ebpf-autoinstrument-operator/api/v1alpha1"
+)
+
+// sidecarConfigLabel identifies the ConfigMaps with the configuration file of the sidecars of the
+// instrumenter whose name is the label value. It differs from the node agent labels, so the
+// ConfigMaps aren't removed with the node agent resources.
+const sidecarConfigLabel = "appo11y.grafana.com/sidecar-config-of"
+
+// errUnmanagedConfigMap is returned when the sidecar configuration would overwrite a ConfigMap
+// that wasn't created by the operator
+var errUnmanagedConfigMap = errors.New("a ConfigMap with the same name already exists, and it isn't managed by the operator")
+
+func sidecarConfigLabels(name, kind, namespace string) map[string]string {
+	return map[string]string{
+		managedByLabel:        managedByOperator,
+		sidecarConfigLabel:    name,
+		instrumenterKindLabel: kind,
+		instrumenterNsLabel:   namespace,
+	}
+}
+
+// reconcileSidecarConfig creates or updates, in the given namespace, the ConfigMap with the
+// configuration file of the instrumenter sidecars. If the sidecars in that namespace don't
+// require it, it removes any ConfigMap that was previously created there.
+func reconcileSidecarConfig(
+	ctx context.Context, c client.Client, scheme *runtime.Scheme, iq appo11yv1alpha1.InstrumenterObject,
+	namespace string, required bool,
+) error {
+	labels := sidecarConfigLabels(iq.GetName(), iq.InstrumenterKind(), iq.GetNamespace())
+	name, file, ok := appo11yv1alpha1.SidecarConfig(iq)
+	if !ok || !required {
+		return removeSidecarConfig(ctx, c, labels, namespace)
+	}
+	configMap := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace}}
+	if _, err := controllerutil.CreateOrUpdate(ctx, c, configMap, func() error {
+		if configMap.ResourceVersion != "" && configMap.Labels[managedByLabel] != managedByOperator {
+			return errUnmanagedConfigMap
+		}
+		configMap.Labels = labels
+		configMap.Data = map[string]string{appo11yv1alpha1.BeylaConfigFile: string(file)}
+		// namespaced resources can be owned by both Instrumenters and ClusterInstrumenters
+		return controllerutil.SetControllerReference(iq, configMap, scheme)
+	}); err != nil {
+		if errors.Is(err, errUnmanagedConfigMap) {
+			return invalidSpecError{err: fmt.Errorf("ConfigMap %s/%s: %w", namespace, name, err)}
+		}
+		return fmt.Errorf("reconciling ConfigMap %s/%s: %w", namespace, name, err)
+	}
+	return nil
+}
+
+func removeSidecarConfig(ctx context.Context, c client.Client, labels map[string]string, namespace string) error {
+	configMaps := corev1.ConfigMapList{}
+	if err := c.List(ctx, &configMaps, client.MatchingLabels(labels), client.InNamespace(namespace)); err != nil {
+		return fmt.Errorf("reading ConfigMaps: %w", err)
+	}
+	for i := range configMaps.Items {
+		if err := c.Delete(ctx, &configMaps.Items[i]); err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("removing ConfigMap %s/%s: %w", namespace, configMaps.Items[i].Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+/*
+Copyright 2023 Grafana Labs <hello@grafana.com>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	appo11yv1alpha1 "github.com/grafana/ebpf-autoinstrument-operator/api/v1alpha1"
+)
+
+var _ = Describe("Sidecar configuration", Ordered, func() {
+	const ns = "sidecar-config"
+	BeforeAll(func() {
+		createNamespace(ns)
+	})
+
+	It("should be stored in a ConfigMap owned by the instrumenter", func() {
+		// the ClusterInstrumenter isn't stored, so it isn't reconciled by the suite manager
+		instr := &appo11yv1alpha1.ClusterInstrumenter{
+			ObjectMeta: metav1.ObjectMeta{Name: "instr", UID: "1234"},
+			Spec: appo11yv1alpha1.ClusterInstrumenterSpec{InstrumenterSpec: appo11yv1alpha1.InstrumenterSpec{
+				Beyla: &appo11yv1alpha1.BeylaConfig{LogLevel: "DEBUG"},
+			}},
+		}
+		Expect(reconcileSidecarConfig(ctx, k8sClient, scheme.Scheme, instr, ns, true)).To(Succeed())
+		name, _, _ := appo11yv1alpha1.SidecarConfig(instr)
+		cm := &corev1.ConfigMap{}
+		Expect(k8sClient.Get(ctx, client.ObjectKey{Namespace: ns, Name: name}, cm)).To(Succeed())
+		Expect(cm.Data).To(HaveKeyWithValue(appo11yv1alpha1.BeylaConfigFile, "log_level: DEBUG\n"))
+		Expect(cm.OwnerReferences).To(HaveLen(1))
+		Expect(cm.OwnerReferences[0].UID).To(BeEquivalentTo("1234"))
+
+		By("updating the ConfigMap with the configuration")
+		instr.Spec.Beyla.LogLevel = "INFO"
+		Expect(reconcileSidecarConfig(ctx, k8sClient, scheme.Scheme, instr, ns, true)).To(Succeed())
+		Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(cm), cm)).To(Succeed())
+		Expect(cm.Data).To(HaveKeyWithValue(appo11yv1alpha1.BeylaConfigFile, "log_level: INFO\n"))
+
+		By("removing the ConfigMap when the namespace is deselected")
+		Expect(reconcileSidecarConfig(ctx, k8sClient, scheme.Scheme, instr, ns, false)).To(Succeed())
+		expectNotFound(cm)
+	})
+
+	It("should not overwrite the ConfigMaps that aren't managed by the operator", func() {
+		instr := &appo11yv1alpha1.Instrumenter{
+			ObjectMeta: metav1.ObjectMeta{Name: "instr", Namespace: ns, UID: "1234"},
+			Spec: appo11yv1alpha1.InstrumenterSpec{
+				Beyla: &appo11yv1alpha1.BeylaConfig{LogLevel: "DEBUG"},
+			},
+		}
+		name, _, _ := appo11yv1alpha1.SidecarConfig(instr)
+		users := &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: ns},
+			Data:       map[string]string{"app.properties": "debug=true"},
+		}
+		Expect(k8sClient.Create(ctx, users)).To(Succeed())
+
+		err := reconcileSidecarConfig(ctx, k8sClient, scheme.Scheme, instr, ns, true)
+		Expect(err).To(BeAssignableToTypeOf(invalidSpecError{}))
+		cm := &corev1.ConfigMap{}
+		Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(users), cm)).To(Succeed())
+		Expect(cm.Data).To(Equal(map[string]string{"app.properties": "debug=true"}))
+		Expect(cm.OwnerReferences).To(BeEmpty())
+	})
+})
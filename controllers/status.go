@@ -0,0 +1,333 @@
+/*
+Copyright 2023 Grafana Labs <hello@grafana.com>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	appo11yv1alpha1 "github.com/grafana/ebpf-autoinstrument-operator/api/v1alpha1"
+)
+
+// reasons of the instrumenter status conditions
+const (
+	reasonAllInstrumented = "AllPodsInstrumented"
+	reasonNoMatchingPods  = "NoMatchingPods"
+	reasonPodsPending     = "PodsPending"
+	reasonPodsFailed      = "SidecarFailing"
+	reasonReconcileError  = "ReconcileError"
+	reasonRollingOut      = "RollingOut"
+	reasonRolloutComplete = "RolloutComplete"
+	reasonNoFailures      = "NoFailures"
+	reasonBlockedByPDB    = "BlockedByPDB"
+	reasonAnnotationsKept = "PodAnnotationsKept"
+	reasonNoConflicts     = "NoConflicts"
+	reasonWebhookMissed   = "AdmittedWithoutSidecar"
+	reasonNoMissed        = "NoMissedAdmissions"
+	reasonLowerPrecedence = "LowerPrecedence"
+	reasonNoContested     = "NoContestedPods"
+)
+
+// maxContestedPods is the maximum number of contested Pods listed in the Conflicting condition
+const maxContestedPods = 10
+
+// sidecar container waiting reasons that are considered as a failure
+var failedWaitingReasons = map[string]struct{}{
+	"CrashLoopBackOff":           {},
+	"ImagePullBackOff":           {},
+	"ErrImagePull":               {},
+	"InvalidImageName":           {},
+	"CreateContainerConfigError": {},
+	"CreateContainerError":       {},
+	"RunContainerError":          {},
+}
+
+// inventory accumulates the instrumentation state of the Pods matched by an instrumenter
+type inventory struct {
+	pods []appo11yv1alpha1.PodReference
+	// blockedEvictions counts the Pods that couldn't be evicted because of a PodDisruptionBudget
+	blockedEvictions int
+	// prometheusConflicts counts the Pods that keep their own Prometheus scrape annotations
+	prometheusConflicts int
+	// missedAdmissions counts the Pods that were admitted without the instrumenter sidecar
+	missedAdmissions int
+	// contested lists the selected Pods that are left to instrumenters with higher precedence
+	contested []string
+	// requeueAfter is the time after which the instrumenter needs to be reconciled again, if not zero
+	requeueAfter time.Duration
+}
+
+func (inv *inventory) add(pod *corev1.Pod, state appo11yv1alpha1.PodState, message string) {
+	inv.pods = append(inv.pods, appo11yv1alpha1.PodReference{
+		Name:      pod.Name,
+		Namespace: pod.Namespace,
+		State:     state,
+		Message:   message,
+	})
+}
+
+// addInstrumented adds a Pod that already has an up-to-date instrumenter sidecar, checking
+// whether the sidecar container is failing
+func (inv *inventory) addInstrumented(pod *corev1.Pod) {
+	status, ok := appo11yv1alpha1.SidecarStatus(pod)
+	switch {
+	case !ok:
+		inv.add(pod, appo11yv1alpha1.PodInstrumented, "")
+	case status.State.Waiting != nil:
+		if _, failed := failedWaitingReasons[status.State.Waiting.Reason]; failed {
+			inv.add(pod, appo11yv1alpha1.PodFailed,
+				fmt.Sprintf("%s: %s", status.State.Waiting.Reason, status.State.Waiting.Message))
+		} else {
+			inv.add(pod, appo11yv1alpha1.PodInstrumented, "")
+		}
+	case status.State.Terminated != nil && status.State.Terminated.ExitCode != 0:
+		inv.add(pod, appo11yv1alpha1.PodFailed,
+			fmt.Sprintf("sidecar terminated with exit code %d: %s",
+				status.State.Terminated.ExitCode, status.State.Terminated.Reason))
+	default:
+		inv.add(pod, appo11yv1alpha1.PodInstrumented, "")
+	}
+}
+
+// requeueIn schedules a new reconciliation after the provided duration, unless an earlier
+// reconciliation is already scheduled
+func (inv *inventory) requeueIn(after time.Duration) {
+	if inv.requeueAfter == 0 || after < inv.requeueAfter {
+		inv.requeueAfter = after
+	}
+}
+
+// addContested records a selected Pod that is left to the winner instrumenter, which takes precedence
+func (inv *inventory) addContested(pod *corev1.Pod, winner appo11yv1alpha1.InstrumenterObject) {
+	inv.contested = append(inv.contested, fmt.Sprintf("%s/%s (%s %s)",
+		pod.Namespace, pod.Name, winner.InstrumenterKind(), winner.GetName()))
+}
+
+// checkPrometheusConflict counts the Pod if it keeps its own Prometheus scrape annotations
+func (inv *inventory) checkPrometheusConflict(iq appo11yv1alpha1.InstrumenterObject, pod *corev1.Pod) {
+	if appo11yv1alpha1.PrometheusConflict(iq, pod) {
+		inv.prometheusConflicts++
+	}
+}
+
+var podStateOrder = map[appo11yv1alpha1.PodState]int{
+	appo11yv1alpha1.PodFailed:       0,
+	appo11yv1alpha1.PodPending:      1,
+	appo11yv1alpha1.PodInstrumented: 2,
+}
+
+// applyTo updates the provided status with the inventoried Pods, as well as the
+// result of the reconciliation
+func (inv *inventory) applyTo(status *appo11yv1alpha1.InstrumenterStatus, generation int64, reconcileErr error) {
+	status.ObservedGeneration = generation
+	status.MatchedPods, status.InstrumentedPods, status.PendingPods, status.FailedPods = 0, 0, 0, 0
+	for i := range inv.pods {
+		status.MatchedPods++
+		switch inv.pods[i].State {
+		case appo11yv1alpha1.PodInstrumented:
+			status.InstrumentedPods++
+		case appo11yv1alpha1.PodPending:
+			status.PendingPods++
+		case appo11yv1alpha1.PodFailed:
+			status.FailedPods++
+		}
+	}
+
+	// sorting Pods to provide a stable status, showing first the Pods that require attention
+	sort.Slice(inv.pods, func(i, j int) bool {
+		pi, pj := &inv.pods[i], &inv.pods[j]
+		if pi.State != pj.State {
+			return podStateOrder[pi.State] < podStateOrder[pj.State]
+		}
+		if pi.Namespace != pj.Namespace {
+			return pi.Namespace < pj.Namespace
+		}
+		return pi.Name < pj.Name
+	})
+	status.Pods = inv.pods
+	if len(status.Pods) > appo11yv1alpha1.MaxStatusPods {
+		status.Pods = status.Pods[:appo11yv1alpha1.MaxStatusPods]
+	}
+
+	setConditions(status, generation, inv.blockedEvictions, reconcileErr)
+	setPrometheusConflictCondition(status, generation, inv.prometheusConflicts)
+	setMissedAdmissionCondition(status, generation, inv.missedAdmissions)
+	setConflictingCondition(status, generation, inv.contested)
+}
+
+func setConflictingCondition(status *appo11yv1alpha1.InstrumenterStatus, generation int64, contested []string) {
+	cond := metav1.Condition{Type: appo11yv1alpha1.ConditionConflicting, ObservedGeneration: generation}
+	if len(contested) > 0 {
+		sort.Strings(contested)
+		listed := contested
+		if len(listed) > maxContestedPods {
+			listed = listed[:maxContestedPods]
+		}
+		cond.Status = metav1.ConditionTrue
+		cond.Reason = reasonLowerPrecedence
+		cond.Message = fmt.Sprintf("%d selected Pods are instrumented by other instrumenters that take "+
+			"precedence: %s", len(contested), strings.Join(listed, ", "))
+		if len(contested) > len(listed) {
+			cond.Message += fmt.Sprintf(" and %d more", len(contested)-len(listed))
+		}
+	} else {
+		cond.Status = metav1.ConditionFalse
+		cond.Reason = reasonNoContested
+	}
+	meta.SetStatusCondition(&status.Conditions, cond)
+}
+
+func setMissedAdmissionCondition(status *appo11yv1alpha1.InstrumenterStatus, generation int64, missed int) {
+	cond := metav1.Condition{Type: appo11yv1alpha1.ConditionMissedAdmission, ObservedGeneration: generation}
+	if missed > 0 {
+		cond.Status = metav1.ConditionTrue
+		cond.Reason = reasonWebhookMissed
+		cond.Message = fmt.Sprintf("%d Pods were admitted without the instrumenter sidecar, probably "+
+			"because the webhook was unavailable. They are being evicted to be recreated with it", missed)
+	} else {
+		cond.Status = metav1.ConditionFalse
+		cond.Reason = reasonNoMissed
+	}
+	meta.SetStatusCondition(&status.Conditions, cond)
+}
+
+func setPrometheusConflictCondition(status *appo11yv1alpha1.InstrumenterStatus, generation int64, conflicts int) {
+	cond := metav1.Condition{Type: appo11yv1alpha1.ConditionPrometheusConflict, ObservedGeneration: generation}
+	if conflicts > 0 {
+		cond.Status = metav1.ConditionTrue
+		cond.Reason = reasonAnnotationsKept
+		cond.Message = fmt.Sprintf("%d Pods define their own Prometheus scrape annotations, so the "+
+			"autoinstrumenter metrics are not annotated for scraping. Consider setting the "+
+			"prometheus.onAnnotationConflict property to UseAlternative", conflicts)
+	} else {
+		cond.Status = metav1.ConditionFalse
+		cond.Reason = reasonNoConflicts
+	}
+	meta.SetStatusCondition(&status.Conditions, cond)
+}
+
+func setConditions(
+	status *appo11yv1alpha1.InstrumenterStatus, generation int64, blockedEvictions int, reconcileErr error,
+) {
+	progressing := metav1.Condition{Type: appo11yv1alpha1.ConditionProgressing, ObservedGeneration: generation}
+	switch {
+	case blockedEvictions > 0:
+		// the rollout is stalled until the PodDisruptionBudgets allow evicting more Pods
+		progressing.Status = metav1.ConditionTrue
+		progressing.Reason = reasonBlockedByPDB
+		progressing.Message = fmt.Sprintf("eviction of %d Pods blocked by PodDisruptionBudgets", blockedEvictions)
+	case status.PendingPods > 0:
+		progressing.Status = metav1.ConditionTrue
+		progressing.Reason = reasonRollingOut
+		progressing.Message = fmt.Sprintf("%d Pods pending to be instrumented", status.PendingPods)
+	default:
+		progressing.Status = metav1.ConditionFalse
+		progressing.Reason = reasonRolloutComplete
+	}
+	meta.SetStatusCondition(&status.Conditions, progressing)
+
+	degraded := metav1.Condition{Type: appo11yv1alpha1.ConditionDegraded, ObservedGeneration: generation}
+	switch {
+	case reconcileErr != nil:
+		degraded.Status = metav1.ConditionTrue
+		degraded.Reason = reasonReconcileError
+		degraded.Message = reconcileErr.Error()
+	case status.FailedPods > 0:
+		degraded.Status = metav1.ConditionTrue
+		degraded.Reason = reasonPodsFailed
+		degraded.Message = fmt.Sprintf("instrumenter sidecar is failing in %d Pods", status.FailedPods)
+	default:
+		degraded.Status = metav1.ConditionFalse
+		degraded.Reason = reasonNoFailures
+	}
+	meta.SetStatusCondition(&status.Conditions, degraded)
+
+	ready := metav1.Condition{Type: appo11yv1alpha1.ConditionReady, ObservedGeneration: generation}
+	switch {
+	case reconcileErr != nil:
+		ready.Status = metav1.ConditionFalse
+		ready.Reason = reasonReconcileError
+		ready.Message = reconcileErr.Error()
+	case status.FailedPods > 0:
+		ready.Status = metav1.ConditionFalse
+		ready.Reason = reasonPodsFailed
+		ready.Message = fmt.Sprintf("%d of %d Pods failed", status.FailedPods, status.MatchedPods)
+	case status.PendingPods > 0:
+		ready.Status = metav1.ConditionFalse
+		ready.Reason = reasonPodsPending
+		ready.Message = fmt.Sprintf("%d of %d Pods pending", status.PendingPods, status.MatchedPods)
+	case status.MatchedPods == 0:
+		ready.Status = metav1.ConditionTrue
+		ready.Reason = reasonNoMatchingPods
+	default:
+		ready.Status = metav1.ConditionTrue
+		ready.Reason = reasonAllInstrumented
+		ready.Message = fmt.Sprintf("%d Pods instrumented", status.InstrumentedPods)
+	}
+	meta.SetStatusCondition(&status.Conditions, ready)
+}
+
+// invalidSpecError wraps the errors caused by an invalid instrumenter specification, which
+// won't be fixed by retrying the reconciliation, so they are just reported in the status
+type invalidSpecError struct {
+	err error
+}
+
+func (e invalidSpecError) Error() string {
+	return e.err.Error()
+}
+
+func (e invalidSpecError) Unwrap() error {
+	return e.err
+}
+
+// retryable returns the provided reconciliation error, unless it can't be fixed by retrying
+func retryable(ctx context.Context, err error) error {
+	if ise := (invalidSpecError{}); errors.As(err, &ise) {
+		log.FromContext(ctx).Error(err, "invalid instrumenter specification")
+		return nil
+	}
+	return err
+}
+
+// updateStatus stores in the instrumenter status the inventoried Pods and the reconciliation result.
+// The status is only written if it has changed.
+func updateStatus(
+	ctx context.Context, c client.Client, iq appo11yv1alpha1.InstrumenterObject,
+	inv *inventory, reconcileErr error,
+) error {
+	prev := iq.GetStatus().DeepCopy()
+	inv.applyTo(iq.GetStatus(), iq.GetGeneration(), reconcileErr)
+	if equality.Semantic.DeepEqual(prev, iq.GetStatus()) {
+		return nil
+	}
+	if err := c.Status().Update(ctx, iq); err != nil {
+		return fmt.Errorf("updating status: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+/*
+Copyright 2023 Grafana Labs <hello@grafana.com>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	appo11yv1alpha1 "github.com/grafana/ebpf-autoinstrument-operator/api/v1alpha1"
+)
+
+func TestInventory_ApplyTo(t *testing.T) {
+	inv := inventory{}
+	inv.addInstrumented(testPod("ns1", "instrumented"))
+	inv.add(testPod("ns2", "pending"), appo11yv1alpha1.PodPending, "")
+	failing := testPod("ns1", "failing")
+	failing.Status.ContainerStatuses = []corev1.ContainerStatus{{
+		Name:  "grafana-ebpf-autoinstrumenter",
+		State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "CrashLoopBackOff"}},
+	}}
+	inv.addInstrumented(failing)
+
+	status := appo11yv1alpha1.InstrumenterStatus{}
+	inv.applyTo(&status, 3, nil)
+
+	if status.ObservedGeneration != 3 {
+		t.Errorf("expected observed generation 3. Got %d", status.ObservedGeneration)
+	}
+	if status.MatchedPods != 3 || status.InstrumentedPods != 1 || status.PendingPods != 1 || status.FailedPods != 1 {
+		t.Errorf("unexpected pod counters: %+v", status)
+	}
+	// failed and pending pods must be listed first
+	var names []string
+	for _, p := range status.Pods {
+		names = append(names, p.Name)
+	}
+	if fmt.Sprint(names) != "[failing pending instrumented]" {
+		t.Errorf("unexpected pods order: %v", names)
+	}
+	assertCondition(t, &status, appo11yv1alpha1.ConditionReady, metav1.ConditionFalse, reasonPodsFailed)
+	assertCondition(t, &status, appo11yv1alpha1.ConditionDegraded, metav1.ConditionTrue, reasonPodsFailed)
+	assertCondition(t, &status, appo11yv1alpha1.ConditionProgressing, metav1.ConditionTrue, reasonRollingOut)
+}
+
+func TestInventory_ApplyTo_AllInstrumented(t *testing.T) {
+	inv := inventory{}
+	for i := 0; i < appo11yv1alpha1.MaxStatusPods+10; i++ {
+		inv.addInstrumented(testPod("ns", fmt.Sprintf("pod-%03d", i)))
+	}
+	status := appo11yv1alpha1.InstrumenterStatus{}
+	inv.applyTo(&status, 1, nil)
+
+	if status.MatchedPods != appo11yv1alpha1.MaxStatusPods+10 {
+		t.Errorf("unexpected matched pods: %d", status.MatchedPods)
+	}
+	if len(status.Pods) != appo11yv1alpha1.MaxStatusPods {
+		t.Errorf("expected the pods list to be truncated to %d. Got %d", appo11yv1alpha1.MaxStatusPods, len(status.Pods))
+	}
+	assertCondition(t, &status, appo11yv1alpha1.ConditionReady, metav1.ConditionTrue, reasonAllInstrumented)
+	assertCondition(t, &status, appo11yv1alpha1.ConditionDegraded, metav1.ConditionFalse, reasonNoFailures)
+	assertCondition(t, &status, appo11yv1alpha1.ConditionProgressing, metav1.ConditionFalse, reasonRolloutComplete)
+}
+
+func TestInventory_ApplyTo_ReconcileError(t *testing.T) {
+	status := appo11yv1alpha1.InstrumenterStatus{}
+	(&inventory{}).applyTo(&status, 1, errors.New("boom"))
+	assertCondition(t, &status, appo11yv1alpha1.ConditionReady, metav1.ConditionFalse, reasonReconcileError)
+	assertCondition(t, &status, appo11yv1alpha1.ConditionDegraded, metav1.ConditionTrue, reasonReconcileError)
+}
+
+func TestInventory_ApplyTo_BlockedByPDB(t *testing.T) {
+	inv := inventory{blockedEvictions: 1}
+	inv.add(testPod("ns", "db-0"), appo11yv1alpha1.PodPending, "eviction blocked by a PodDisruptionBudget")
+	status := appo11yv1alpha1.InstrumenterStatus{}
+	inv.applyTo(&status, 1, nil)
+	assertCondition(t, &status, appo11yv1alpha1.ConditionProgressing, metav1.ConditionTrue, reasonBlockedByPDB)
+	assertCondition(t, &status, appo11yv1alpha1.ConditionReady, metav1.ConditionFalse, reasonPodsPending)
+}
+
+func TestInventory_ApplyTo_PrometheusConflict(t *testing.T) {
+	status := appo11yv1alpha1.InstrumenterStatus{}
+	(&inventory{}).applyTo(&status, 1, nil)
+	assertCondition(t, &status, appo11yv1alpha1.ConditionPrometheusConflict, metav1.ConditionFalse, reasonNoConflicts)
+
+	(&inventory{prometheusConflicts: 2}).applyTo(&status, 2, nil)
+	assertCondition(t, &status, appo11yv1alpha1.ConditionPrometheusConflict, metav1.ConditionTrue, reasonAnnotationsKept)
+}
+
+func TestInventory_ApplyTo_Conflicting(t *testing.T) {
+	status := appo11yv1alpha1.InstrumenterStatus{}
+	(&inventory{}).applyTo(&status, 1, nil)
+	assertCondition(t, &status, appo11yv1alpha1.ConditionConflicting, metav1.ConditionFalse, reasonNoContested)
+
+	inv := inventory{}
+	winner := &appo11yv1alpha1.Instrumenter{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "winner"}}
+	for i := 0; i < maxContestedPods+2; i++ {
+		inv.addContested(testPod("ns", fmt.Sprintf("pod-%02d", i)), winner)
+	}
+	inv.applyTo(&status, 2, nil)
+	assertCondition(t, &status, appo11yv1alpha1.ConditionConflicting, metav1.ConditionTrue, reasonLowerPrecedence)
+	cond := meta.FindStatusCondition(status.Conditions, appo11yv1alpha1.ConditionConflicting)
+	if !strings.HasPrefix(cond.Message, "12 selected Pods") ||
+		!strings.Contains(cond.Message, "ns/pod-00 (Instrumenter winner)") ||
+		strings.Contains(cond.Message, "pod-10") || !strings.HasSuffix(cond.Message, "and 2 more") {
+		t.Errorf("unexpected condition message: %s", cond.Message)
+	}
+}
+
+func testPod(namespace, name string) *corev1.Pod {
+	return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name}}
+}
+
+func assertCondition(
+	t *testing.T, status *appo11yv1alpha1.InstrumenterStatus,
+	condType string, expectedStatus metav1.ConditionStatus, expectedReason string,
+) {
+	t.Helper()
+	cond := meta.FindStatusCondition(status.Conditions, condType)
+	if cond == nil {
+		t.Fatalf("condition %s not found in %+v", condType, status.Conditions)
+	}
+	if cond.Status != expectedStatus || cond.Reason != expectedReason {
+		t.Errorf("expected condition %s to be %s (%s). Got %s (%s)",
+			condType, expectedStatus, expectedReason, cond.Status, cond.Reason)
+	}
+}
+
+func expectCondition(
+	status *appo11yv1alpha1.InstrumenterStatus,
+	condType string, expectedStatus metav1.ConditionStatus, expectedReason string,
+) {
+	cond := meta.FindStatusCondition(status.Conditions, condType)
+	ExpectWithOffset(1, cond).ToNot(BeNil(), "condition %s not found in %+v", condType, status.Conditions)
+	ExpectWithOffset(1, cond.Status).To(Equal(expectedStatus))
+	ExpectWithOffset(1, cond.Reason).To(Equal(expectedReason))
+}
+
+var _ = Describe("Instrumenter status", func() {
+	It("should only be written when it changes", func() {
+		instr := appo11yv1alpha1.Instrumenter{
+			ObjectMeta: metav1.ObjectMeta{Name: "status-instrumenter", Namespace: defaultNS},
+			Spec: appo11yv1alpha1.InstrumenterSpec{
+				Selector: appo11yv1alpha1.Selector{PortLabel: "status-instrument-port"},
+			},
+		}
+		Expect(k8sClient.Create(ctx, &instr)).To(Succeed())
+		By("waiting for the reconciler to report the Instrumenter without Pods as Ready")
+		Eventually(func() error {
+			if err := k8sClient.Get(ctx, client.ObjectKeyFromObject(&instr), &instr); err != nil {
+				return err
+			}
+			if !meta.IsStatusConditionTrue(instr.Status.Conditions, appo11yv1alpha1.ConditionReady) {
+				return fmt.Errorf("expecting Ready condition. Got %+v", instr.Status.Conditions)
+			}
+			return nil
+		}, timeout, interval).Should(Succeed())
+
+		version := instr.ResourceVersion
+		Expect(updateStatus(ctx, k8sClient, &instr, &inventory{}, nil)).To(Succeed())
+		Expect(instr.ResourceVersion).To(Equal(version))
+
+		Expect(updateStatus(ctx, k8sClient, &instr, &inventory{}, errors.New("reconcile failed"))).To(Succeed())
+		Expect(instr.ResourceVersion).ToNot(Equal(version))
+
+		Expect(k8sClient.Delete(ctx, &instr)).To(Succeed())
+		expectNotFound(&instr)
+	})
+})
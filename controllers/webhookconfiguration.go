@@ -0,0 +1,205 @@
+/*
+Copyright 2023 Grafana Labs <hello@grafana.com>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	admissionv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	appo11yv1alpha1 "github.com/grafana/ebpf-autoinstrument-operator/api/v1alpha1"
+)
+
+// WebhookConfigurationReconciler restricts the Pod webhook of the operator MutatingWebhookConfiguration
+// to the namespaces and Pods that the existing instrumenters might select, so an outage of the
+// operator doesn't block the admission of any other Pod.
+type WebhookConfigurationReconciler struct {
+	client.Client
+	// Name of the MutatingWebhookConfiguration that contains the Pod webhook
+	Name string
+	// Namespace where the operator is deployed. Its Pods are never intercepted by the Pod webhook.
+	Namespace string
+	// FailurePolicy of the Pod webhook. With the Ignore policy, the Pods are admitted without the
+	// instrumenter sidecar if the webhook is unavailable, and replaced later by the controllers.
+	// If empty, the failure policy of the MutatingWebhookConfiguration is kept.
+	FailurePolicy admissionv1.FailurePolicyType
+}
+
+//+kubebuilder:rbac:groups=admissionregistration.k8s.io,resources=mutatingwebhookconfigurations,verbs=get;list;watch;update
+
+// Reconcile updates the selectors of the Pod webhook from the current instrumenters
+func (r *WebhookConfigurationReconciler) Reconcile(ctx context.Context, _ ctrl.Request) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+	config := admissionv1.MutatingWebhookConfiguration{}
+	if err := r.Get(ctx, types.NamespacedName{Name: r.Name}, &config); err != nil {
+		if errors.IsNotFound(err) {
+			logger.Info("MutatingWebhookConfiguration not found. Ignoring", "name", r.Name)
+			return ctrl.Result{}, nil
+		}
+		return ctrl.Result{}, fmt.Errorf("reading MutatingWebhookConfiguration: %w", err)
+	}
+	instrumenters, err := r.instrumenters(ctx)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	nsSelector, objSelector := webhookSelectors(instrumenters, excludedNamespaces(r.Namespace))
+	changed := false
+	for i := range config.Webhooks {
+		wh := &config.Webhooks[i]
+		if wh.Name != appo11yv1alpha1.PodWebhookName {
+			continue
+		}
+		if !equality.Semantic.DeepEqual(wh.NamespaceSelector, nsSelector) ||
+			!equality.Semantic.DeepEqual(wh.ObjectSelector, objSelector) {
+			wh.NamespaceSelector, wh.ObjectSelector = nsSelector, objSelector
+			changed = true
+		}
+		if r.FailurePolicy != "" && (wh.FailurePolicy == nil || *wh.FailurePolicy != r.FailurePolicy) {
+			policy := r.FailurePolicy
+			wh.FailurePolicy = &policy
+			changed = true
+		}
+	}
+	if !changed {
+		return ctrl.Result{}, nil
+	}
+	logger.Info("updating Pod webhook", "namespaceSelector", nsSelector, "objectSelector", objSelector,
+		"failurePolicy", r.FailurePolicy)
+	if err := r.Update(ctx, &config); err != nil {
+		return ctrl.Result{}, fmt.Errorf("updating MutatingWebhookConfiguration: %w", err)
+	}
+	return ctrl.Result{}, nil
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *WebhookConfigurationReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		// restoring the selectors if the configuration is modified or reapplied
+		For(&admissionv1.MutatingWebhookConfiguration{},
+			builder.WithPredicates(predicate.NewPredicateFuncs(func(obj client.Object) bool {
+				return obj.GetName() == r.Name
+			}))).
+		Watches(&source.Kind{Type: &appo11yv1alpha1.Instrumenter{}},
+			handler.EnqueueRequestsFromMapFunc(r.configuration),
+			builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		Watches(&source.Kind{Type: &appo11yv1alpha1.ClusterInstrumenter{}},
+			handler.EnqueueRequestsFromMapFunc(r.configuration),
+			builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		Complete(r)
+}
+
+// configuration enqueues the managed MutatingWebhookConfiguration
+func (r *WebhookConfigurationReconciler) configuration(_ client.Object) []reconcile.Request {
+	return []reconcile.Request{{NamespacedName: types.NamespacedName{Name: r.Name}}}
+}
+
+func (r *WebhookConfigurationReconciler) instrumenters(ctx context.Context) ([]appo11yv1alpha1.InstrumenterObject, error) {
+	instrumenters := appo11yv1alpha1.InstrumenterList{}
+	if err := r.List(ctx, &instrumenters); err != nil {
+		return nil, fmt.Errorf("listing instrumenters: %w", err)
+	}
+	clusterInstrumenters := appo11yv1alpha1.ClusterInstrumenterList{}
+	if err := r.List(ctx, &clusterInstrumenters); err != nil {
+		return nil, fmt.Errorf("listing cluster instrumenters: %w", err)
+	}
+	all := make([]appo11yv1alpha1.InstrumenterObject, 0, len(instrumenters.Items)+len(clusterInstrumenters.Items))
+	for i := range instrumenters.Items {
+		all = append(all, &instrumenters.Items[i])
+	}
+	for i := range clusterInstrumenters.Items {
+		all = append(all, &clusterInstrumenters.Items[i])
+	}
+	return all, nil
+}
+
+// webhookSelectors returns the Pod webhook selectors, matching at least all the Pods that the
+// sidecar instrumenters might select, and never the Pods from the excluded namespaces
+func webhookSelectors(
+	instrumenters []appo11yv1alpha1.InstrumenterObject, excluded []string,
+) (nsSelector, objSelector *metav1.LabelSelector) {
+	exclude := metav1.LabelSelectorRequirement{
+		Key: corev1.LabelMetadataName, Operator: metav1.LabelSelectorOpNotIn, Values: excluded,
+	}
+	// the API server stores unset selectors as empty selectors, matching everything
+	objSelector = &metav1.LabelSelector{}
+	portLabels := map[string]struct{}{}
+	namespaces := map[string]struct{}{}
+	var clusterInstrumenters []appo11yv1alpha1.InstrumenterObject
+	for _, iq := range instrumenters {
+		if iq.GetMode() == appo11yv1alpha1.ModeDaemonSet {
+			continue
+		}
+		portLabels[iq.GetSpec().Selector.PortLabel] = struct{}{}
+		if iq.GetNamespace() == "" {
+			clusterInstrumenters = append(clusterInstrumenters, iq)
+		} else {
+			namespaces[iq.GetNamespace()] = struct{}{}
+		}
+	}
+	if len(portLabels) == 1 {
+		for portLabel := range portLabels {
+			objSelector = &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{{
+				Key: portLabel, Operator: metav1.LabelSelectorOpExists,
+			}}}
+		}
+	}
+	switch {
+	case len(clusterInstrumenters) == 1 && len(namespaces) == 0 &&
+		clusterInstrumenters[0].GetSpec().Selector.NamespaceSelector != nil:
+		nsSelector = clusterInstrumenters[0].GetSpec().Selector.NamespaceSelector.DeepCopy()
+		nsSelector.MatchExpressions = append(nsSelector.MatchExpressions, exclude)
+	case len(clusterInstrumenters) > 0:
+		nsSelector = &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{exclude}}
+	default:
+		nsSelector = &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{
+			namespacesIn(namespaces, excluded), exclude,
+		}}
+	}
+	return nsSelector, objSelector
+}
+
+// namespacesIn returns a requirement that matches the provided namespaces, except the excluded ones.
+// If there aren't namespaces left, the requirement doesn't match any namespace.
+func namespacesIn(namespaces map[string]struct{}, excluded []string) metav1.LabelSelectorRequirement {
+	for _, ns := range excluded {
+		delete(namespaces, ns)
+	}
+	if len(namespaces) == 0 {
+		return metav1.LabelSelectorRequirement{Key: corev1.LabelMetadataName, Operator: metav1.LabelSelectorOpDoesNotExist}
+	}
+	names := make([]string, 0, len(namespaces))
+	for ns := range namespaces {
+		names = append(names, ns)
+	}
+	sort.Strings(names)
+	return metav1.LabelSelectorRequirement{Key: corev1.LabelMetadataName, Operator: metav1.LabelSelectorOpIn, Values: names}
+}
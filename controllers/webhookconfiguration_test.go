@@ -0,0 +1,203 @@
+/*
+Copyright 2023 Grafana Labs <hello@grafana.com>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	admissionv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	appo11yv1alpha1 "github.com/grafana/ebpf-autoinstrument-operator/api/v1alpha1"
+	"github.com/grafana/ebpf-autoinstrument-operator/pkg/helper"
+)
+
+func TestWebhookSelectors(t *testing.T) {
+	instrumenter := func(ns, portLabel string) appo11yv1alpha1.InstrumenterObject {
+		return &appo11yv1alpha1.Instrumenter{ObjectMeta: metav1.ObjectMeta{Name: "instr", Namespace: ns},
+			Spec: appo11yv1alpha1.InstrumenterSpec{Selector: appo11yv1alpha1.Selector{PortLabel: portLabel}}}
+	}
+	clusterInstrumenter := func(portLabel string, nsLabels map[string]string) *appo11yv1alpha1.ClusterInstrumenter {
+		ci := &appo11yv1alpha1.ClusterInstrumenter{ObjectMeta: metav1.ObjectMeta{Name: "cluster"},
+			Spec: appo11yv1alpha1.ClusterInstrumenterSpec{InstrumenterSpec: appo11yv1alpha1.InstrumenterSpec{
+				Selector: appo11yv1alpha1.Selector{PortLabel: portLabel},
+			}}}
+		if nsLabels != nil {
+			ci.Spec.Selector.NamespaceSelector = &metav1.LabelSelector{MatchLabels: nsLabels}
+		}
+		return ci
+	}
+	daemonSet := func(ci *appo11yv1alpha1.ClusterInstrumenter) *appo11yv1alpha1.ClusterInstrumenter {
+		ci.Spec.Mode = appo11yv1alpha1.ModeDaemonSet
+		return ci
+	}
+	namespaces := map[string]map[string]string{
+		"kube-system": {"team": "payments"},
+		"operator":    {"team": "payments"},
+		"payments":    {"team": "payments"},
+		"frontend":    {"team": "frontend"},
+	}
+	for _, tc := range []struct {
+		name          string
+		instrumenters []appo11yv1alpha1.InstrumenterObject
+		namespaces    []string
+		podLabels     map[string]string
+		selectsPod    bool
+	}{
+		// the namespace selector doesn't match any namespace
+		{name: "no instrumenters",
+			podLabels: map[string]string{"instrument": "8080"}, selectsPod: true},
+		{name: "namespaced instrumenters",
+			instrumenters: []appo11yv1alpha1.InstrumenterObject{
+				instrumenter("payments", "instrument"), instrumenter("kube-system", "instrument"),
+			},
+			namespaces: []string{"payments"},
+			podLabels:  map[string]string{"instrument": "8080"}, selectsPod: true},
+		{name: "unlabeled pod",
+			instrumenters: []appo11yv1alpha1.InstrumenterObject{instrumenter("payments", "instrument")},
+			namespaces:    []string{"payments"},
+			podLabels:     map[string]string{"app": "foo"}},
+		{name: "different port labels",
+			instrumenters: []appo11yv1alpha1.InstrumenterObject{
+				instrumenter("payments", "instrument"), instrumenter("payments", "other"),
+			},
+			namespaces: []string{"payments"},
+			podLabels:  map[string]string{"app": "foo"}, selectsPod: true},
+		{name: "cluster instrumenter",
+			instrumenters: []appo11yv1alpha1.InstrumenterObject{clusterInstrumenter("instrument", nil)},
+			namespaces:    []string{"payments", "frontend"},
+			podLabels:     map[string]string{"instrument": "8080"}, selectsPod: true},
+		{name: "cluster instrumenter with namespace selector",
+			instrumenters: []appo11yv1alpha1.InstrumenterObject{
+				clusterInstrumenter("instrument", map[string]string{"team": "payments"}),
+			},
+			namespaces: []string{"payments"},
+			podLabels:  map[string]string{"instrument": "8080"}, selectsPod: true},
+		{name: "cluster and namespaced instrumenters",
+			instrumenters: []appo11yv1alpha1.InstrumenterObject{
+				clusterInstrumenter("instrument", map[string]string{"team": "payments"}),
+				instrumenter("frontend", "instrument"),
+			},
+			namespaces: []string{"payments", "frontend"},
+			podLabels:  map[string]string{"instrument": "8080"}, selectsPod: true},
+		// instrumenters in DaemonSet mode don't add sidecars, so they don't widen the selectors
+		{name: "cluster instrumenter in DaemonSet mode",
+			instrumenters: []appo11yv1alpha1.InstrumenterObject{
+				daemonSet(clusterInstrumenter("other", nil)),
+				instrumenter("frontend", "instrument"),
+			},
+			namespaces: []string{"frontend"},
+			podLabels:  map[string]string{"other": "8080"}},
+		{name: "only DaemonSet mode",
+			instrumenters: []appo11yv1alpha1.InstrumenterObject{daemonSet(clusterInstrumenter("instrument", nil))},
+			podLabels:     map[string]string{"instrument": "8080"}, selectsPod: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			nsSelector, objSelector := webhookSelectors(tc.instrumenters, []string{"kube-system", "operator"})
+			nsSel, err := metav1.LabelSelectorAsSelector(nsSelector)
+			if err != nil {
+				t.Fatalf("invalid namespace selector: %v", err)
+			}
+			var selected []string
+			for _, ns := range []string{"kube-system", "operator", "payments", "frontend"} {
+				nsLabels := labels.Set{corev1.LabelMetadataName: ns}
+				for k, v := range namespaces[ns] {
+					nsLabels[k] = v
+				}
+				if nsSel.Matches(nsLabels) {
+					selected = append(selected, ns)
+				}
+			}
+			if fmt.Sprint(selected) != fmt.Sprint(tc.namespaces) {
+				t.Errorf("expected namespaces %v to be selected. Got %v", tc.namespaces, selected)
+			}
+			objSel, err := metav1.LabelSelectorAsSelector(objSelector)
+			if err != nil {
+				t.Fatalf("invalid object selector: %v", err)
+			}
+			if selects := objSel.Matches(labels.Set(tc.podLabels)); selects != tc.selectsPod {
+				t.Errorf("expected the object selector to select the Pod: %v. Got %v", tc.selectsPod, selects)
+			}
+		})
+	}
+}
+
+var _ = Describe("Webhook configuration", Ordered, func() {
+	const ns = "webhook-config"
+	BeforeAll(func() {
+		createNamespace(ns)
+	})
+
+	It("should only send the Pods of the instrumented namespaces to the Pod webhook", func() {
+		sideEffects := admissionv1.SideEffectClassNone
+		webhook := func(name string) admissionv1.MutatingWebhook {
+			return admissionv1.MutatingWebhook{
+				Name: name, SideEffects: &sideEffects, AdmissionReviewVersions: []string{"v1"},
+				ClientConfig: admissionv1.WebhookClientConfig{URL: helper.Ptr("https://webhook.local/mutate")},
+			}
+		}
+		config := &admissionv1.MutatingWebhookConfiguration{
+			ObjectMeta: metav1.ObjectMeta{Name: "webhook-config"},
+			Webhooks:   []admissionv1.MutatingWebhook{webhook("other.kb.io"), webhook(appo11yv1alpha1.PodWebhookName)},
+		}
+		Expect(k8sClient.Create(ctx, config)).To(Succeed())
+		otherNsSelector := config.Webhooks[0].NamespaceSelector
+		otherObjSelector := config.Webhooks[0].ObjectSelector
+		instr := &appo11yv1alpha1.Instrumenter{
+			ObjectMeta: metav1.ObjectMeta{Name: "instr", Namespace: ns},
+			Spec: appo11yv1alpha1.InstrumenterSpec{
+				Selector: appo11yv1alpha1.Selector{PortLabel: "webhook-instrument-port"},
+			},
+		}
+		Expect(k8sClient.Create(ctx, instr)).To(Succeed())
+		r := WebhookConfigurationReconciler{
+			Client: k8sClient, Name: config.Name, Namespace: "operator", FailurePolicy: admissionv1.Ignore,
+		}
+
+		_, err := r.Reconcile(ctx, ctrl.Request{})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(config), config)).To(Succeed())
+		By("leaving the other webhooks untouched")
+		Expect(config.Webhooks[0].NamespaceSelector).To(Equal(otherNsSelector))
+		Expect(config.Webhooks[0].ObjectSelector).To(Equal(otherObjSelector))
+		nsSelector := config.Webhooks[1].NamespaceSelector
+		Expect(nsSelector).ToNot(BeNil())
+		Expect(nsSelector.MatchExpressions).To(HaveLen(2))
+		Expect(nsSelector.MatchExpressions[0].Values).To(ContainElement(ns))
+		Expect(config.Webhooks[1].FailurePolicy).To(Equal(helper.Ptr(admissionv1.Ignore)))
+		By("excluding the system and operator namespaces")
+		excluded := nsSelector.MatchExpressions[1].Values
+		Expect(excluded).To(HaveLen(len(appo11yv1alpha1.SystemNamespaces) + 1))
+		Expect(excluded[len(excluded)-1]).To(Equal("operator"))
+
+		By("ignoring a missing configuration")
+		r.Name = "missing"
+		_, err = r.Reconcile(ctx, ctrl.Request{})
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(k8sClient.Delete(ctx, instr)).To(Succeed())
+		expectNotFound(instr)
+		Expect(k8sClient.Delete(ctx, config)).To(Succeed())
+	})
+})
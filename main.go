@@ -18,12 +18,14 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"os"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
+	admissionv1 "k8s.io/api/admissionregistration/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
@@ -52,11 +54,21 @@ func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
+	var webhookConfiguration string
+	var webhookFailurePolicy string
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.StringVar(&webhookConfiguration, "webhook-configuration",
+		"ebpf-autoinstrument-operator-mutating-webhook-configuration",
+		"Name of the MutatingWebhookConfiguration whose Pod webhook selectors are managed by the operator. "+
+			"If empty, the selectors aren't managed.")
+	flag.StringVar(&webhookFailurePolicy, "webhook-failure-policy", string(admissionv1.Ignore),
+		"Failure policy of the Pod webhook: Ignore or Fail. With Ignore, the Pods are admitted without the "+
+			"instrumenter sidecar if the webhook is unavailable, and replaced later by the operator. "+
+			"It requires the --webhook-configuration flag.")
 	opts := zap.Options{
 		Development: true,
 	}
@@ -65,6 +77,13 @@ func main() {
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
+	failurePolicy := admissionv1.FailurePolicyType(webhookFailurePolicy)
+	if failurePolicy != admissionv1.Ignore && failurePolicy != admissionv1.Fail {
+		setupLog.Error(fmt.Errorf("invalid value: %q", webhookFailurePolicy),
+			"the webhook failure policy must be Ignore or Fail")
+		os.Exit(1)
+	}
+
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 		Scheme:                 scheme,
 		MetricsBindAddress:     metricsAddr,
@@ -90,12 +109,32 @@ func main() {
 	}
 
 	if err = (&controllers.InstrumenterReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
+		Client:    mgr.GetClient(),
+		Scheme:    mgr.GetScheme(),
+		Namespace: os.Getenv("POD_NAMESPACE"),
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "Instrumenter")
 		os.Exit(1)
 	}
+	if err = (&controllers.ClusterInstrumenterReconciler{
+		Client:    mgr.GetClient(),
+		Scheme:    mgr.GetScheme(),
+		Namespace: os.Getenv("POD_NAMESPACE"),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "ClusterInstrumenter")
+		os.Exit(1)
+	}
+	if webhookConfiguration != "" {
+		if err = (&controllers.WebhookConfigurationReconciler{
+			Client:        mgr.GetClient(),
+			Name:          webhookConfiguration,
+			Namespace:     os.Getenv("POD_NAMESPACE"),
+			FailurePolicy: failurePolicy,
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "WebhookConfiguration")
+			os.Exit(1)
+		}
+	}
 	if err = appo11yv1alpha1.SetupWebhookWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create webhook", "webhook", "Instrumenter")
 		os.Exit(1)
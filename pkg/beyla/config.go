@@ -0,0 +1,76 @@
+/*
+Copyright 2023 Grafana Labs <hello@grafana.com>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package beyla models the configuration file of the Beyla autoinstrumenter
+package beyla
+
+// Config is the subset of the autoinstrumenter configuration file that is managed by the operator
+type Config struct {
+	LogLevel   string      `json:"log_level,omitempty"`
+	Routes     *Routes     `json:"routes,omitempty"`
+	Attributes *Attributes `json:"attributes,omitempty"`
+	Filter     *Filters    `json:"filter,omitempty"`
+	Discovery  *Discovery  `json:"discovery,omitempty"`
+}
+
+type Routes struct {
+	Patterns        []string `json:"patterns,omitempty"`
+	IgnoredPatterns []string `json:"ignored_patterns,omitempty"`
+	IgnoreMode      string   `json:"ignore_mode,omitempty"`
+	Unmatched       string   `json:"unmatched,omitempty"`
+}
+
+type Attributes struct {
+	Kubernetes *Kubernetes          `json:"kubernetes,omitempty"`
+	Select     map[string]Selection `json:"select,omitempty"`
+}
+
+type Kubernetes struct {
+	Enable bool `json:"enable"`
+}
+
+// Selection of the attributes reported by a metric family
+type Selection struct {
+	Include []string `json:"include,omitempty"`
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+type Filters struct {
+	Application map[string]MatchFilter `json:"application,omitempty"`
+	Network     map[string]MatchFilter `json:"network,omitempty"`
+}
+
+// MatchFilter keeps the telemetry whose attribute values match, or don't match, a glob pattern
+type MatchFilter struct {
+	Match    string `json:"match,omitempty"`
+	NotMatch string `json:"not_match,omitempty"`
+}
+
+type Discovery struct {
+	Services                        []Service `json:"services,omitempty"`
+	ExcludeOTelInstrumentedServices *bool     `json:"exclude_otel_instrumented_services,omitempty"`
+	SkipGoSpecificTracers           bool      `json:"skip_go_specific_tracers,omitempty"`
+}
+
+// Service selects the processes to instrument, and the name they are reported with
+type Service struct {
+	Name         string `json:"name,omitempty"`
+	Namespace    string `json:"namespace,omitempty"`
+	OpenPorts    string `json:"open_ports,omitempty"`
+	K8sNamespace string `json:"k8s_namespace,omitempty"`
+	K8sOwnerName string `json:"k8s_owner_name,omitempty"`
+	K8sPodName   string `json:"k8s_pod_name,omitempty"`
+}
@@ -0,0 +1,112 @@
+/*
+Copyright 2023 Grafana Labs <hello@grafana.com>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package owner resolves the chain of workloads that own a Pod
+package owner
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	KindReplicaSet  = "ReplicaSet"
+	KindDeployment  = "Deployment"
+	KindStatefulSet = "StatefulSet"
+	KindDaemonSet   = "DaemonSet"
+	KindJob         = "Job"
+	KindCronJob     = "CronJob"
+)
+
+// Ref identifies a workload owning a Pod
+type Ref struct {
+	Kind string
+	Name string
+}
+
+// Chain of owners of a Pod, from its direct controller to the top-level workload.
+// For example, Pod → ReplicaSet → Deployment or Pod → Job → CronJob.
+type Chain []Ref
+
+// Top returns the top-level workload owning the Pod, if any
+func (c Chain) Top() (Ref, bool) {
+	if len(c) == 0 {
+		return Ref{}, false
+	}
+	return c[len(c)-1], true
+}
+
+// Find returns the owner of the given kind, if any
+func (c Chain) Find(kind string) (Ref, bool) {
+	for _, r := range c {
+		if r.Kind == kind {
+			return r, true
+		}
+	}
+	return Ref{}, false
+}
+
+// Resolve returns the controller owners of the Pod, up to the top-level workload. Only the
+// ReplicaSets and the Jobs are looked up, to find their Deployments and CronJobs.
+func Resolve(ctx context.Context, c client.Reader, pod *corev1.Pod) (Chain, error) {
+	ref := metav1.GetControllerOf(pod)
+	if ref == nil {
+		return nil, nil
+	}
+	chain := Chain{{Kind: ref.Kind, Name: ref.Name}}
+	var parent client.Object
+	switch ref.Kind {
+	case KindReplicaSet:
+		parent = &appsv1.ReplicaSet{}
+	case KindJob:
+		parent = &batchv1.Job{}
+	default:
+		return chain, nil
+	}
+	if err := c.Get(ctx, client.ObjectKey{Namespace: pod.Namespace, Name: ref.Name}, parent); err != nil {
+		if !errors.IsNotFound(err) {
+			return nil, fmt.Errorf("reading %s %s/%s: %w", ref.Kind, pod.Namespace, ref.Name, err)
+		}
+		// The owner might not be in the informers' cache yet. For Deployments,
+		// we can still infer its name from the ReplicaSet name
+		if deployment, ok := deploymentFromReplicaSet(pod, ref.Name); ok {
+			chain = append(chain, Ref{Kind: KindDeployment, Name: deployment})
+		}
+		return chain, nil
+	}
+	if ref = metav1.GetControllerOf(parent); ref != nil {
+		chain = append(chain, Ref{Kind: ref.Kind, Name: ref.Name})
+	}
+	return chain, nil
+}
+
+// deploymentFromReplicaSet infers the name of the Deployment owning a ReplicaSet, as its
+// name is composed by the Deployment name and the pod-template-hash label of the Pod.
+func deploymentFromReplicaSet(pod *corev1.Pod, rsName string) (string, bool) {
+	hash := pod.Labels[appsv1.DefaultDeploymentUniqueLabelKey]
+	if hash == "" || !strings.HasSuffix(rsName, "-"+hash) {
+		return "", false
+	}
+	return strings.TrimSuffix(rsName, "-"+hash), true
+}
@@ -0,0 +1,112 @@
+/*
+Copyright 2023 Grafana Labs <hello@grafana.com>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package owner
+
+import (
+	"context"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/grafana/ebpf-autoinstrument-operator/pkg/helper"
+)
+
+func controlledBy(kind, name string) []metav1.OwnerReference {
+	return []metav1.OwnerReference{{Kind: kind, Name: name, Controller: helper.Ptr(true)}}
+}
+
+func TestResolve(t *testing.T) {
+	cl := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(
+		&appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{
+			Namespace: "ns", Name: "backend-5d4f8c", OwnerReferences: controlledBy(KindDeployment, "backend"),
+		}},
+		&batchv1.Job{ObjectMeta: metav1.ObjectMeta{
+			Namespace: "ns", Name: "report-2789", OwnerReferences: controlledBy(KindCronJob, "report"),
+		}},
+	).Build()
+
+	for _, tc := range []struct {
+		name     string
+		pod      corev1.Pod
+		expected Chain
+	}{
+		{name: "ownerless pod"},
+		{name: "deployment",
+			pod: corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+				Namespace: "ns", OwnerReferences: controlledBy(KindReplicaSet, "backend-5d4f8c"),
+			}},
+			expected: Chain{{KindReplicaSet, "backend-5d4f8c"}, {KindDeployment, "backend"}}},
+		{name: "deployment with uncached replicaset",
+			pod: corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+				Namespace:       "ns",
+				OwnerReferences: controlledBy(KindReplicaSet, "frontend-7b9c"),
+				Labels:          map[string]string{appsv1.DefaultDeploymentUniqueLabelKey: "7b9c"},
+			}},
+			expected: Chain{{KindReplicaSet, "frontend-7b9c"}, {KindDeployment, "frontend"}}},
+		{name: "unknown replicaset",
+			pod: corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+				Namespace: "ns", OwnerReferences: controlledBy(KindReplicaSet, "standalone"),
+			}},
+			expected: Chain{{KindReplicaSet, "standalone"}}},
+		{name: "cronjob",
+			pod: corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+				Namespace: "ns", OwnerReferences: controlledBy(KindJob, "report-2789"),
+			}},
+			expected: Chain{{KindJob, "report-2789"}, {KindCronJob, "report"}}},
+		{name: "statefulset",
+			pod: corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+				Namespace: "ns", OwnerReferences: controlledBy(KindStatefulSet, "db"),
+			}},
+			expected: Chain{{KindStatefulSet, "db"}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			chain, err := Resolve(context.Background(), cl, &tc.pod)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(chain) != len(tc.expected) {
+				t.Fatalf("expected %v. Got %v", tc.expected, chain)
+			}
+			for i := range chain {
+				if chain[i] != tc.expected[i] {
+					t.Errorf("expected %v. Got %v", tc.expected, chain)
+				}
+			}
+		})
+	}
+}
+
+func TestChain(t *testing.T) {
+	chain := Chain{{KindReplicaSet, "backend-5d4f8c"}, {KindDeployment, "backend"}}
+	if top, ok := chain.Top(); !ok || top.Name != "backend" {
+		t.Errorf("unexpected top owner: %v", top)
+	}
+	if rs, ok := chain.Find(KindReplicaSet); !ok || rs.Name != "backend-5d4f8c" {
+		t.Errorf("unexpected replicaset: %v", rs)
+	}
+	if _, ok := chain.Find(KindCronJob); ok {
+		t.Error("not expecting to find a CronJob")
+	}
+	if _, ok := Chain(nil).Top(); ok {
+		t.Error("not expecting a top owner for an empty chain")
+	}
+}